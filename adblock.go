@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	errCosmeticRule      = errors.New("cosmetic rules are not supported")
+	errUnsupportedRule   = errors.New("only domain rules (||example.com^) are supported")
+	errUnsupportedOption = errors.New("unsupported option")
+)
+
+// List represents the parsed rules of a blocklist
+type List struct {
+	Block       map[string]bool // Blocked domains (true if $important)
+	Allow       map[string]bool // Exception (@@) domains
+	Unsupported []string        // Rules which were skipped, with line numbers
+}
+
+// adblockRule represents the DNS relevant parts of an Adblock Plus style
+// network rule
+type adblockRule struct {
+	domain    string
+	exception bool
+	important bool
+	badfilter bool
+}
+
+func newList() *List {
+	return &List{Block: make(map[string]bool), Allow: make(map[string]bool)}
+}
+
+// parseHostsList parses a hosts file (or a file with one domain per line).
+func parseHostsList(r io.Reader) (*List, error) {
+	l := newList()
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		// Parse line and trim any dots
+		k := strings.Trim(parseRecord(scanner.Text()), ".")
+
+		// Ignore records that don't appear to be valid
+		if !isValidDomainName(k) {
+			continue
+		}
+
+		l.Block[strings.ToLower(k)] = false
+	}
+
+	return l, scanner.Err()
+}
+
+// parseAdblockList parses the network level subset of the Adblock Plus (and
+// uBlock Origin/AdGuard) filter syntax. Block rules are blocked records,
+// exception rules are allowlisted, $important block rules take precedence over
+// exceptions, and $badfilter rules disable the otherwise identical rule.
+func parseAdblockList(r io.Reader) (*List, error) {
+	var rules []adblockRule
+
+	l := newList()
+	bad := make(map[adblockRule]bool)
+	scanner := bufio.NewScanner(r)
+
+	for n := 1; scanner.Scan(); n++ {
+		rule, err := parseAdblockRule(scanner.Text())
+		if err != nil {
+			l.Unsupported = append(l.Unsupported, fmt.Sprintf("line %d: %s (%s)", n, strings.TrimSpace(scanner.Text()), err))
+			continue
+		} else if rule.domain == "" {
+			// Comment or empty line
+			continue
+		}
+
+		if rule.badfilter {
+			rule.badfilter = false
+			bad[rule] = true
+			continue
+		}
+
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		if bad[rule] {
+			continue
+		}
+
+		if rule.exception {
+			l.Allow[rule.domain] = true
+		} else {
+			l.Block[rule.domain] = l.Block[rule.domain] || rule.important
+		}
+	}
+
+	return l, nil
+}
+
+// parseAdblockRule parses a single line of an Adblock Plus style filter list.
+// A rule without a domain is returned for comments and empty lines.
+func parseAdblockRule(s string) (adblockRule, error) {
+	var rule adblockRule
+
+	s = strings.TrimSpace(s)
+
+	// Comments, headers and empty lines
+	if s == "" || s[0] == '!' || s[0] == '[' {
+		return rule, nil
+	}
+
+	// Element hiding (and other cosmetic) rules
+	for _, sep := range []string{"##", "#@#", "#?#", "#$#", "#%#"} {
+		if strings.Contains(s, sep) {
+			return rule, errCosmeticRule
+		}
+	}
+
+	// Hosts file comments
+	if s[0] == '#' {
+		return rule, nil
+	}
+
+	if strings.HasPrefix(s, "@@") {
+		rule.exception = true
+		s = s[2:]
+	}
+
+	if i := strings.LastIndexByte(s, '$'); i >= 0 {
+		for _, opt := range strings.Split(s[i+1:], ",") {
+			switch opt {
+			case "important":
+				rule.important = true
+			case "badfilter":
+				rule.badfilter = true
+			default:
+				return rule, fmt.Errorf("%s: %s", errUnsupportedOption, opt)
+			}
+		}
+		s = s[:i]
+	}
+
+	switch {
+	case strings.HasPrefix(s, "||"):
+		// Domain anchor, which must be followed by a separator
+		s = strings.TrimSuffix(strings.TrimSuffix(s[2:], "|"), "^")
+	case !rule.exception && !rule.important && !rule.badfilter && !strings.ContainsAny(s, "|^/*"):
+		// Hosts file syntax (ignoring invalid records, such as localhost)
+		if s = strings.ToLower(strings.Trim(parseRecord(s), ".")); isValidDomainName(s) {
+			rule.domain = s
+		}
+		return rule, nil
+	default:
+		return rule, errUnsupportedRule
+	}
+
+	s = strings.ToLower(strings.Trim(s, "."))
+	if !isValidDomainName(s) || strings.ContainsAny(s, "|^/*$") {
+		return rule, errUnsupportedRule
+	}
+
+	rule.domain = s
+	return rule, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_parseAdblockRule(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want adblockRule
+		err  bool
+	}{
+		{"", adblockRule{}, false},
+		{"! comment ##", adblockRule{}, false},
+		{"[Adblock Plus 2.0]", adblockRule{}, false},
+		{"# hosts comment", adblockRule{}, false},
+		{"||Ads.Example.test^", adblockRule{domain: "ads.example.test"}, false},
+		{"||ads.example.test^|", adblockRule{domain: "ads.example.test"}, false},
+		{"@@||example.test^", adblockRule{domain: "example.test", exception: true}, false},
+		{"||ads.example.test^$important", adblockRule{domain: "ads.example.test", important: true}, false},
+		{"||ads.example.test^$badfilter", adblockRule{domain: "ads.example.test", badfilter: true}, false},
+		{"0.0.0.0 ads.example.test", adblockRule{domain: "ads.example.test"}, false},
+		{"ads.example.test", adblockRule{domain: "ads.example.test"}, false},
+		{"127.0.0.1 localhost", adblockRule{}, false},
+		{"example.test##.banner", adblockRule{}, true},
+		{"#@#.banner", adblockRule{}, true},
+		{"||ads.example.test^$third-party", adblockRule{}, true},
+		{"||example.test/ads/*", adblockRule{}, true},
+		{"||ads*.example.test^", adblockRule{}, true},
+		{"/banner/*/img^", adblockRule{}, true},
+		{"@@example.test", adblockRule{}, true},
+	} {
+		rule, err := parseAdblockRule(tt.s)
+		testEqual(t, "parseAdblockRule("+tt.s+") err = %+v, want %+v", err != nil, tt.err)
+		if !tt.err {
+			testEqual(t, "parseAdblockRule("+tt.s+") = %+v, want %+v", rule, tt.want)
+		}
+	}
+}
+
+func Test_parseAdblockList(t *testing.T) {
+	l, err := parseAdblockList(strings.NewReader(strings.Join([]string{
+		"! Title: Test",
+		"||ads.test^",
+		"||tracker.test^",
+		"||tracker.test^$badfilter",
+		"||important.test^$important",
+		"||important.test^",
+		"@@||allowed.test^",
+		"@@||unallowed.test^",
+		"@@||unallowed.test^$badfilter",
+		"test##.banner",
+		"||ads.test^$script",
+	}, "\n")))
+	testEqual(t, "parseAdblockList() err = %+v, want %+v", err, nil)
+	testEqual(t, "parseAdblockList() Block = %+v, want %+v", l.Block, map[string]bool{"ads.test": false, "important.test": true})
+	testEqual(t, "parseAdblockList() Allow = %+v, want %+v", l.Allow, map[string]bool{"allowed.test": true})
+	testEqual(t, "parseAdblockList() Unsupported = %+v, want %+v", l.Unsupported, []string{
+		"line 10: test##.banner (cosmetic rules are not supported)",
+		"line 11: ||ads.test^$script (unsupported option: script)",
+	})
+}
+
+func Test_parseHostsList(t *testing.T) {
+	l, err := parseHostsList(strings.NewReader("# comment\n127.0.0.1 localhost\n0.0.0.0 Ads.test\n"))
+	testEqual(t, "parseHostsList() err = %+v, want %+v", err, nil)
+	testEqual(t, "parseHostsList() Block = %+v, want %+v", l.Block, map[string]bool{"ads.test": false})
+	testEqual(t, "parseHostsList() Allow = %+v, want %+v", l.Allow, map[string]bool{})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxNegativeTTL caps how long negative (NXDOMAIN/NODATA) responses are cached
+// (RFC 2308 section 5 recommends one to three hours).
+const maxNegativeTTL = 3 * 60 * 60
+
+// Cache represents a bounded, TTL respecting DNS response cache
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	hits    uint64
+	misses  uint64
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// CacheStats represents a snapshot of the cache counters
+type CacheStats struct {
+	Size    int    `json:"size"`
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// newCache returns a cache holding at most size responses. A size of 0
+// disables caching.
+func newCache(size int) *Cache {
+	return &Cache{
+		size:    size,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns a copy of the cached response to the passed query (with its ID
+// and TTLs adjusted), or nil if there is no fresh response cached.
+func (c *Cache) get(r *dns.Msg) *dns.Msg {
+	if c.size <= 0 || len(r.Question) != 1 {
+		return nil
+	}
+
+	k := newCacheKey(r.Question[0])
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[k]
+	if !ok {
+		c.misses++
+		return nil
+	}
+
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		// Expired
+		c.remove(el)
+		c.misses++
+		return nil
+	}
+
+	c.lru.MoveToFront(el)
+	c.hits++
+
+	m := e.msg.Copy()
+	m.Id = r.Id
+	ageTTLs(m, uint32(now.Sub(e.stored)/time.Second))
+
+	return m
+}
+
+// put caches the passed response, if it is cacheable.
+func (c *Cache) put(m *dns.Msg) {
+	if c.size <= 0 || len(m.Question) != 1 || m.Truncated {
+		return
+	}
+
+	ttl, ok := cacheTTL(m)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	e := &cacheEntry{
+		key:     newCacheKey(m.Question[0]),
+		msg:     m.Copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+
+	// Evict the least recently used responses to make room
+	for c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+	}
+
+	c.entries[e.key] = c.lru.PushFront(e)
+}
+
+// flush removes every cached response.
+func (c *Cache) flush() {
+	c.mu.Lock()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+	c.mu.Unlock()
+}
+
+// stats returns a snapshot of the cache counters.
+func (c *Cache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{Size: c.size, Entries: c.lru.Len(), Hits: c.hits, Misses: c.misses}
+}
+
+// remove drops the passed element. The caller must hold c.mu.
+func (c *Cache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*cacheEntry).key)
+	c.lru.Remove(el)
+}
+
+func newCacheKey(q dns.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+}
+
+// cacheTTL determines how long the passed response may be cached for. Positive
+// responses use their lowest record TTL, while negative responses use the SOA
+// record of the authority section (RFC 2308 section 5).
+func cacheTTL(m *dns.Msg) (uint32, bool) {
+	switch {
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0:
+		return minTTL(m), true
+	case m.Rcode == dns.RcodeSuccess, m.Rcode == dns.RcodeNameError:
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				if ttl > maxNegativeTTL {
+					ttl = maxNegativeTTL
+				}
+
+				return ttl, true
+			}
+		}
+	}
+
+	// Errors and negative responses without a SOA record aren't cached
+	return 0, false
+}
+
+// minTTL returns the lowest TTL of the records in the passed response.
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				// Skip EDNS pseudo-records
+				continue
+			}
+
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+
+	return ttl
+}
+
+// ageTTLs decrements the TTL of the records in the passed response by age.
+func ageTTLs(m *dns.Msg, age uint32) {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				if hdr.Ttl > age {
+					hdr.Ttl -= age
+				} else {
+					hdr.Ttl = 0
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testCacheMsg(name string, qtype uint16, rcode int, rrs ...string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	m.Rcode = rcode
+
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+
+		if rr.Header().Rrtype == dns.TypeSOA {
+			m.Ns = append(m.Ns, rr)
+		} else {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+
+	return m
+}
+
+func TestCache_get_put(t *testing.T) {
+	c := newCache(10)
+
+	q := new(dns.Msg)
+	q.SetQuestion("Test.Test.", dns.TypeA)
+	testEqual(t, "get() = %+v, want %+v", c.get(q) == nil, true)
+
+	c.put(testCacheMsg("test.test.", dns.TypeA, dns.RcodeSuccess, "test.test. 300 IN A 127.0.0.1"))
+	m := c.get(q)
+	if m == nil {
+		t.Fatalf("get() = nil, want response")
+	}
+	testEqual(t, "get() Id = %+v, want %+v", m.Id, q.Id)
+	testEqual(t, "get() Answer = %+v, want %+v", m.Answer[0].String(), "test.test.\t300\tIN\tA\t127.0.0.1")
+
+	// Other types and classes aren't matched
+	q.SetQuestion("test.test.", dns.TypeAAAA)
+	testEqual(t, "get(AAAA) = %+v, want %+v", c.get(q) == nil, true)
+
+	// TTLs are aged
+	c.entries[cacheKey{"test.test.", dns.TypeA, dns.ClassINET}].Value.(*cacheEntry).stored = time.Now().Add(-100 * time.Second)
+	q.SetQuestion("test.test.", dns.TypeA)
+	m = c.get(q)
+	testEqual(t, "get() aged TTL = %+v, want %+v", m.Answer[0].Header().Ttl, uint32(200))
+
+	// Expired responses are removed
+	c.entries[cacheKey{"test.test.", dns.TypeA, dns.ClassINET}].Value.(*cacheEntry).expires = time.Now()
+	testEqual(t, "get() expired = %+v, want %+v", c.get(q) == nil, true)
+	testEqual(t, "stats() = %+v, want %+v", c.stats(), CacheStats{Size: 10, Entries: 0, Hits: 2, Misses: 3})
+}
+
+func TestCache_put(t *testing.T) {
+	c := newCache(2)
+
+	// Errors, zero TTLs and negative responses without a SOA aren't cached
+	c.put(testCacheMsg("servfail.test.", dns.TypeA, dns.RcodeServerFailure))
+	c.put(testCacheMsg("nxdomain.test.", dns.TypeA, dns.RcodeNameError))
+	c.put(testCacheMsg("zero.test.", dns.TypeA, dns.RcodeSuccess, "zero.test. 0 IN A 127.0.0.1"))
+	testEqual(t, "stats().Entries = %+v, want %+v", c.stats().Entries, 0)
+
+	// Negative responses use the SOA minimum
+	c.put(testCacheMsg("nxdomain.test.", dns.TypeA, dns.RcodeNameError, "test. 3600 IN SOA ns.test. admin.test. 1 7200 900 1209600 60"))
+	testEqual(t, "stats().Entries = %+v, want %+v", c.stats().Entries, 1)
+	e := c.entries[cacheKey{"nxdomain.test.", dns.TypeA, dns.ClassINET}].Value.(*cacheEntry)
+	testEqual(t, "negative TTL = %+v, want %+v", e.expires.Sub(e.stored), 60*time.Second)
+
+	// Least recently used responses are evicted
+	c.put(testCacheMsg("one.test.", dns.TypeA, dns.RcodeSuccess, "one.test. 300 IN A 127.0.0.1"))
+	c.put(testCacheMsg("two.test.", dns.TypeA, dns.RcodeSuccess, "two.test. 300 IN A 127.0.0.1"))
+	testEqual(t, "stats().Entries = %+v, want %+v", c.stats().Entries, 2)
+	_, ok := c.entries[cacheKey{"nxdomain.test.", dns.TypeA, dns.ClassINET}]
+	testEqual(t, "evicted = %+v, want %+v", ok, false)
+
+	// Disabled
+	c = newCache(0)
+	c.put(testCacheMsg("one.test.", dns.TypeA, dns.RcodeSuccess, "one.test. 300 IN A 127.0.0.1"))
+	testEqual(t, "stats().Entries = %+v, want %+v", c.stats().Entries, 0)
+}
+
+func TestCache_flush(t *testing.T) {
+	c := newCache(10)
+
+	c.put(testCacheMsg("one.test.", dns.TypeA, dns.RcodeSuccess, "one.test. 300 IN A 127.0.0.1"))
+	testEqual(t, "stats().Entries = %+v, want %+v", c.stats().Entries, 1)
+	c.flush()
+	testEqual(t, "stats().Entries = %+v, want %+v", c.stats().Entries, 0)
+}
+
+func Test_cacheTTL(t *testing.T) {
+	ttl, ok := cacheTTL(testCacheMsg("test.test.", dns.TypeA, dns.RcodeSuccess, "test.test. 300 IN CNAME other.test.", "other.test. 30 IN A 127.0.0.1"))
+	testEqual(t, "cacheTTL() = %+v, want %+v", ttl, uint32(30))
+	testEqual(t, "cacheTTL() ok = %+v, want %+v", ok, true)
+
+	// NODATA
+	ttl, ok = cacheTTL(testCacheMsg("test.test.", dns.TypeA, dns.RcodeSuccess, "test. 30 IN SOA ns.test. admin.test. 1 7200 900 1209600 60"))
+	testEqual(t, "cacheTTL(NODATA) = %+v, want %+v", ttl, uint32(30))
+	testEqual(t, "cacheTTL(NODATA) ok = %+v, want %+v", ok, true)
+
+	// Capped
+	ttl, _ = cacheTTL(testCacheMsg("test.test.", dns.TypeA, dns.RcodeNameError, "test. 86400 IN SOA ns.test. admin.test. 1 7200 900 1209600 86400"))
+	testEqual(t, "cacheTTL(NXDOMAIN) = %+v, want %+v", ttl, uint32(maxNegativeTTL))
+
+	_, ok = cacheTTL(testCacheMsg("test.test.", dns.TypeA, dns.RcodeRefused))
+	testEqual(t, "cacheTTL(REFUSED) ok = %+v, want %+v", ok, false)
+}
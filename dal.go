@@ -3,27 +3,85 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
-var errRecordNotFound = errors.New("record not found")
+// pauseSweepInterval is how often expired record pauses are swept
+const pauseSweepInterval = time.Minute
+
+// recordsVersion is the version of the record format (see migrateRecords)
+const recordsVersion = 1
+
+// timeNow returns the time records are stamped with (replaced by the tests)
+var timeNow = time.Now
+
+var (
+	errRecordNotFound       = errors.New("record not found")
+	errSubscriptionNotFound = errors.New("subscription not found")
+	errGroupNotFound        = errors.New("group not found")
+	errSettingNotFound      = errors.New("setting not found")
+	errLocalRecordNotFound  = errors.New("local record not found")
+)
 
 // Record represents a hosts record
 type Record struct {
-	Paused bool `json:"paused"`
+	Paused      bool       `json:"paused"`
+	PausedUntil *time.Time `json:"pausedUntil,omitempty"` // Nil if paused indefinitely
+	Important   bool       `json:"important,omitempty"`   // Takes precedence over the allowlist
+	Source      string     `json:"source,omitempty"`      // Subscription name (empty if added manually or imported)
+	File        string     `json:"file,omitempty"`        // Name of the file it was imported from
+	Comment     string     `json:"comment,omitempty"`
+	Created     *time.Time `json:"created,omitempty"` // Nil if added before it was tracked
+	Updated     *time.Time `json:"updated,omitempty"`
+	Hits        uint64     `json:"hits,omitempty"`
+	LastHit     *time.Time `json:"lastHit,omitempty"`
+}
+
+// Group represents a named group of clients, and the policy applied to their
+// queries
+type Group struct {
+	Clients     []string `json:"clients"`               // IP addresses and CIDR ranges
+	Sources     []string `json:"sources,omitempty"`     // Record sources which apply (all, if empty)
+	NoAllowlist bool     `json:"noAllowlist,omitempty"` // Ignore the allowlist
+	BlockMode   string   `json:"blockMode,omitempty"`   // Overrides -dns-block-mode
+}
+
+// Subscription represents a blocklist fetched from a URL on a schedule
+type Subscription struct {
+	URL          string    `json:"url"`
+	Format       string    `json:"format"`
+	Enabled      bool      `json:"enabled"`
+	Interval     string    `json:"interval"` // e.g. "24h"
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	LastUpdated  time.Time `json:"lastUpdated"`
+	LastError    string    `json:"lastError,omitempty"`
+	Count        int       `json:"count"`
+	Skipped      int       `json:"skipped,omitempty"`     // Domains already blocked (manually or by another source)
+	Exceptions   int       `json:"exceptions,omitempty"`  // Allowlisted (@@) domains
+	Unsupported  int       `json:"unsupported,omitempty"` // Skipped rules
 }
 
 func (r *Record) isAllowed() bool {
-	// A paused record is an allowed record
-	return r.Paused
+	// A paused record is an allowed record (until its pause expires)
+	return r.Paused && !r.isPauseExpired(time.Now())
+}
+
+// isPauseExpired checks whether the record's timed pause expired at the passed
+// time.
+func (r *Record) isPauseExpired(now time.Time) bool {
+	return r.PausedUntil != nil && !r.PausedUntil.After(now)
 }
 
 func (r *Record) jsonEncode() ([]byte, error) {
@@ -43,6 +101,50 @@ func (r *Record) jsonDecode(data []byte) (*Record, error) {
 	return r, nil
 }
 
+// decodeRecord decodes the passed stored record, including the empty values
+// (and plain {"paused":...} values) stored before records carried metadata.
+func decodeRecord(v []byte) (*Record, error) {
+	var r *Record
+
+	if len(v) == 0 {
+		return &Record{}, nil
+	}
+
+	return r.jsonDecode(v)
+}
+
+// putRecord stores the passed record in the passed (blacklist) bucket, stamping
+// its created and updated times. The created time and hit counters of the
+// record it replaces (if any) are kept.
+func putRecord(b *bolt.Bucket, key string, r *Record, now time.Time) error {
+	var rec Record
+
+	if r != nil {
+		rec = *r
+	}
+
+	k := []byte(strings.ToLower(key))
+	now = now.UTC().Truncate(time.Second)
+
+	rec.Created, rec.Updated = &now, &now
+	rec.Hits, rec.LastHit = 0, nil
+	if v := b.Get(k); v != nil {
+		old, err := decodeRecord(v)
+		if err != nil {
+			return err
+		}
+
+		rec.Created, rec.Hits, rec.LastHit = old.Created, old.Hits, old.LastHit
+	}
+
+	v, err := rec.jsonEncode()
+	if err != nil {
+		return err
+	}
+
+	return b.Put(k, v)
+}
+
 func (db *DB) keyCount() (int, error) {
 	var stats bolt.BucketStats
 
@@ -67,13 +169,9 @@ func (db *DB) get(key string) (*Record, error) {
 		v := tx.Bucket(blacklistKey).Get([]byte(strings.ToLower(key)))
 		if v == nil {
 			return errRecordNotFound
-		} else if len(v) == 0 {
-			// Empty value (likely due to hosts import)
-			r = &Record{}
-			return nil
 		}
 
-		r, err = r.jsonDecode(v)
+		r, err = decodeRecord(v)
 		return err
 	})
 	if err != nil {
@@ -83,20 +181,72 @@ func (db *DB) get(key string) (*Record, error) {
 	return r, nil
 }
 
-func (db *DB) put(key string, r *Record) error {
-	err := db.Update(func(tx *bolt.Tx) error {
+// match looks up the given name and each of its parent domains (from most
+// specific to least), returning the key and record of the first match. Only
+// the records from sources which apply to the passed group (if any) match.
+func (db *DB) match(name string, g *Group) (string, *Record, error) {
+	var key string
+	var r *Record
+
+	err := db.View(func(tx *bolt.Tx) error {
 		var err error
 		var v []byte
 
-		// Check for record data
-		if r != nil {
-			v, err = r.jsonEncode()
-			if err != nil {
-				return err
+		key, v = matchKey(tx.Bucket(blacklistKey), name, func(v []byte) bool {
+			var r *Record
+
+			// Skip the records from sources which don't apply to the group
+			if g == nil {
+				return true
+			} else if len(v) == 0 {
+				// Empty value (manually added)
+				return g.hasSource("")
 			}
+
+			r, err := r.jsonDecode(v)
+			return err != nil || g.hasSource(r.Source)
+		})
+		if v == nil {
+			return errRecordNotFound
+		} else if len(v) == 0 {
+			// Empty value (likely due to hosts import)
+			r = &Record{}
+			return nil
+		}
+
+		r, err = r.jsonDecode(v)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return key, r, nil
+}
+
+// matchKey looks up the given name and each of its parent domains (from most
+// specific to least) in the passed bucket, returning the first matching key
+// (whose value is accepted by the passed function, if any) and its value.
+func matchKey(b *bolt.Bucket, name string, accept func(v []byte) bool) (string, []byte) {
+	n := strings.ToLower(strings.TrimSuffix(name, "."))
+
+	for {
+		if v := b.Get([]byte(n)); v != nil && (accept == nil || accept(v)) {
+			return n, v
 		}
 
-		return tx.Bucket(blacklistKey).Put([]byte(strings.ToLower(key)), v)
+		// Move on to the parent domain, if any
+		i := strings.IndexByte(n, '.')
+		if i < 0 {
+			return "", nil
+		}
+		n = n[i+1:]
+	}
+}
+
+func (db *DB) put(key string, r *Record) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		return putRecord(tx.Bucket(blacklistKey), key, r, timeNow())
 	})
 
 	return err
@@ -104,7 +254,24 @@ func (db *DB) put(key string, r *Record) error {
 
 func (db *DB) delete(key string) error {
 	err := db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(blacklistKey).Delete([]byte(strings.ToLower(key)))
+		b := tx.Bucket(blacklistKey)
+		k := []byte(strings.ToLower(key))
+
+		v := b.Get(k)
+		if v == nil {
+			return nil
+		}
+
+		r, err := decodeRecord(v)
+		if err != nil {
+			return err
+		}
+
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+
+		return resetSkippingSubscriptions(tx, r.Source)
 	})
 
 	return err
@@ -132,15 +299,10 @@ func (db *DB) find(search string) map[string]*Record {
 				sk := string(k)
 
 				if strings.Contains(sk, search) {
-					if len(v) == 0 {
-						// Empty value (likely due to hosts import)
+					if r, err = decodeRecord(v); err != nil {
+						// Log the decode error and continue
+						log.Printf("decodeRecord(%s) Error: %s\n", sk, err)
 						r = &Record{}
-					} else {
-						if r, err = r.jsonDecode(v); err != nil {
-							// Log the decode error and continue
-							log.Printf("Record.jsonDecode(%s) Error: %s\n", sk, err)
-							r = &Record{}
-						}
 					}
 
 					recs[sk] = r
@@ -177,7 +339,7 @@ func (db *DB) getPaused() map[string]*Record {
 				return nil
 			}
 
-			if r.Paused {
+			if r.isAllowed() {
 				recs[string(k)] = r
 			}
 
@@ -190,67 +352,1106 @@ func (db *DB) getPaused() map[string]*Record {
 	return recs
 }
 
-func (db *DB) importBlacklist(fname string) error {
-	f, err := os.Open(fname)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+// expirePauses resumes the records whose timed pause expired at the passed
+// time, returning how many were resumed.
+func (db *DB) expirePauses(now time.Time) (int, error) {
+	var n int
 
-	lines, err := lineCount(f)
-	if err != nil {
-		return err
-	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		var expired = make(map[string]*Record)
 
-	// Rewind
-	if _, err = f.Seek(0, 0); err != nil {
-		return err
+		b := tx.Bucket(blacklistKey)
+
+		// Collect first, as the bucket mustn't be modified while iterating
+		b.ForEach(func(k, v []byte) error {
+			var r *Record
+			var err error
+
+			if len(v) == 0 {
+				// Skip "sub-buckets" and empty values
+				return nil
+			}
+
+			if r, err = r.jsonDecode(v); err != nil {
+				// Log the decode error and continue
+				log.Printf("Record.jsonDecode(%s) Error: %s\n", k, err)
+				return nil
+			}
+
+			if r.Paused && r.isPauseExpired(now) {
+				expired[string(k)] = r
+			}
+
+			return nil
+		})
+
+		for k, r := range expired {
+			r.Paused, r.PausedUntil = false, nil
+
+			if err := putRecord(b, k, r, now); err != nil {
+				return err
+			}
+		}
+
+		n = len(expired)
+		return nil
+	})
+
+	return n, err
+}
+
+// addRecordHits adds the passed hit counts to the records, skipping those which
+// have since been deleted. The records' updated times are left alone.
+func (db *DB) addRecordHits(hits map[string]*recordHit) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blacklistKey)
+
+		for k, h := range hits {
+			v := b.Get([]byte(k))
+			if v == nil {
+				continue
+			}
+
+			r, err := decodeRecord(v)
+			if err != nil {
+				// Log the decode error and continue
+				log.Printf("decodeRecord(%s) Error: %s\n", k, err)
+				continue
+			}
+
+			last := h.last.UTC().Truncate(time.Second)
+			r.Hits += h.count
+			if r.LastHit == nil || last.After(*r.LastHit) {
+				r.LastHit = &last
+			}
+
+			if v, err = r.jsonEncode(); err != nil {
+				return err
+			}
+			if err = b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// migrateRecords upgrades the empty values stored by the hosts imports of
+// previous versions to (metadata-less) JSON records, returning how many were
+// migrated. Their created times are unknown, and so are left unset, as are
+// those of the plain {"paused":...} records, which decode as they are.
+func (db *DB) migrateRecords() (int, error) {
+	var n int
+	var version int
+
+	if err := db.getSetting(settingRecordsVersion, &version); err != nil && err != errSettingNotFound {
+		return 0, err
+	} else if version >= recordsVersion {
+		return 0, nil
 	}
 
-	n := 0
-	scanner := bufio.NewScanner(f)
+	err := db.Update(func(tx *bolt.Tx) error {
+		var legacy [][]byte
 
-	for scanner.Scan() {
-		n++
-		fmt.Printf("\rProcessing %d of %d", n, lines)
+		b := tx.Bucket(blacklistKey)
 
-		// Parse line and trim any dots
-		r := strings.Trim(parseRecord(scanner.Text()), ".")
+		// Collect first, as the bucket mustn't be modified while iterating
+		b.ForEach(func(k, v []byte) error {
+			if v != nil && len(v) == 0 {
+				legacy = append(legacy, append([]byte{}, k...))
+			}
 
-		// Ignore records that don't appear to be valid
-		if !isValidDomainName(r) {
-			continue
+			return nil
+		})
+
+		v, err := (&Record{}).jsonEncode()
+		if err != nil {
+			return err
+		}
+
+		for _, k := range legacy {
+			if err := b.Put(k, v); err != nil {
+				return err
+			}
 		}
 
-		db.put(r, nil)
+		n = len(legacy)
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	fmt.Print("\n")
+	return n, db.putSetting(settingRecordsVersion, recordsVersion)
+}
 
-	return scanner.Err()
+// schedulePauseSweeps periodically resumes the records whose timed pause
+// expired (which are already treated as blocked until then).
+func schedulePauseSweeps() {
+	for {
+		time.Sleep(pauseSweepInterval)
+
+		if n, err := db.expirePauses(time.Now()); err != nil {
+			log.Printf("db.expirePauses() Error: %s\n", err)
+		} else if n > 0 {
+			log.Printf("Resumed %d record(s) whose pause expired\n", n)
+		}
+	}
 }
 
-func parseRecord(s string) string {
-	// Ignore comments
-	i := strings.IndexByte(s, '#')
-	if i == 0 {
-		return ""
-	} else if i > 0 {
-		s = s[:i]
+// allowlisted checks the given name (and each of its parent domains) against
+// the allowlist, returning the matching key. Only the domains which apply to
+// the passed group (if any) match.
+func (db *DB) allowlisted(name string, g *Group) (string, error) {
+	var key string
+
+	if g != nil && g.NoAllowlist {
+		return "", nil
 	}
 
-	sf := strings.Fields(s)
+	err := db.View(func(tx *bolt.Tx) error {
+		key, _ = matchKey(tx.Bucket(allowlistKey), name, func(v []byte) bool {
+			// The value is the source of the domain (empty if added manually,
+			// in which case it applies to every group)
+			return len(v) == 0 || g.hasSource(string(v))
+		})
+		return nil
+	})
 
-	if len(sf) < 1 {
-		// empty
-		return ""
-	} else if len(sf) > 1 {
-		// Return 2nd item if more than 1
-		return sf[1]
-	} else {
-		// Return one and only item
-		return sf[0]
+	return key, err
+}
+
+// allowlistedManually checks the given name (and each of its parent domains)
+// against the domains which were allowlisted manually (rather than by a
+// subscription), returning the matching key.
+func (db *DB) allowlistedManually(name string, g *Group) (string, error) {
+	var key string
+
+	if g != nil && g.NoAllowlist {
+		return "", nil
 	}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		key, _ = matchKey(tx.Bucket(allowlistKey), name, func(v []byte) bool {
+			return len(v) == 0
+		})
+		return nil
+	})
+
+	return key, err
+}
+
+func (db *DB) getAllowlist() []string {
+	var keys = []string{}
+
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(allowlistKey).ForEach(func(k, v []byte) error {
+			if v != nil {
+				// Skip "sub-buckets"
+				keys = append(keys, string(k))
+			}
+
+			return nil
+		})
+	})
+
+	return keys
+}
+
+func (db *DB) isAllowlisted(key string) bool {
+	var ok bool
+
+	db.View(func(tx *bolt.Tx) error {
+		ok = tx.Bucket(allowlistKey).Get([]byte(strings.ToLower(key))) != nil
+		return nil
+	})
+
+	return ok
+}
+
+func (db *DB) allow(key string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(allowlistKey).Put([]byte(strings.ToLower(key)), []byte{})
+	})
+}
+
+func (db *DB) disallow(key string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(allowlistKey).Delete([]byte(strings.ToLower(key)))
+	})
+}
+
+func (db *DB) getIPBlacklist() []string {
+	var keys = []string{}
+
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(ipBlacklistKey).ForEach(func(k, v []byte) error {
+			if v != nil {
+				// Skip "sub-buckets"
+				keys = append(keys, string(k))
+			}
+
+			return nil
+		})
+	})
+
+	return keys
+}
+
+func (db *DB) isIPBlacklisted(key string) bool {
+	var ok bool
+
+	db.View(func(tx *bolt.Tx) error {
+		ok = tx.Bucket(ipBlacklistKey).Get([]byte(key)) != nil
+		return nil
+	})
+
+	return ok
+}
+
+func (db *DB) blockIP(key string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ipBlacklistKey).Put([]byte(key), []byte{})
+	})
+}
+
+func (db *DB) unblockIP(key string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ipBlacklistKey).Delete([]byte(key))
+	})
+}
+
+func (db *DB) getGroup(name string) (*Group, error) {
+	var g *Group
+
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(groupsKey).Get([]byte(name))
+		if v == nil {
+			return errGroupNotFound
+		}
+
+		return json.Unmarshal(v, &g)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+func (db *DB) getGroups() map[string]*Group {
+	var groups = make(map[string]*Group)
+
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(groupsKey).ForEach(func(k, v []byte) error {
+			var g *Group
+
+			if v == nil {
+				// Skip "sub-buckets"
+				return nil
+			}
+
+			if err := json.Unmarshal(v, &g); err != nil {
+				// Log the decode error and continue
+				log.Printf("json.Unmarshal(%s) Error: %s\n", k, err)
+				return nil
+			}
+
+			groups[string(k)] = g
+			return nil
+		})
+	})
+
+	return groups
+}
+
+func (db *DB) putGroup(name string, g *Group) error {
+	v, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(groupsKey).Put([]byte(name), v)
+	})
+}
+
+func (db *DB) deleteGroup(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(groupsKey).Delete([]byte(name))
+	})
+}
+
+func (db *DB) getLocalRecords(name string) ([]LocalRecord, error) {
+	var lrs []LocalRecord
+
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(localRecordsKey).Get([]byte(strings.ToLower(name)))
+		if v == nil {
+			return errLocalRecordNotFound
+		}
+
+		return json.Unmarshal(v, &lrs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lrs, nil
+}
+
+func (db *DB) getAllLocalRecords() map[string][]LocalRecord {
+	var all = make(map[string][]LocalRecord)
+
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(localRecordsKey).ForEach(func(k, v []byte) error {
+			var lrs []LocalRecord
+
+			if v == nil {
+				// Skip "sub-buckets"
+				return nil
+			}
+
+			if err := json.Unmarshal(v, &lrs); err != nil {
+				// Log the decode error and continue
+				log.Printf("json.Unmarshal(%s) Error: %s\n", k, err)
+				return nil
+			}
+
+			all[string(k)] = lrs
+			return nil
+		})
+	})
+
+	return all
+}
+
+// putLocalRecords replaces the local records of the passed name.
+func (db *DB) putLocalRecords(name string, lrs []LocalRecord) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return putLocalRecords(tx.Bucket(localRecordsKey), name, lrs, false)
+	})
+}
+
+// addLocalRecords adds the passed local records to those of the passed name,
+// skipping any duplicates.
+func (db *DB) addLocalRecords(name string, lrs ...LocalRecord) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return putLocalRecords(tx.Bucket(localRecordsKey), name, lrs, true)
+	})
+}
+
+func (db *DB) deleteLocalRecords(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(localRecordsKey).Delete([]byte(strings.ToLower(name)))
+	})
+}
+
+// putLocalRecords stores the local records of the passed name in the passed
+// bucket, either replacing or adding to (without duplicates) the stored ones.
+func putLocalRecords(b *bolt.Bucket, name string, lrs []LocalRecord, add bool) error {
+	k := []byte(strings.ToLower(name))
+
+	if add {
+		var stored []LocalRecord
+
+		if v := b.Get(k); v != nil {
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+		}
+
+	next:
+		for _, lr := range lrs {
+			for _, s := range stored {
+				if s.Type == lr.Type && strings.EqualFold(s.Value, lr.Value) {
+					continue next
+				}
+			}
+			stored = append(stored, lr)
+		}
+		lrs = stored
+	}
+
+	v, err := json.Marshal(lrs)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(k, v)
+}
+
+func (db *DB) getSetting(key []byte, v interface{}) error {
+	return db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(settingsKey).Get(key)
+		if data == nil {
+			return errSettingNotFound
+		}
+
+		return json.Unmarshal(data, v)
+	})
+}
+
+func (db *DB) putSetting(key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(settingsKey).Put(key, data)
+	})
+}
+
+// putSettings stores the passed settings (by key) in a single transaction.
+func (db *DB) putSettings(settings map[string]interface{}) error {
+	var data = make(map[string][]byte)
+
+	for k, v := range settings {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		data[k] = b
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(settingsKey)
+
+		for k, v := range data {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (db *DB) getSubscription(name string) (*Subscription, error) {
+	var sub *Subscription
+
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(subscriptionsKey).Get([]byte(name))
+		if v == nil {
+			return errSubscriptionNotFound
+		}
+
+		return json.Unmarshal(v, &sub)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+func (db *DB) getSubscriptions() map[string]*Subscription {
+	var subs = make(map[string]*Subscription)
+
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(subscriptionsKey).ForEach(func(k, v []byte) error {
+			var sub *Subscription
+
+			if v == nil {
+				// Skip "sub-buckets"
+				return nil
+			}
+
+			if err := json.Unmarshal(v, &sub); err != nil {
+				// Log the decode error and continue
+				log.Printf("json.Unmarshal(%s) Error: %s\n", k, err)
+				return nil
+			}
+
+			subs[string(k)] = sub
+			return nil
+		})
+	})
+
+	return subs
+}
+
+func (db *DB) putSubscription(name string, sub *Subscription) error {
+	v, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(subscriptionsKey).Put([]byte(name), v)
+	})
+}
+
+// deleteSubscription deletes the named subscription along with the records
+// (and allowlisted domains) which came from it.
+func (db *DB) deleteSubscription(name string) error {
+	if _, err := db.replaceSourceRecords(name, nil); err != nil {
+		return err
+	}
+	if err := db.replaceSourceAllowlist(name, nil); err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(subscriptionsKey).Delete([]byte(name))
+	})
+}
+
+// replaceSourceRecords makes the records from the named source match the passed
+// keys (whose values mark $important records): new keys are added, and records
+// no longer listed are deleted. Records which were added manually (or by
+// another source) are left untouched, and the number of keys skipped because of
+// them is returned.
+func (db *DB) replaceSourceRecords(source string, keys map[string]bool) (int, error) {
+	var skipped int
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		var deleted bool
+
+		now := timeNow()
+		b := tx.Bucket(blacklistKey)
+		recs := make(map[string]*Record)
+
+		// Find the records from the source
+		if err = b.ForEach(func(k, v []byte) error {
+			var r *Record
+
+			if len(v) == 0 {
+				// Skip "sub-buckets" and empty values (manually added)
+				return nil
+			}
+
+			if r, err = r.jsonDecode(v); err == nil && r.Source == source {
+				recs[string(k)] = r
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		// Delete the records which are no longer listed
+		for k := range recs {
+			if _, ok := keys[k]; !ok {
+				if err = b.Delete([]byte(k)); err != nil {
+					return err
+				}
+				deleted = true
+			}
+		}
+
+		// Add the new records, and update the existing ones (keeping their
+		// paused state)
+		for k, important := range keys {
+			r, ok := recs[k]
+			if !ok && b.Get([]byte(k)) != nil {
+				// Added manually (or by another source)
+				skipped++
+				continue
+			} else if !ok {
+				r = &Record{Source: source}
+			} else if r.Important == important {
+				continue
+			}
+			r.Important = important
+
+			if err = putRecord(b, k, r, now); err != nil {
+				return err
+			}
+		}
+
+		if deleted {
+			return resetSkippingSubscriptions(tx, source)
+		}
+
+		return nil
+	})
+
+	return skipped, err
+}
+
+// resetSkippingSubscriptions clears the stored ETag and Last-Modified of the
+// subscriptions (other than the passed source) which skipped some of their
+// domains because they were already blocked. As one of those records was just
+// deleted, their next refresh then fetches (and adds) their domains in full,
+// rather than finding the list unchanged.
+func resetSkippingSubscriptions(tx *bolt.Tx, source string) error {
+	var subs = make(map[string]*Subscription)
+
+	b := tx.Bucket(subscriptionsKey)
+
+	if err := b.ForEach(func(k, v []byte) error {
+		var sub *Subscription
+
+		if v == nil || string(k) == source {
+			return nil
+		}
+
+		if err := json.Unmarshal(v, &sub); err != nil {
+			// Log the decode error and continue
+			log.Printf("json.Unmarshal(%s) Error: %s\n", k, err)
+			return nil
+		}
+
+		if sub.Skipped > 0 && (sub.ETag != "" || sub.LastModified != "") {
+			subs[string(k)] = sub
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for name, sub := range subs {
+		sub.ETag, sub.LastModified = "", ""
+
+		v, err := json.Marshal(sub)
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put([]byte(name), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceSourceAllowlist makes the allowlisted domains from the named source
+// match the passed keys. Allowlisted domains store their source as the value
+// (which is empty if they were added manually).
+func (db *DB) replaceSourceAllowlist(source string, keys map[string]bool) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		var stale [][]byte
+
+		b := tx.Bucket(allowlistKey)
+
+		// Find the domains which are no longer listed
+		if err := b.ForEach(func(k, v []byte) error {
+			if string(v) == source && !keys[string(k)] {
+				stale = append(stale, append([]byte{}, k...))
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		// Add the new domains
+		for k := range keys {
+			if b.Get([]byte(k)) != nil {
+				// Added manually (or by another source)
+				continue
+			}
+
+			if err := b.Put([]byte(k), []byte(source)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (db *DB) getRules() []*Rule {
+	var rules []*Rule
+
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(rulesKey).ForEach(func(k, v []byte) error {
+			var r *Rule
+
+			if v == nil {
+				// Skip "sub-buckets"
+				return nil
+			}
+
+			if err := json.Unmarshal(v, &r); err != nil {
+				// Log the decode error and continue
+				log.Printf("json.Unmarshal(%x) Error: %s\n", k, err)
+				return nil
+			}
+
+			rules = append(rules, r)
+			return nil
+		})
+	})
+
+	return rules
+}
+
+// putRule stores the passed rule, assigning it an ID if it doesn't have one.
+func (db *DB) putRule(r *Rule) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(rulesKey)
+
+		if r.ID == 0 {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			r.ID = id
+		}
+
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(ruleKey(r.ID), v)
+	})
+}
+
+func (db *DB) deleteRule(id uint64) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(rulesKey).Delete(ruleKey(id))
+	})
+}
+
+// updateRuleHits updates the match counters of the passed rules, skipping those
+// which have since been deleted.
+func (db *DB) updateRuleHits(rules []*Rule) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(rulesKey)
+
+		for _, r := range rules {
+			if b.Get(ruleKey(r.ID)) == nil {
+				continue
+			}
+
+			v, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put(ruleKey(r.ID), v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ruleKey returns the big endian representation of the passed rule ID, so that
+// rules are kept in the order they were added.
+func ruleKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+
+	return k
+}
+
+// appendQueryLog appends the passed entries to the query log. Keys are the big
+// endian log time followed by a sequence number, so that entries are kept in
+// order.
+func (db *DB) appendQueryLog(entries []*QueryLogEntry) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queryLogKey)
+
+		for _, e := range entries {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			v, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+
+			k := make([]byte, 16)
+			binary.BigEndian.PutUint64(k, uint64(e.Time.UnixNano()))
+			binary.BigEndian.PutUint64(k[8:], seq)
+
+			if err := b.Put(k, v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// pruneQueryLog deletes the query log entries logged before the passed cutoff,
+// returning how many were deleted.
+func (db *DB) pruneQueryLog(cutoff time.Time) (int, error) {
+	var n int
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(queryLogKey).Cursor()
+		for k, _ := c.First(); k != nil && len(k) == 16; k, _ = c.First() {
+			if int64(binary.BigEndian.Uint64(k)) >= cutoff.UnixNano() {
+				break
+			}
+
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			n++
+		}
+
+		return nil
+	})
+
+	return n, err
+}
+
+// searchQueryLog returns the newest entries (at most limit) for which match
+// returns true.
+func (db *DB) searchQueryLog(match func(*QueryLogEntry) bool, limit int) ([]*QueryLogEntry, error) {
+	var entries = []*QueryLogEntry{}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(queryLogKey).Cursor()
+
+		for k, v := c.Last(); k != nil && len(entries) < limit; k, v = c.Prev() {
+			var e *QueryLogEntry
+
+			if err := json.Unmarshal(v, &e); err != nil {
+				// Log the decode error and continue
+				log.Printf("json.Unmarshal(%x) Error: %s\n", k, err)
+				continue
+			}
+
+			if match(e) {
+				entries = append(entries, e)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (db *DB) importBlacklist(fname string) error {
+	r := &Record{File: filepath.Base(fname)}
+
+	return db.importList(fname, func(tx *bolt.Tx, key string) error {
+		return putRecord(tx.Bucket(blacklistKey), key, r, timeNow())
+	})
+}
+
+func (db *DB) importAllowlist(fname string) error {
+	return db.importList(fname, func(tx *bolt.Tx, key string) error {
+		return tx.Bucket(allowlistKey).Put([]byte(key), []byte{})
+	})
+}
+
+// importIPBlacklist imports the IP addresses and CIDR ranges of the passed
+// file (one per line, with # comments) into the IP blacklist, returning how
+// many were imported.
+func (db *DB) importIPBlacklist(fname string) (int, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for scanner.Scan() {
+			key := parseIPRange(scanner.Text())
+			if key == "" {
+				continue
+			}
+
+			if err := tx.Bucket(ipBlacklistKey).Put([]byte(key), []byte{}); err != nil {
+				return err
+			}
+			n++
+		}
+
+		return scanner.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// importLocalRecords imports the addresses of a hosts file as local records
+// (see localRecordsFromHosts), returning how many names were imported.
+func (db *DB) importLocalRecords(fname string) (int, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for scanner.Scan() {
+			for name, lrs := range localRecordsFromHosts(scanner.Text()) {
+				if err := putLocalRecords(tx.Bucket(localRecordsKey), name, lrs, true); err != nil {
+					return err
+				}
+				names[name] = true
+			}
+		}
+
+		return scanner.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(names), nil
+}
+
+// importAdblock imports the rules of an Adblock Plus style filter list, adding
+// exception rules to the allowlist. The parsed list is returned so that the
+// unsupported rules may be reported.
+func (db *DB) importAdblock(fname string) (*List, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l, err := parseAdblockList(f)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		now := timeNow()
+		file := filepath.Base(fname)
+
+		for k, important := range l.Block {
+			r := &Record{Important: important, File: file}
+			if err := putRecord(tx.Bucket(blacklistKey), k, r, now); err != nil {
+				return err
+			}
+		}
+
+		for k := range l.Allow {
+			if err := tx.Bucket(allowlistKey).Put([]byte(k), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// importList imports the records of a hosts file (or a file with one domain
+// per line), storing each (lowercased) domain with the passed function.
+func (db *DB) importList(fname string, put func(tx *bolt.Tx, key string) error) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lines, err := lineCount(f)
+	if err != nil {
+		return err
+	}
+
+	// Rewind
+	if _, err = f.Seek(0, 0); err != nil {
+		return err
+	}
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		n++
+		fmt.Printf("\rProcessing %d of %d", n, lines)
+
+		// Parse line and trim any dots
+		r := strings.Trim(parseRecord(scanner.Text()), ".")
+
+		// Ignore records that don't appear to be valid
+		if !isValidDomainName(r) {
+			continue
+		}
+
+		db.Update(func(tx *bolt.Tx) error {
+			return put(tx, strings.ToLower(r))
+		})
+	}
+
+	fmt.Print("\n")
+
+	return scanner.Err()
+}
+
+func parseRecord(s string) string {
+	_, names := parseHostsLine(s)
+	if len(names) == 0 {
+		return ""
+	}
+
+	// Return the first name
+	return names[0]
+}
+
+// parseHostsLine parses a hosts file line into its address and names, ignoring
+// comments. A line with a single field (one domain per line) has no address.
+func parseHostsLine(s string) (string, []string) {
+	// Ignore comments
+	i := strings.IndexByte(s, '#')
+	if i == 0 {
+		return "", nil
+	} else if i > 0 {
+		s = s[:i]
+	}
+
+	sf := strings.Fields(s)
+
+	if len(sf) < 1 {
+		// empty
+		return "", nil
+	} else if len(sf) > 1 {
+		// The address is followed by the names
+		return sf[0], sf[1:]
+	} else {
+		// Return one and only item
+		return "", sf
+	}
+}
+
+// parseIPRange parses the first field of the passed line as an IP address or
+// CIDR range, returning its normalized CIDR form (or an empty string if it is
+// neither).
+func parseIPRange(s string) string {
+	addr, fields := parseHostsLine(s)
+	if addr == "" && len(fields) > 0 {
+		addr = fields[0]
+	}
+
+	n := parseClient(addr)
+	if n == nil {
+		return ""
+	}
+
+	return n.String()
 }
 
 func lineCount(r io.Reader) (int, error) {
@@ -3,8 +3,10 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -15,6 +17,15 @@ func TestRecord_isAllowed(t *testing.T) {
 
 	r = &Record{Paused: true}
 	testEqual(t, "isAllowed() = %+v, want %+v", r.isAllowed(), true)
+
+	until := time.Now().Add(time.Minute)
+	r = &Record{Paused: true, PausedUntil: &until}
+	testEqual(t, "isAllowed() = %+v, want %+v", r.isAllowed(), true)
+
+	// Expired
+	until = time.Now().Add(-time.Minute)
+	r = &Record{Paused: true, PausedUntil: &until}
+	testEqual(t, "isAllowed() = %+v, want %+v", r.isAllowed(), false)
 }
 
 func TestRecord_jsonEncode(t *testing.T) {
@@ -60,33 +71,82 @@ func TestDB_put_get(t *testing.T) {
 	}
 	db.View(func(tx *bolt.Tx) error {
 		v := tx.Bucket(blacklistKey).Get([]byte("nil.test"))
-		testEqual(t, "put() = %+v, want %+v", string(v), "")
+		testEqual(t, "put() = %+v, want %+v", string(v), "{\"paused\":false"+testStamps+"}")
 		return nil
 	})
 	r, _ = db.get("nil.Test")
-	testEqual(t, "get() = %+v, want %+v", *r, Record{})
+	testEqual(t, "get() = %+v, want %+v", *r, stamped(Record{}))
 
 	if err := db.put("empty.test", &Record{}); err != nil {
 		t.Errorf("failed to put: %+v", err)
 	}
 	db.View(func(tx *bolt.Tx) error {
 		v := tx.Bucket(blacklistKey).Get([]byte("empty.test"))
-		testEqual(t, "put() = %+v, want %+v", string(v), "{\"paused\":false}")
+		testEqual(t, "put() = %+v, want %+v", string(v), "{\"paused\":false"+testStamps+"}")
 		return nil
 	})
 	r, _ = db.get("empty.test")
-	testEqual(t, "get() = %+v, want %+v", *r, Record{})
+	testEqual(t, "get() = %+v, want %+v", *r, stamped(Record{}))
 
 	if err := db.put("paused.test", &Record{Paused: true}); err != nil {
 		t.Errorf("failed to put: %+v", err)
 	}
 	db.View(func(tx *bolt.Tx) error {
 		v := tx.Bucket(blacklistKey).Get([]byte("paused.test"))
-		testEqual(t, "put() = %+v, want %+v", string(v), "{\"paused\":true}")
+		testEqual(t, "put() = %+v, want %+v", string(v), "{\"paused\":true"+testStamps+"}")
 		return nil
 	})
 	r, _ = db.get("paused.test")
+	testEqual(t, "get() = %+v, want %+v", *r, stamped(Record{Paused: true}))
+
+	// Legacy values
+	db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket(blacklistKey).Put([]byte("legacy.test"), []byte{})
+		return tx.Bucket(blacklistKey).Put([]byte("legacy-paused.test"), []byte("{\"paused\":true}"))
+	})
+	r, _ = db.get("legacy.test")
+	testEqual(t, "get() = %+v, want %+v", *r, Record{})
+	r, _ = db.get("legacy-paused.test")
 	testEqual(t, "get() = %+v, want %+v", *r, Record{Paused: true})
+
+	// Updating keeps the created time (unknown for legacy values) and hits
+	last := testTime.Add(-time.Hour)
+	db.addRecordHits(map[string]*recordHit{"paused.test": {count: 2, last: last}})
+	updated := testTime.Add(time.Hour)
+	db.Update(func(tx *bolt.Tx) error {
+		putRecord(tx.Bucket(blacklistKey), "paused.test", &Record{Comment: "test"}, updated)
+		return putRecord(tx.Bucket(blacklistKey), "Legacy.test", &Record{Comment: "test"}, updated)
+	})
+	r, _ = db.get("paused.test")
+	testEqual(t, "get() = %+v, want %+v", *r, Record{Comment: "test", Created: &testTime, Updated: &updated, Hits: 2, LastHit: &last})
+	r, _ = db.get("legacy.test")
+	testEqual(t, "get() = %+v, want %+v", *r, Record{Comment: "test", Updated: &updated})
+}
+
+func TestDB_match(t *testing.T) {
+	db.Reset()
+
+	if err := db.put("example.test", nil); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+	if err := db.put("cdn.example.test", &Record{Paused: true}); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+
+	k, r, _ := db.match("Example.Test.", nil)
+	testEqual(t, "match('example.test') key = %+v, want %+v", k, "example.test")
+	testEqual(t, "match('example.test') = %+v, want %+v", *r, stamped(Record{}))
+
+	k, r, _ = db.match("stats.g.example.test", nil)
+	testEqual(t, "match('stats.g.example.test') key = %+v, want %+v", k, "example.test")
+	testEqual(t, "match('stats.g.example.test') = %+v, want %+v", *r, stamped(Record{}))
+
+	k, r, _ = db.match("img.cdn.example.test", nil)
+	testEqual(t, "match('img.cdn.example.test') key = %+v, want %+v", k, "cdn.example.test")
+	testEqual(t, "match('img.cdn.example.test') = %+v, want %+v", *r, stamped(Record{Paused: true}))
+
+	_, _, err := db.match("notexample.test", nil)
+	testEqual(t, "match('notexample.test') err = %+v, want %+v", err, errRecordNotFound)
 }
 
 func TestDB_delete(t *testing.T) {
@@ -96,7 +156,7 @@ func TestDB_delete(t *testing.T) {
 		t.Errorf("failed to put: %+v", err)
 	}
 	r, _ := db.get("delete.test")
-	testEqual(t, "get() = %+v, want %+v", *r, Record{})
+	testEqual(t, "get() = %+v, want %+v", *r, stamped(Record{}))
 	if err := db.delete("delete.test"); err != nil {
 		t.Errorf("failed to delete: %+v", err)
 	}
@@ -145,7 +205,331 @@ func TestDB_getPaused(t *testing.T) {
 
 	rs := db.getPaused()
 	testEqual(t, "len(getPaused()) = %+v, want %+v", len(rs), 1)
-	testEqual(t, "getPaused()[0] = %+v, want %+v", *rs["paused.test"], Record{Paused: true})
+	testEqual(t, "getPaused()[0] = %+v, want %+v", *rs["paused.test"], stamped(Record{Paused: true}))
+}
+
+func TestDB_expirePauses(t *testing.T) {
+	db.Reset()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+
+	db.put("empty.test", nil)
+	db.put("paused.test", &Record{Paused: true})
+	db.put("expired.test", &Record{Paused: true, PausedUntil: &past, Source: "test"})
+	db.put("unexpired.test", &Record{Paused: true, PausedUntil: &future})
+
+	// Expired pauses aren't listed, even before they're swept
+	rs := db.getPaused()
+	testEqual(t, "len(getPaused()) = %+v, want %+v", len(rs), 2)
+
+	n, err := db.expirePauses(now)
+	testEqual(t, "expirePauses() err = %+v, want %+v", err, nil)
+	testEqual(t, "expirePauses() = %+v, want %+v", n, 1)
+
+	rec, _ := db.get("expired.test")
+	testEqual(t, "get() = %+v, want %+v", *rec, Record{Source: "test", Created: &testTime, Updated: &now})
+	rec, _ = db.get("unexpired.test")
+	testEqual(t, "get() = %+v, want %+v", *rec, stamped(Record{Paused: true, PausedUntil: &future}))
+	rec, _ = db.get("paused.test")
+	testEqual(t, "get() = %+v, want %+v", *rec, stamped(Record{Paused: true}))
+
+	n, _ = db.expirePauses(now)
+	testEqual(t, "expirePauses() = %+v, want %+v", n, 0)
+}
+
+func TestDB_migrateRecords(t *testing.T) {
+	db.Reset()
+
+	db.put("current.test", &Record{Paused: true})
+	db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket(blacklistKey).Put([]byte("legacy.test"), []byte{})
+		return tx.Bucket(blacklistKey).Put([]byte("legacy-paused.test"), []byte("{\"paused\":true}"))
+	})
+
+	n, err := db.migrateRecords()
+	testEqual(t, "migrateRecords() err = %+v, want %+v", err, nil)
+	testEqual(t, "migrateRecords() = %+v, want %+v", n, 1)
+	db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(blacklistKey).Get([]byte("legacy.test"))
+		testEqual(t, "get(legacy.test) = %+v, want %+v", string(v), "{\"paused\":false}")
+		return nil
+	})
+	r, _ := db.get("legacy-paused.test")
+	testEqual(t, "get() = %+v, want %+v", *r, Record{Paused: true})
+	r, _ = db.get("current.test")
+	testEqual(t, "get() = %+v, want %+v", *r, stamped(Record{Paused: true}))
+
+	// Only once
+	db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(blacklistKey).Put([]byte("legacy.test"), []byte{})
+	})
+	n, _ = db.migrateRecords()
+	testEqual(t, "migrateRecords() = %+v, want %+v", n, 0)
+}
+
+func TestDB_allow_disallow(t *testing.T) {
+	db.Reset()
+
+	testEqual(t, "getAllowlist() = %+v, want %+v", db.getAllowlist(), []string{})
+
+	if err := db.allow("Allowed.Test"); err != nil {
+		t.Errorf("failed to allow: %+v", err)
+	}
+	testEqual(t, "isAllowlisted('allowed.test') = %+v, want %+v", db.isAllowlisted("allowed.test"), true)
+	testEqual(t, "isAllowlisted('sub.allowed.test') = %+v, want %+v", db.isAllowlisted("sub.allowed.test"), false)
+	testEqual(t, "getAllowlist() = %+v, want %+v", db.getAllowlist(), []string{"allowed.test"})
+
+	k, _ := db.allowlisted("sub.Allowed.test.", nil)
+	testEqual(t, "allowlisted('sub.allowed.test') = %+v, want %+v", k, "allowed.test")
+	k, _ = db.allowlisted("notallowed.test", nil)
+	testEqual(t, "allowlisted('notallowed.test') = %+v, want %+v", k, "")
+
+	if err := db.disallow("allowed.test"); err != nil {
+		t.Errorf("failed to disallow: %+v", err)
+	}
+	testEqual(t, "isAllowlisted('allowed.test') = %+v, want %+v", db.isAllowlisted("allowed.test"), false)
+	k, _ = db.allowlisted("allowed.test", nil)
+	testEqual(t, "allowlisted('allowed.test') = %+v, want %+v", k, "")
+}
+
+func TestDB_groups(t *testing.T) {
+	db.Reset()
+
+	_, err := db.getGroup("kids")
+	testEqual(t, "getGroup() err = %+v, want %+v", err, errGroupNotFound)
+
+	g := &Group{Clients: []string{"10.0.0.20"}, Sources: []string{"adult"}, NoAllowlist: true, BlockMode: blockModeNull}
+	if err := db.putGroup("kids", g); err != nil {
+		t.Errorf("failed to putGroup: %+v", err)
+	}
+	got, _ := db.getGroup("kids")
+	testEqual(t, "getGroup() = %+v, want %+v", got, g)
+	testEqual(t, "len(getGroups()) = %+v, want %+v", len(db.getGroups()), 1)
+
+	if err := db.deleteGroup("kids"); err != nil {
+		t.Errorf("failed to deleteGroup: %+v", err)
+	}
+	testEqual(t, "len(getGroups()) = %+v, want %+v", len(db.getGroups()), 0)
+}
+
+func TestDB_localRecords(t *testing.T) {
+	db.Reset()
+
+	_, err := db.getLocalRecords("nas.lan")
+	testEqual(t, "getLocalRecords() err = %+v, want %+v", err, errLocalRecordNotFound)
+
+	a := LocalRecord{Type: localRecordA, Value: "192.168.1.10"}
+	txt := LocalRecord{Type: localRecordTXT, Value: "hello"}
+	if err := db.putLocalRecords("NAS.lan", []LocalRecord{a}); err != nil {
+		t.Errorf("failed to putLocalRecords: %+v", err)
+	}
+	if err := db.addLocalRecords("nas.lan", a, txt); err != nil {
+		t.Errorf("failed to addLocalRecords: %+v", err)
+	}
+	got, _ := db.getLocalRecords("nas.lan")
+	testEqual(t, "getLocalRecords() = %+v, want %+v", got, []LocalRecord{a, txt})
+	testEqual(t, "getAllLocalRecords() = %+v, want %+v", db.getAllLocalRecords(), map[string][]LocalRecord{"nas.lan": {a, txt}})
+
+	if err := db.putLocalRecords("nas.lan", []LocalRecord{txt}); err != nil {
+		t.Errorf("failed to putLocalRecords: %+v", err)
+	}
+	got, _ = db.getLocalRecords("nas.lan")
+	testEqual(t, "getLocalRecords() = %+v, want %+v", got, []LocalRecord{txt})
+
+	if err := db.deleteLocalRecords("nas.lan"); err != nil {
+		t.Errorf("failed to deleteLocalRecords: %+v", err)
+	}
+	testEqual(t, "len(getAllLocalRecords()) = %+v, want %+v", len(db.getAllLocalRecords()), 0)
+}
+
+func TestDB_subscriptions(t *testing.T) {
+	db.Reset()
+
+	_, err := db.getSubscription("test")
+	testEqual(t, "getSubscription() err = %+v, want %+v", err, errSubscriptionNotFound)
+
+	sub := &Subscription{URL: "http://list.test/hosts", Format: subscriptionFormatHosts, Enabled: true, Interval: "24h"}
+	if err := db.putSubscription("test", sub); err != nil {
+		t.Errorf("failed to putSubscription: %+v", err)
+	}
+	got, _ := db.getSubscription("test")
+	testEqual(t, "getSubscription() = %+v, want %+v", *got, *sub)
+	testEqual(t, "getSubscriptions() = %+v, want %+v", len(db.getSubscriptions()), 1)
+
+	// Records from the subscription are replaced, others are left alone
+	if err := db.put("manual.test", nil); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+	if err := db.put("other.test", &Record{Source: "other"}); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+	skipped, err := db.replaceSourceRecords("test", map[string]bool{"one.test": false, "two.test": false, "manual.test": false, "other.test": false})
+	if err != nil {
+		t.Errorf("failed to replaceSourceRecords: %+v", err)
+	}
+	testEqual(t, "replaceSourceRecords() = %+v, want %+v", skipped, 2)
+	c, _ := db.keyCount()
+	testEqual(t, "keyCount() = %+v, want %+v", c, 4)
+	r, _ := db.get("one.test")
+	testEqual(t, "get('one.test') = %+v, want %+v", *r, stamped(Record{Source: "test"}))
+	r, _ = db.get("other.test")
+	testEqual(t, "get('other.test') = %+v, want %+v", *r, stamped(Record{Source: "other"}))
+
+	if err := db.put("one.test", &Record{Paused: true, Source: "test"}); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+	if _, err := db.replaceSourceRecords("test", map[string]bool{"one.test": true}); err != nil {
+		t.Errorf("failed to replaceSourceRecords: %+v", err)
+	}
+	_, err = db.get("two.test")
+	testEqual(t, "get('two.test') err = %+v, want %+v", err, errRecordNotFound)
+	r, _ = db.get("one.test")
+	testEqual(t, "get('one.test') = %+v, want %+v", *r, stamped(Record{Paused: true, Important: true, Source: "test"}))
+
+	// Allowlisted domains from the subscription are replaced, others are left alone
+	if err := db.allow("manual.test"); err != nil {
+		t.Errorf("failed to allow: %+v", err)
+	}
+	if err := db.replaceSourceAllowlist("test", map[string]bool{"allowed.test": true, "manual.test": true}); err != nil {
+		t.Errorf("failed to replaceSourceAllowlist: %+v", err)
+	}
+	testEqual(t, "getAllowlist() = %+v, want %+v", db.getAllowlist(), []string{"allowed.test", "manual.test"})
+
+	// Deleting a subscription deletes its records
+	if err := db.deleteSubscription("test"); err != nil {
+		t.Errorf("failed to deleteSubscription: %+v", err)
+	}
+	_, err = db.getSubscription("test")
+	testEqual(t, "getSubscription() err = %+v, want %+v", err, errSubscriptionNotFound)
+	c, _ = db.keyCount()
+	testEqual(t, "keyCount() = %+v, want %+v", c, 2)
+	testEqual(t, "getAllowlist() = %+v, want %+v", db.getAllowlist(), []string{"manual.test"})
+}
+
+func TestDB_rules(t *testing.T) {
+	db.Reset()
+
+	testEqual(t, "getRules() = %+v, want %+v", len(db.getRules()), 0)
+
+	one, two := &Rule{Pattern: "one.*"}, &Rule{Pattern: "two.*"}
+	for _, r := range []*Rule{one, two} {
+		if err := db.putRule(r); err != nil {
+			t.Errorf("failed to putRule: %+v", err)
+		}
+	}
+	testEqual(t, "putRule() IDs = %+v, want %+v", []uint64{one.ID, two.ID}, []uint64{1, 2})
+	testEqual(t, "getRules() = %+v, want %+v", db.getRules(), []*Rule{one, two})
+
+	if err := db.deleteRule(one.ID); err != nil {
+		t.Errorf("failed to deleteRule: %+v", err)
+	}
+
+	// Deleted rules aren't updated
+	if err := db.updateRuleHits([]*Rule{{ID: one.ID, Pattern: one.Pattern, Hits: 1}, {ID: two.ID, Pattern: two.Pattern, Hits: 2}}); err != nil {
+		t.Errorf("failed to updateRuleHits: %+v", err)
+	}
+	testEqual(t, "getRules() = %+v, want %+v", db.getRules(), []*Rule{{ID: two.ID, Pattern: two.Pattern, Hits: 2}})
+}
+
+func TestDB_importAllowlist(t *testing.T) {
+	db.Reset()
+
+	f, err := ioutil.TempFile("", "nogo-import-")
+	if err != nil {
+		t.Errorf("failed to create TempFile: %+v", err)
+	}
+	f.WriteString(" # comment\ntest\nallowed.test\n0.0.0.0 Other.Test\n")
+	f.Sync()
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	db.importAllowlist(f.Name())
+
+	testEqual(t, "getAllowlist() = %+v, want %+v", db.getAllowlist(), []string{"allowed.test", "other.test"})
+	c, _ := db.keyCount()
+	testEqual(t, "keyCount() = %+v, want %+v", c, 0)
+}
+
+func TestDB_importLocalRecords(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+
+	f, err := ioutil.TempFile("", "nogo-import-")
+	if err != nil {
+		t.Errorf("failed to create TempFile: %+v", err)
+	}
+	f.WriteString("# comment\n127.0.0.1 localhost\n::1 localhost\n0.0.0.0 ads.test\n192.168.1.10 nas.lan nas\n192.168.1.11 nas.lan\n")
+	f.Sync()
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	n, err := db.importLocalRecords(f.Name())
+	if err != nil {
+		t.Errorf("failed to importLocalRecords: %+v", err)
+	}
+	testEqual(t, "importLocalRecords() = %+v, want %+v", n, 4)
+
+	lrs, _ := db.getLocalRecords("nas.lan")
+	testEqual(t, "getLocalRecords('nas.lan') = %+v, want %+v", lrs, []LocalRecord{{Type: localRecordA, Value: "192.168.1.10"}, {Type: localRecordA, Value: "192.168.1.11"}})
+	lrs, _ = db.getLocalRecords("11.1.168.192.in-addr.arpa")
+	testEqual(t, "getLocalRecords('11.1.168.192.in-addr.arpa') = %+v, want %+v", lrs, []LocalRecord{{Type: localRecordPTR, Value: "nas.lan"}})
+	_, err = db.getLocalRecords("localhost")
+	testEqual(t, "getLocalRecords('localhost') err = %+v, want %+v", err, errLocalRecordNotFound)
+	c, _ := db.keyCount()
+	testEqual(t, "keyCount() = %+v, want %+v", c, 0)
+}
+
+func TestDB_importIPBlacklist(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+
+	f, err := ioutil.TempFile("", "nogo-import-")
+	if err != nil {
+		t.Errorf("failed to create TempFile: %+v", err)
+	}
+	f.WriteString("# comment\n192.0.2.0/24 # ads\n198.51.100.7\n2001:db8::1/32\nads.test\n")
+	f.Sync()
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	n, err := db.importIPBlacklist(f.Name())
+	if err != nil {
+		t.Errorf("failed to importIPBlacklist: %+v", err)
+	}
+	testEqual(t, "importIPBlacklist() = %+v, want %+v", n, 3)
+	testEqual(t, "getIPBlacklist() = %+v, want %+v", db.getIPBlacklist(), []string{"192.0.2.0/24", "198.51.100.7/32", "2001:db8::/32"})
+	testEqual(t, "isIPBlacklisted('198.51.100.7/32') = %+v, want %+v", db.isIPBlacklisted("198.51.100.7/32"), true)
+
+	db.unblockIP("198.51.100.7/32")
+	testEqual(t, "isIPBlacklisted('198.51.100.7/32') = %+v, want %+v", db.isIPBlacklisted("198.51.100.7/32"), false)
+}
+
+func TestDB_importAdblock(t *testing.T) {
+	db.Reset()
+
+	f, err := ioutil.TempFile("", "nogo-import-")
+	if err != nil {
+		t.Errorf("failed to create TempFile: %+v", err)
+	}
+	f.WriteString("[Adblock Plus 2.0]\n! comment\n||ads.test^\n||important.test^$important\n@@||allowed.test^\nexample.test##.ad\n")
+	f.Sync()
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	l, err := db.importAdblock(f.Name())
+	if err != nil {
+		t.Errorf("failed to importAdblock: %+v", err)
+	}
+	testEqual(t, "importAdblock() Unsupported = %+v, want %+v", len(l.Unsupported), 1)
+
+	c, _ := db.keyCount()
+	testEqual(t, "keyCount() = %+v, want %+v", c, 2)
+	r, _ := db.get("ads.test")
+	testEqual(t, "get('ads.test') = %+v, want %+v", *r, stamped(Record{File: filepath.Base(f.Name())}))
+	r, _ = db.get("important.test")
+	testEqual(t, "get('important.test') = %+v, want %+v", *r, stamped(Record{Important: true, File: filepath.Base(f.Name())}))
+	testEqual(t, "getAllowlist() = %+v, want %+v", db.getAllowlist(), []string{"allowed.test"})
 }
 
 func TestDB_importBlacklist(t *testing.T) {
@@ -169,7 +553,7 @@ func TestDB_importBlacklist(t *testing.T) {
 	testEqual(t, "keyCount() = %+v, want %+v", c, 1)
 
 	r, _ := db.get("test.test")
-	testEqual(t, "get('test.test') = %+v, want %+v", *r, Record{})
+	testEqual(t, "get('test.test') = %+v, want %+v", *r, stamped(Record{File: filepath.Base(f.Name())}))
 }
 
 func Test_parseRecord(t *testing.T) {
@@ -180,6 +564,23 @@ func Test_parseRecord(t *testing.T) {
 	testEqual(t, "parseRecord('127.0.0.1 localhost alias # comment') = %+v, want %+v", parseRecord("127.0.0.1 localhost alias # comment"), "localhost")
 }
 
+func Test_parseHostsLine(t *testing.T) {
+	addr, names := parseHostsLine("# comment")
+	testEqual(t, "parseHostsLine('# comment') = %+v, want %+v", []interface{}{addr, names}, []interface{}{"", []string(nil)})
+	addr, names = parseHostsLine("nas.lan")
+	testEqual(t, "parseHostsLine('nas.lan') = %+v, want %+v", []interface{}{addr, names}, []interface{}{"", []string{"nas.lan"}})
+	addr, names = parseHostsLine("192.168.1.10\tnas.lan nas # comment")
+	testEqual(t, "parseHostsLine('192.168.1.10\tnas.lan nas # comment') = %+v, want %+v", []interface{}{addr, names}, []interface{}{"192.168.1.10", []string{"nas.lan", "nas"}})
+}
+
+func Test_parseIPRange(t *testing.T) {
+	testEqual(t, "parseIPRange('# comment') = %+v, want %+v", parseIPRange("# comment"), "")
+	testEqual(t, "parseIPRange('ads.test') = %+v, want %+v", parseIPRange("ads.test"), "")
+	testEqual(t, "parseIPRange('192.0.2.1') = %+v, want %+v", parseIPRange("192.0.2.1"), "192.0.2.1/32")
+	testEqual(t, "parseIPRange('192.0.2.1/24 # comment') = %+v, want %+v", parseIPRange("192.0.2.1/24 # comment"), "192.0.2.0/24")
+	testEqual(t, "parseIPRange('2001:db8::1') = %+v, want %+v", parseIPRange("2001:db8::1"), "2001:db8::1/128")
+}
+
 func TestDB_lineCount(t *testing.T) {
 	c, err := lineCount(strings.NewReader("one\ntwo\nthree\n"))
 	if err != nil {
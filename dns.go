@@ -2,82 +2,441 @@ package main
 
 import (
 	"log"
+	"net"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
+// Block response modes
+const (
+	blockModeNXDomain = "nxdomain" // NXDOMAIN
+	blockModeRefused  = "refused"  // REFUSED
+	blockModeNoData   = "nodata"   // NOERROR with no answers
+	blockModeNull     = "null"     // 0.0.0.0 and :: answers
+	blockModeSinkhole = "sinkhole" // -dns-block-ipv4 and -dns-block-ipv6 answers
+)
+
+// Query decisions
+const (
+	decisionAllowed     = "allowed"     // No matching record (or nogo is disabled)
+	decisionAllowlisted = "allowlisted" // Matched the allowlist
+	decisionPaused      = "paused"      // Matched a paused record
+	decisionBlocked     = "blocked"     // Matched a record or pattern rule
+	decisionCached      = "cached"      // Allowed, and answered from the cache
+	decisionLocal       = "local"       // Answered from the local records
+	decisionCloaked     = "cloaked"     // A CNAME target matched a record or pattern rule
+	decisionIPBlocked   = "ipblocked"   // Every answer address matched the IP blacklist
+	decisionRebinding   = "rebinding"   // An answer address was private (see filterRebinding)
+)
+
+// maxCNAMEChain is the maximum number of CNAMEs followed when checking the
+// CNAME targets of an answer.
+const maxCNAMEChain = 16
+
+var blockModes = []string{blockModeNXDomain, blockModeRefused, blockModeNoData, blockModeNull, blockModeSinkhole}
+
+var queryDecisions = []string{decisionAllowed, decisionAllowlisted, decisionPaused, decisionBlocked, decisionCached, decisionLocal, decisionCloaked, decisionIPBlocked, decisionRebinding}
+
+// verdict represents the outcome of checking a name, along with the record,
+// allowlisted domain or pattern rule which decided it
+type verdict struct {
+	allowed  bool
+	decision string
+	rule     string
+}
+
 func dnsHandler(w dns.ResponseWriter, r *dns.Msg) {
+	w.WriteMsg(resolve(r, clientIP(w.RemoteAddr().String())))
+}
+
+// resolve answers the passed query, independently of how it was received, and
+// records it (see recordQuery).
+func resolve(r *dns.Msg, client string) *dns.Msg {
+	var g *Group
+
+	e := &QueryLogEntry{Time: time.Now().UTC(), Client: client, Decision: decisionAllowed}
+	e.Group, g = groupSet.match(client)
+	if len(r.Question) > 0 {
+		e.Name = strings.ToLower(strings.TrimSuffix(r.Question[0].Name, "."))
+		e.Type = dns.TypeToString[r.Question[0].Qtype]
+	}
+
+	// Local records are answered ahead of the blacklist and upstreams
+	m := localAnswer(r)
+	if m != nil {
+		e.Decision = decisionLocal
+	} else if m = filterQuery(r, e, g); m == nil {
+		// Names allowed explicitly (allowlisted or paused) aren't checked for
+		// CNAME cloaking
+		explicit := e.Decision == decisionAllowlisted || e.Decision == decisionPaused
+
+		m = proxyQuery(r, e)
+		if !explicit {
+			if b := filterCNAMEs(r, m, e, g); b != nil {
+				m = b
+			} else {
+				m = filterAddrs(r, m, e, g)
+			}
+		}
+		if !isBlockedDecision(e.Decision) {
+			m = filterRebinding(r, m, e, g)
+		}
+	}
+
+	e.Latency = float64(time.Since(e.Time)) / float64(time.Millisecond)
+	e.Rcode = dns.RcodeToString[m.Rcode]
+	recordQuery(e)
+
+	return m
+}
+
+// filterQuery removes the questions blocked for the passed group (if any) from
+// the passed query. If none of the questions are allowed, the block response is
+// returned.
+func filterQuery(r *dns.Msg, e *QueryLogEntry, g *Group) *dns.Msg {
+	isDisabledMu.Lock()
+	isEnabled := !isDisabled
+	isDisabledMu.Unlock()
+
+	if !isEnabled {
+		return nil
+	}
+
+	// Make a copy of the questions (in case we need them for the block response)
+	qs := make([]dns.Question, len(r.Question))
+	copy(qs, r.Question)
+
+	// If none of the questions are allowed, respond with a block response
+	var v verdict
+	r.Question, v = filterQuestions(r.Question, g)
+	e.Decision, e.Rule = v.decision, v.rule
+	if len(r.Question) == 0 {
+		return blockResponse(r, qs, groupBlockMode(g))
+	}
+
+	return nil
+}
+
+// filterCNAMEs checks the CNAME targets of the passed response (when enabled
+// via -dns-cname-check), following the chain of each question's name. If any
+// of them isn't allowed for the passed group (if any), as trackers hide behind
+// first-party subdomains pointing at them (CNAME cloaking), the block response
+// is returned instead.
+func filterCNAMEs(r, m *dns.Msg, e *QueryLogEntry, g *Group) *dns.Msg {
 	isDisabledMu.Lock()
 	isEnabled := !isDisabled
 	isDisabledMu.Unlock()
 
-	if isEnabled {
-		// Make a copy of the questions (in case we need them for the error response)
-		qs := make([]dns.Question, len(r.Question))
-		copy(qs, r.Question)
-
-		// If none of the questions are allowed, respond with an error message
-		if r.Question = filterQuestions(r.Question); len(r.Question) == 0 {
-			m := &dns.Msg{
-				MsgHdr: dns.MsgHdr{
-					Id:                 r.Id,
-					Response:           true,
-					Opcode:             dns.OpcodeQuery,
-					Authoritative:      true,
-					RecursionDesired:   r.RecursionDesired,
-					RecursionAvailable: false,
-					Rcode:              dns.RcodeNameError, // NXDOMAIN
-				},
-				Question: qs,
+	if !*dnsCNAMECheck || !isEnabled {
+		return nil
+	}
+
+	for _, q := range r.Question {
+		name := q.Name
+
+		for i := 0; i < maxCNAMEChain; i++ {
+			target := cnameTarget(m.Answer, name)
+			if target == "" {
+				break
 			}
 
-			w.WriteMsg(m)
-			return
+			if v := checkName(target, g); !v.allowed {
+				e.Decision, e.Rule, e.CNAME = decisionCloaked, v.rule, strings.ToLower(strings.TrimSuffix(target, "."))
+				return blockResponse(r, r.Question, groupBlockMode(g))
+			}
+			name = target
 		}
 	}
 
-	// Proxy allowed questions upstream
-	for _, addr := range strings.Split(*dnsProxyTo, ",") {
-		in, _, err := dnsClient.Exchange(r, addr)
-		if err != nil {
-			log.Printf("Exchange(%s) Error: %s\n", addr, err)
+	return nil
+}
+
+// filterAddrs removes the A and AAAA answers of the passed response whose
+// addresses are in a blocked IP range. If no addresses remain, the block
+// response is returned instead.
+func filterAddrs(r, m *dns.Msg, e *QueryLogEntry, g *Group) *dns.Msg {
+	isDisabledMu.Lock()
+	isEnabled := !isDisabled
+	isDisabledMu.Unlock()
+
+	if !isEnabled || ipBlacklist.len() == 0 {
+		return m
+	}
+
+	var keep []dns.RR
+	var blocked string
+	var addrs int
+
+	for _, rr := range m.Answer {
+		var ip net.IP
+
+		switch a := rr.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		default:
+			keep = append(keep, rr)
+			continue
+		}
+
+		if network := ipBlacklist.match(ip); network != "" {
+			if blocked == "" {
+				blocked = network
+			}
 			continue
 		}
+		keep = append(keep, rr)
+		addrs++
+	}
 
-		w.WriteMsg(in)
-		return
+	if blocked == "" {
+		return m
 	}
 
-	dns.HandleFailed(w, r)
+	if addrs == 0 {
+		e.Decision, e.Rule = decisionIPBlocked, blocked
+		return blockResponse(r, r.Question, groupBlockMode(g))
+	}
+
+	m.Answer = keep
+	return m
 }
 
-func filterQuestions(qs []dns.Question) []dns.Question {
+// cnameTarget returns the target of the passed name's CNAME among the passed
+// answers, if any.
+func cnameTarget(rrs []dns.RR, name string) string {
+	for _, rr := range rrs {
+		if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, name) {
+			return c.Target
+		}
+	}
+
+	return ""
+}
+
+// groupBlockMode returns the block response mode for the passed group (if
+// any), which defaults to the configured block mode.
+func groupBlockMode(g *Group) string {
+	if g != nil && g.BlockMode != "" {
+		return g.BlockMode
+	}
+
+	blockModeMu.Lock()
+	defer blockModeMu.Unlock()
+
+	return blockMode
+}
+
+// proxyQuery answers the passed query from the cache, or by proxying it
+// upstream (to the upstreams of the conditional forwarding rule matching its
+// first question, if any). A SERVFAIL response is returned if no upstream
+// could answer.
+func proxyQuery(r *dns.Msg, e *QueryLogEntry) *dns.Msg {
+	// Answer from the cache, if possible
+	if m := dnsCache.get(r); m != nil {
+		e.Decision = decisionCached
+		return m
+	}
+
+	// Match the question being proxied, which isn't the logged one if that
+	// was filtered out
+	pool := currentUpstreams()
+	if len(r.Question) > 0 {
+		if _, fp := currentForwards().match(r.Question[0].Name); fp != nil {
+			pool = fp
+		}
+	}
+
+	// Proxy allowed questions upstream
+	in, u, err := pool.exchange(r)
+	if u != nil {
+		e.Upstream = u.Addr
+	}
+	if err != nil {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		return m
+	}
+
+	dnsCache.put(in)
+	return in
+}
+
+// filterQuestions returns the questions allowed for the passed group (if any),
+// along with the verdict of the first allowed question (or of the first
+// question, if none are allowed).
+func filterQuestions(qs []dns.Question, g *Group) ([]dns.Question, verdict) {
 	var keep []dns.Question
+	var first verdict
 
-	for _, q := range qs {
-		if isNameAllowed(q.Name) {
+	for i, q := range qs {
+		v := checkName(q.Name, g)
+		if v.allowed {
+			if keep == nil {
+				first = v
+			}
 			keep = append(keep, q)
+		} else if i == 0 {
+			first = v
 		}
 	}
 
-	return keep
+	return keep, first
 }
 
+// isNameAllowed checks whether the passed name is allowed for clients outside
+// of any group (see checkName).
 func isNameAllowed(n string) bool {
+	return checkName(n, nil).allowed
+}
+
+// checkName checks the name (and each of its parent domains) against the
+// allowlist, which takes precedence, and then the blacklist. The most specific
+// blacklist record found decides, so a paused subdomain is allowed even when
+// its parent domain is blocked. Important records (from $important rules) take
+// precedence over the domains allowlisted by subscriptions, but not over those
+// allowlisted manually. Names without a record are then checked
+// against the pattern rules. Only the records and allowlisted domains from the
+// sources which apply to the passed group (if any) are considered. Hits of the
+// deciding record (or rule) are counted.
+func checkName(n string, g *Group) verdict {
 	n = strings.TrimSuffix(n, ".")
 
-	r, err := db.get(n)
+	key, r, err := db.match(n, g)
+	if err == nil && r.Important && !r.isAllowed() {
+		if akey, err := db.allowlistedManually(n, g); err != nil {
+			log.Printf("db.allowlistedManually(%s) Error: %s\n", n, err)
+		} else if akey != "" {
+			return verdict{allowed: true, decision: decisionAllowlisted, rule: akey}
+		}
+
+		recordHits.add(key, time.Now())
+		return verdict{allowed: false, decision: decisionBlocked, rule: key}
+	}
+
+	if akey, err := db.allowlisted(n, g); err != nil {
+		log.Printf("db.allowlisted(%s) Error: %s\n", n, err)
+	} else if akey != "" {
+		return verdict{allowed: true, decision: decisionAllowlisted, rule: akey}
+	}
+
 	if err != nil {
 		if err == errRecordNotFound {
-			// If no record by that name was found, assume it is allowed
-			return true
+			// If no record by that name was found, it is allowed unless a
+			// pattern rule matches
+			if pattern := ruleSet.match(n); pattern != "" {
+				return verdict{allowed: false, decision: decisionBlocked, rule: pattern}
+			}
+
+			return verdict{allowed: true, decision: decisionAllowed}
 		}
 
-		// For other errors, assume the name is now allowed
-		log.Printf("db.get(%s) Error: %s\n", n, err)
-		return false
+		// For other errors, assume the name is not allowed
+		log.Printf("db.match(%s) Error: %s\n", n, err)
+		return verdict{allowed: false, decision: decisionBlocked}
+	}
+
+	recordHits.add(key, time.Now())
+	if r.isAllowed() {
+		return verdict{allowed: true, decision: decisionPaused, rule: key}
+	}
+
+	return verdict{allowed: false, decision: decisionBlocked, rule: key}
+}
+
+// blockResponse builds the response to a blocked query according to the
+// passed block mode.
+func blockResponse(r *dns.Msg, qs []dns.Question, mode string) *dns.Msg {
+	m := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:                 r.Id,
+			Response:           true,
+			Opcode:             dns.OpcodeQuery,
+			Authoritative:      true,
+			RecursionDesired:   r.RecursionDesired,
+			RecursionAvailable: false,
+			Rcode:              dns.RcodeSuccess,
+		},
+		Question: qs,
+	}
+
+	switch mode {
+	case blockModeRefused:
+		m.Rcode = dns.RcodeRefused
+	case blockModeNoData:
+		// No answers
+	case blockModeNull:
+		m.Answer = blockAnswers(qs, net.IPv4zero, net.IPv6zero)
+	case blockModeSinkhole:
+		m.Answer = blockAnswers(qs, blockIPv4, blockIPv6)
+	default:
+		m.Rcode = dns.RcodeNameError // NXDOMAIN
+	}
+
+	return m
+}
+
+// blockAnswers synthesizes A and AAAA answers for the passed questions. Other
+// question types (and types without a configured address) go unanswered.
+func blockAnswers(qs []dns.Question, ip4, ip6 net.IP) []dns.RR {
+	var rrs []dns.RR
+
+	for _, q := range qs {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: uint32(*dnsBlockTTL)}
+
+		switch {
+		case q.Qtype == dns.TypeA && ip4 != nil:
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+		case q.Qtype == dns.TypeAAAA && ip6 != nil:
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip6})
+		}
+	}
+
+	return rrs
+}
+
+// isBlockedDecision checks whether the passed query decision blocked the
+// query.
+func isBlockedDecision(decision string) bool {
+	switch decision {
+	case decisionBlocked, decisionCloaked, decisionIPBlocked, decisionRebinding:
+		return true
+	}
+
+	return false
+}
+
+// isValidBlockMode checks that the passed string is a known block mode.
+func isValidBlockMode(mode string) bool {
+	switch mode {
+	case blockModeNXDomain, blockModeRefused, blockModeNoData, blockModeNull, blockModeSinkhole:
+		return true
+	}
+
+	return false
+}
+
+// isUsableBlockMode checks that the passed string is a known block mode which
+// can be used, i.e. that "sinkhole" has a -dns-block-ipv4 or -dns-block-ipv6
+// address to answer with.
+func isUsableBlockMode(mode string) bool {
+	if mode == blockModeSinkhole {
+		return blockIPv4 != nil || blockIPv6 != nil
+	}
+
+	return isValidBlockMode(mode)
+}
+
+// clientIP returns the IP address of the passed "host:port" address (or the
+// address itself, if it has no port).
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
 	}
 
-	return r.isAllowed()
+	return host
 }
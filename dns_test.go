@@ -37,8 +37,46 @@ func RunLocalDNSServer(laddr string, echo bool) (*dns.Server, string, error) {
 	return server, pc.LocalAddr().String(), nil
 }
 
+// RunLocalCNAMEServer runs a server answering each query with a CNAME chain
+// from the queried name through the passed targets, the last of which gets an
+// A record.
+func RunLocalCNAMEServer(laddr string, targets ...string) (*dns.Server, string, error) {
+	pc, err := net.ListenPacket("udp", laddr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	server := &dns.Server{PacketConn: pc, ReadTimeout: time.Hour, WriteTimeout: time.Hour}
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		name := r.Question[0].Name
+		for _, target := range targets {
+			m.Answer = append(m.Answer, &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: target})
+			name = target
+		}
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(192, 0, 2, 1)})
+		w.WriteMsg(m)
+	})
+
+	waitLock := sync.Mutex{}
+	waitLock.Lock()
+	server.NotifyStartedFunc = waitLock.Unlock
+
+	go func() {
+		server.ActivateAndServe()
+		pc.Close()
+	}()
+
+	waitLock.Lock()
+	return server, pc.LocalAddr().String(), nil
+}
+
 func Test_dnsHandler(t *testing.T) {
 	db.Reset()
+	dnsCache = newCache(10)
+	defer func() { dnsCache = newCache(0) }()
 
 	s, addrstr, err := RunLocalDNSServer("127.0.0.1:0", false)
 	if err != nil {
@@ -51,7 +89,7 @@ func Test_dnsHandler(t *testing.T) {
 	}
 	defer es.Shutdown()
 
-	*dnsProxyTo = eaddrstr
+	upstreams = MustNewUpstreamPool([]string{eaddrstr}, strategySequential)
 	dns.HandleFunc(".", dnsHandler)
 	defer dns.HandleRemove(".")
 
@@ -111,6 +149,100 @@ func Test_dnsHandler(t *testing.T) {
 	testEqual(t, "Multiple Rcode = %+v, want %+v", r.Rcode, dns.RcodeSuccess)
 	testEqual(t, "Multiple Response len() = %+v, want %+v", len(r.Question), 1)
 	testEqual(t, "Multiple Response Question = %+v, want %+v", r.Question[0].Name, "test.allowed.")
+
+	// Disallowed record, null block mode
+	blockModeMu.Lock()
+	blockMode = blockModeNull
+	blockModeMu.Unlock()
+	m = new(dns.Msg)
+	m.SetQuestion("test.disallowed.", dns.TypeA)
+	r, err = dns.Exchange(m, addrstr)
+	if err != nil {
+		t.Errorf("failed to exchange: %+v", err)
+	}
+	testEqual(t, "Null Rcode = %+v, want %+v", r.Rcode, dns.RcodeSuccess)
+	testEqual(t, "Null Answer len() = %+v, want %+v", len(r.Answer), 1)
+	blockModeMu.Lock()
+	blockMode = blockModeNXDomain
+	blockModeMu.Unlock()
+
+	// Cached response
+	dnsCache.put(testCacheMsg("test.cached.", dns.TypeA, dns.RcodeSuccess, "test.cached. 300 IN A 127.0.0.1"))
+	m = new(dns.Msg)
+	m.SetQuestion("test.cached.", dns.TypeA)
+	r, err = dns.Exchange(m, addrstr)
+	if err != nil {
+		t.Errorf("failed to exchange: %+v", err)
+	}
+	testEqual(t, "Cached Rcode = %+v, want %+v", r.Rcode, dns.RcodeSuccess)
+	testEqual(t, "Cached Id = %+v, want %+v", r.Id, m.Id)
+	testEqual(t, "Cached Answer len() = %+v, want %+v", len(r.Answer), 1)
+	testEqual(t, "Cached hits = %+v, want %+v", dnsCache.stats().Hits, uint64(1))
+}
+
+func Test_proxyQuery(t *testing.T) {
+	// No upstreams
+	m := new(dns.Msg)
+	m.SetQuestion("test.test.", dns.TypeA)
+	e := &QueryLogEntry{}
+	r := proxyQuery(m, e)
+	testEqual(t, "Rcode = %+v, want %+v", r.Rcode, dns.RcodeServerFailure)
+	testEqual(t, "Id = %+v, want %+v", r.Id, m.Id)
+	testEqual(t, "Upstream = %+v, want %+v", e.Upstream, "")
+}
+
+func Test_blockResponse(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("test.disallowed.", dns.TypeA)
+	m.Question = append(m.Question, dns.Question{Name: "test.disallowed.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	m.Question = append(m.Question, dns.Question{Name: "test.disallowed.", Qtype: dns.TypeMX, Qclass: dns.ClassINET})
+
+	r := blockResponse(m, m.Question, blockModeNXDomain)
+	testEqual(t, "NXDOMAIN Rcode = %+v, want %+v", r.Rcode, dns.RcodeNameError)
+	testEqual(t, "NXDOMAIN Id = %+v, want %+v", r.Id, m.Id)
+	testEqual(t, "NXDOMAIN Answer len() = %+v, want %+v", len(r.Answer), 0)
+
+	r = blockResponse(m, m.Question, blockModeRefused)
+	testEqual(t, "REFUSED Rcode = %+v, want %+v", r.Rcode, dns.RcodeRefused)
+	testEqual(t, "REFUSED Answer len() = %+v, want %+v", len(r.Answer), 0)
+
+	r = blockResponse(m, m.Question, blockModeNoData)
+	testEqual(t, "NODATA Rcode = %+v, want %+v", r.Rcode, dns.RcodeSuccess)
+	testEqual(t, "NODATA Answer len() = %+v, want %+v", len(r.Answer), 0)
+
+	r = blockResponse(m, m.Question, blockModeNull)
+	testEqual(t, "Null Rcode = %+v, want %+v", r.Rcode, dns.RcodeSuccess)
+	testEqual(t, "Null Answer len() = %+v, want %+v", len(r.Answer), 2)
+	testEqual(t, "Null Answer[0] = %+v, want %+v", r.Answer[0].String(), "test.disallowed.\t60\tIN\tA\t0.0.0.0")
+	testEqual(t, "Null Answer[1] = %+v, want %+v", r.Answer[1].String(), "test.disallowed.\t60\tIN\tAAAA\t::")
+
+	blockIPv4 = net.ParseIP("10.0.0.1").To4()
+	r = blockResponse(m, m.Question, blockModeSinkhole)
+	testEqual(t, "Sinkhole Rcode = %+v, want %+v", r.Rcode, dns.RcodeSuccess)
+	testEqual(t, "Sinkhole Answer len() = %+v, want %+v", len(r.Answer), 1)
+	testEqual(t, "Sinkhole Answer[0] = %+v, want %+v", r.Answer[0].String(), "test.disallowed.\t60\tIN\tA\t10.0.0.1")
+	blockIPv6 = net.ParseIP("fd00::1")
+	r = blockResponse(m, m.Question, blockModeSinkhole)
+	testEqual(t, "Sinkhole Answer len() = %+v, want %+v", len(r.Answer), 2)
+	testEqual(t, "Sinkhole Answer[1] = %+v, want %+v", r.Answer[1].String(), "test.disallowed.\t60\tIN\tAAAA\tfd00::1")
+	blockIPv4, blockIPv6 = nil, nil
+}
+
+func Test_isValidBlockMode(t *testing.T) {
+	testEqual(t, "isValidBlockMode(nxdomain) = %+v, want %+v", isValidBlockMode("nxdomain"), true)
+	testEqual(t, "isValidBlockMode(sinkhole) = %+v, want %+v", isValidBlockMode("sinkhole"), true)
+	testEqual(t, "isValidBlockMode(NXDOMAIN) = %+v, want %+v", isValidBlockMode("NXDOMAIN"), false)
+	testEqual(t, "isValidBlockMode('') = %+v, want %+v", isValidBlockMode(""), false)
+}
+
+func Test_isUsableBlockMode(t *testing.T) {
+	testEqual(t, "isUsableBlockMode(nxdomain) = %+v, want %+v", isUsableBlockMode("nxdomain"), true)
+	testEqual(t, "isUsableBlockMode(invalid) = %+v, want %+v", isUsableBlockMode("invalid"), false)
+	testEqual(t, "isUsableBlockMode(sinkhole) = %+v, want %+v", isUsableBlockMode("sinkhole"), false)
+
+	blockIPv6 = net.ParseIP("fd00::1")
+	testEqual(t, "isUsableBlockMode(sinkhole) = %+v, want %+v", isUsableBlockMode("sinkhole"), true)
+	blockIPv6 = nil
 }
 
 func Test_filterQuestions(t *testing.T) {
@@ -123,9 +255,362 @@ func Test_filterQuestions(t *testing.T) {
 		t.Errorf("failed to put: %+v", err)
 	}
 
-	qs := filterQuestions([]dns.Question{{Name: "Test.Allowed."}, {Name: "Test.disallowed"}})
+	qs, v := filterQuestions([]dns.Question{{Name: "Test.disallowed"}, {Name: "Test.Allowed."}}, nil)
 	testEqual(t, "len(filterQuestions(...)) = %+v, want %+v", len(qs), 1)
 	testEqual(t, "filterQuestions(...)[0].Name = %+v, want %+v", qs[0].Name, "Test.Allowed.")
+	testEqual(t, "filterQuestions(...) verdict = %+v, want %+v", v, verdict{allowed: true, decision: decisionPaused, rule: "test.allowed"})
+
+	qs, v = filterQuestions([]dns.Question{{Name: "Test.disallowed"}}, nil)
+	testEqual(t, "len(filterQuestions(...)) = %+v, want %+v", len(qs), 0)
+	testEqual(t, "filterQuestions(...) verdict = %+v, want %+v", v, verdict{allowed: false, decision: decisionBlocked, rule: "test.disallowed"})
+}
+
+func Test_checkName(t *testing.T) {
+	db.Reset()
+	recordHits.flush() // Drop the hits counted by other tests
+
+	db.put("example.test", nil)
+	db.put("cdn.example.test", &Record{Paused: true})
+	expired := time.Now().Add(-time.Minute)
+	db.put("expired.example.test", &Record{Paused: true, PausedUntil: &expired})
+	db.allow("allowed.example.test")
+	if err := db.putRule(&Rule{Pattern: "*.tracking.*"}); err != nil {
+		t.Errorf("failed to putRule: %+v", err)
+	}
+	ruleSet.load()
+
+	for n, want := range map[string]verdict{
+		"ad.example.test.":     {allowed: false, decision: decisionBlocked, rule: "example.test"},
+		"img.cdn.example.test": {allowed: true, decision: decisionPaused, rule: "cdn.example.test"},
+		"expired.example.test": {allowed: false, decision: decisionBlocked, rule: "expired.example.test"},
+		"allowed.example.test": {allowed: true, decision: decisionAllowlisted, rule: "allowed.example.test"},
+		"a.tracking.test":      {allowed: false, decision: decisionBlocked, rule: "*.tracking.*"},
+		"other.test":           {allowed: true, decision: decisionAllowed},
+	} {
+		testEqual(t, "checkName("+n+") = %+v, want %+v", checkName(n, nil), want)
+	}
+
+	// Hits of the deciding records are counted
+	recordHits.flush()
+	for k, want := range map[string]uint64{"example.test": 1, "cdn.example.test": 1, "expired.example.test": 1} {
+		r, _ := db.get(k)
+		testEqual(t, "get("+k+").Hits = %+v, want %+v", r.Hits, want)
+	}
+}
+
+func Test_resolve(t *testing.T) {
+	db.Reset()
+	queryLog = newQueryLog(time.Hour)
+	defer func() { queryLog = newQueryLog(0) }()
+
+	s, addrstr, err := RunLocalDNSServer("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("unable to run test server: %v", err)
+	}
+	defer s.Shutdown()
+	upstreams = MustNewUpstreamPool([]string{addrstr}, strategySequential)
+
+	db.put("blocked.test", nil)
+
+	m := new(dns.Msg)
+	m.SetQuestion("Blocked.test.", dns.TypeAAAA)
+	resolve(m, "10.0.0.1")
+	m.SetQuestion("allowed.test.", dns.TypeA)
+	resolve(m, "10.0.0.2")
+
+	entries, err := queryLog.search(QueryLogFilter{}, 10)
+	testEqual(t, "search() err = %+v, want %+v", err, nil)
+	testEqual(t, "len(search()) = %+v, want %+v", len(entries), 2)
+	e := entries[0]
+	testEqual(t, "search()[0] = %+v, want %+v", []string{e.Client, e.Name, e.Type, e.Decision, e.Rule, e.Upstream, e.Rcode}, []string{"10.0.0.2", "allowed.test", "A", decisionAllowed, "", addrstr, "NOERROR"})
+	e = entries[1]
+	testEqual(t, "search()[1] = %+v, want %+v", []string{e.Client, e.Name, e.Type, e.Decision, e.Rule, e.Upstream, e.Rcode}, []string{"10.0.0.1", "blocked.test", "AAAA", decisionBlocked, "blocked.test", "", "NXDOMAIN"})
+}
+
+func Test_resolve_local(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+	queryLog = newQueryLog(time.Hour)
+	defer func() { queryLog = newQueryLog(0) }()
+
+	// Local records are answered ahead of the blacklist
+	db.put("nas.lan", nil)
+	db.putLocalRecords("nas.lan", []LocalRecord{{Type: localRecordA, Value: "192.168.1.10"}})
+
+	m := new(dns.Msg)
+	m.SetQuestion("nas.lan.", dns.TypeA)
+	a := resolve(m, "10.0.0.1")
+	testEqual(t, "resolve() Rcode = %+v, want %+v", a.Rcode, dns.RcodeSuccess)
+	testEqual(t, "len(resolve().Answer) = %+v, want %+v", len(a.Answer), 1)
+
+	entries, _ := queryLog.search(QueryLogFilter{}, 10)
+	testEqual(t, "search()[0].Decision = %+v, want %+v", entries[0].Decision, decisionLocal)
+}
+
+func Test_resolve_forward(t *testing.T) {
+	db.Reset()
+	queryLog = newQueryLog(time.Hour)
+	defer func() { queryLog = newQueryLog(0) }()
+
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		s, addrstr, err := RunLocalDNSServer("127.0.0.1:0", true)
+		if err != nil {
+			t.Fatalf("unable to run test server: %v", err)
+		}
+		defer s.Shutdown()
+		addrs = append(addrs, addrstr)
+	}
+	upstreams = MustNewUpstreamPool([]string{addrs[0]}, strategySequential)
+
+	fs, err := newForwardSet(map[string][]string{"corp.test": {addrs[1]}, "lab.corp.test": {addrs[2]}, "192.168.0.0/16": {addrs[2]}})
+	if err != nil {
+		t.Fatalf("failed to newForwardSet: %v", err)
+	}
+	forwards = fs
+	defer func() { forwards = &ForwardSet{} }()
+
+	// The most specific rule applies
+	m := new(dns.Msg)
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"example.test.", addrs[0]},
+		{"corp.test.", addrs[1]},
+		{"www.Corp.test.", addrs[1]},
+		{"host.lab.corp.test.", addrs[2]},
+		{"notcorp.test.", addrs[0]},
+		{"10.1.168.192.in-addr.arpa.", addrs[2]},
+		{"10.1.0.10.in-addr.arpa.", addrs[0]},
+	} {
+		m.SetQuestion(tt.name, dns.TypeA)
+		resolve(m, "10.0.0.1")
+
+		entries, _ := queryLog.search(QueryLogFilter{}, 1)
+		testEqual(t, "resolve("+tt.name+") Upstream = %+v, want %+v", entries[0].Upstream, tt.want)
+	}
+
+	// The proxied question applies, rather than the logged one
+	m.SetQuestion("www.corp.test.", dns.TypeA)
+	e := &QueryLogEntry{Name: "example.test"}
+	proxyQuery(m, e)
+	testEqual(t, "proxyQuery() Upstream = %+v, want %+v", e.Upstream, addrs[1])
+}
+
+func Test_filterCNAMEs(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+	*dnsCNAMECheck = true
+	defer func() { *dnsCNAMECheck = false }()
+
+	db.put("tracker.test", nil)
+	db.allow("cdn.tracker.test")
+
+	r := new(dns.Msg)
+	r.SetQuestion("metrics.example.test.", dns.TypeA)
+	chain := func(targets ...string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		name := r.Question[0].Name
+		for _, target := range targets {
+			m.Answer = append(m.Answer, &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: target})
+			name = target
+		}
+		return m
+	}
+
+	// No CNAMEs, or none blocked
+	e := &QueryLogEntry{Decision: decisionAllowed}
+	testEqual(t, "filterCNAMEs() = %+v, want %+v", filterCNAMEs(r, chain(), e, nil) == nil, true)
+	testEqual(t, "filterCNAMEs() = %+v, want %+v", filterCNAMEs(r, chain("www.example.test.", "cdn.tracker.test."), e, nil) == nil, true)
+	testEqual(t, "e.Decision = %+v, want %+v", e.Decision, decisionAllowed)
+
+	// A blocked target further down the chain
+	b := filterCNAMEs(r, chain("www.example.test.", "Eu.Tracker.test."), e, nil)
+	testEqual(t, "filterCNAMEs() Rcode = %+v, want %+v", b.Rcode, dns.RcodeNameError)
+	testEqual(t, "filterCNAMEs() Question = %+v, want %+v", b.Question, r.Question)
+	testEqual(t, "e = %+v, want %+v", []string{e.Decision, e.Rule, e.CNAME}, []string{decisionCloaked, "tracker.test", "eu.tracker.test"})
+
+	// The block mode of the group applies
+	b = filterCNAMEs(r, chain("tracker.test."), &QueryLogEntry{}, &Group{BlockMode: blockModeRefused})
+	testEqual(t, "filterCNAMEs() Rcode = %+v, want %+v", b.Rcode, dns.RcodeRefused)
+
+	// Unless enabled
+	*dnsCNAMECheck = false
+	testEqual(t, "filterCNAMEs() = %+v, want %+v", filterCNAMEs(r, chain("tracker.test."), &QueryLogEntry{}, nil) == nil, true)
+}
+
+func Test_resolve_cname(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+	queryLog = newQueryLog(time.Hour)
+	defer func() { queryLog = newQueryLog(0) }()
+	*dnsCNAMECheck = true
+	defer func() { *dnsCNAMECheck = false }()
+
+	s, addrstr, err := RunLocalCNAMEServer("127.0.0.1:0", "edge.example.test.", "collect.tracker.test.")
+	if err != nil {
+		t.Fatalf("unable to run test server: %v", err)
+	}
+	defer s.Shutdown()
+	upstreams = MustNewUpstreamPool([]string{addrstr}, strategySequential)
+
+	m := new(dns.Msg)
+	m.SetQuestion("metrics.example.test.", dns.TypeA)
+	testEqual(t, "resolve() Rcode = %+v, want %+v", resolve(m, "10.0.0.1").Rcode, dns.RcodeSuccess)
+
+	db.put("tracker.test", nil)
+	m.SetQuestion("metrics.example.test.", dns.TypeA)
+	a := resolve(m, "10.0.0.1")
+	testEqual(t, "resolve() Rcode = %+v, want %+v", a.Rcode, dns.RcodeNameError)
+	testEqual(t, "len(resolve().Answer) = %+v, want %+v", len(a.Answer), 0)
+
+	entries, _ := queryLog.search(QueryLogFilter{}, 1)
+	e := entries[0]
+	testEqual(t, "search()[0] = %+v, want %+v", []string{e.Name, e.Decision, e.Rule, e.CNAME, e.Rcode}, []string{"metrics.example.test", decisionCloaked, "tracker.test", "collect.tracker.test", "NXDOMAIN"})
+
+	// Allowlisted names aren't checked
+	db.allow("metrics.example.test")
+	m.SetQuestion("metrics.example.test.", dns.TypeA)
+	testEqual(t, "resolve() Rcode = %+v, want %+v", resolve(m, "10.0.0.1").Rcode, dns.RcodeSuccess)
+}
+
+func Test_filterAddrs(t *testing.T) {
+	db.Reset()
+	defer func() {
+		db.Reset()
+		ipBlacklist.load()
+	}()
+
+	r := new(dns.Msg)
+	r.SetQuestion("ads.example.test.", dns.TypeA)
+	answer := func(ips ...string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.CNAME{Hdr: dns.RR_Header{Name: "ads.example.test.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: "edge.example.test."})
+		for _, ip := range ips {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: "edge.example.test.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP(ip)})
+		}
+		return m
+	}
+
+	// Nothing blocked
+	m := answer("192.0.2.1")
+	testEqual(t, "filterAddrs() = %+v, want %+v", filterAddrs(r, m, &QueryLogEntry{}, nil) == m, true)
+
+	db.blockIP("192.0.2.0/24")
+	ipBlacklist.load()
+
+	// Some addresses blocked
+	e := &QueryLogEntry{Decision: decisionAllowed}
+	got := filterAddrs(r, answer("192.0.2.1", "198.51.100.1", "192.0.2.2"), e, nil)
+	testEqual(t, "len(filterAddrs().Answer) = %+v, want %+v", len(got.Answer), 2)
+	testEqual(t, "filterAddrs().Answer[1] = %+v, want %+v", got.Answer[1].(*dns.A).A.String(), "198.51.100.1")
+	testEqual(t, "e.Decision = %+v, want %+v", e.Decision, decisionAllowed)
+
+	// Every address blocked
+	got = filterAddrs(r, answer("192.0.2.1", "192.0.2.2"), e, &Group{BlockMode: blockModeRefused})
+	testEqual(t, "filterAddrs() Rcode = %+v, want %+v", got.Rcode, dns.RcodeRefused)
+	testEqual(t, "e = %+v, want %+v", []string{e.Decision, e.Rule}, []string{decisionIPBlocked, "192.0.2.0/24"})
+}
+
+func Test_resolve_ipblacklist(t *testing.T) {
+	db.Reset()
+	defer func() {
+		db.Reset()
+		ipBlacklist.load()
+	}()
+	queryLog = newQueryLog(time.Hour)
+	defer func() { queryLog = newQueryLog(0) }()
+
+	s, addrstr, err := RunLocalCNAMEServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to run test server: %v", err)
+	}
+	defer s.Shutdown()
+	upstreams = MustNewUpstreamPool([]string{addrstr}, strategySequential)
+
+	db.blockIP("192.0.2.0/24")
+	ipBlacklist.load()
+
+	m := new(dns.Msg)
+	m.SetQuestion("rotating1.example.test.", dns.TypeA)
+	testEqual(t, "resolve() Rcode = %+v, want %+v", resolve(m, "10.0.0.1").Rcode, dns.RcodeNameError)
+
+	entries, _ := queryLog.search(QueryLogFilter{}, 1)
+	testEqual(t, "search()[0] = %+v, want %+v", []string{entries[0].Decision, entries[0].Rule}, []string{decisionIPBlocked, "192.0.2.0/24"})
+
+	// Allowlisted names aren't checked
+	db.allow("rotating1.example.test")
+	m.SetQuestion("rotating1.example.test.", dns.TypeA)
+	testEqual(t, "len(resolve().Answer) = %+v, want %+v", len(resolve(m, "10.0.0.1").Answer), 1)
+}
+
+func Test_checkName_group(t *testing.T) {
+	db.Reset()
+
+	db.put("manual.test", nil)
+	db.put("ads.test", &Record{Source: "ads"})
+	db.put("casino.test", &Record{Source: "gambling"})
+	db.put("sub.ads.test", &Record{Source: "gambling"})
+	db.allow("allowed.casino.test")
+
+	kids := &Group{Sources: []string{"gambling"}}
+	testEqual(t, "checkName('casino.test') = %+v, want %+v", checkName("casino.test.", kids), verdict{allowed: false, decision: decisionBlocked, rule: "casino.test"})
+	testEqual(t, "checkName('ads.test') = %+v, want %+v", checkName("ads.test.", kids), verdict{allowed: true, decision: decisionAllowed})
+	testEqual(t, "checkName('x.sub.ads.test') = %+v, want %+v", checkName("x.sub.ads.test.", kids), verdict{allowed: false, decision: decisionBlocked, rule: "sub.ads.test"})
+	testEqual(t, "checkName('manual.test') = %+v, want %+v", checkName("manual.test.", kids), verdict{allowed: true, decision: decisionAllowed})
+	testEqual(t, "checkName('allowed.casino.test') = %+v, want %+v", checkName("allowed.casino.test.", kids), verdict{allowed: true, decision: decisionAllowlisted, rule: "allowed.casino.test"})
+
+	// Records from sources which don't apply are skipped, so the parent
+	// domain's record decides
+	work := &Group{Sources: []string{"ads", sourceManual}, NoAllowlist: true}
+	testEqual(t, "checkName('x.sub.ads.test') = %+v, want %+v", checkName("x.sub.ads.test.", work), verdict{allowed: false, decision: decisionBlocked, rule: "ads.test"})
+	testEqual(t, "checkName('manual.test') = %+v, want %+v", checkName("manual.test.", work), verdict{allowed: false, decision: decisionBlocked, rule: "manual.test"})
+	testEqual(t, "checkName('casino.test') = %+v, want %+v", checkName("casino.test.", work), verdict{allowed: true, decision: decisionAllowed})
+
+	// Allowlisted domains from a subscription only apply along with its records
+	if err := db.replaceSourceAllowlist("gambling", map[string]bool{"ok.ads.test": true}); err != nil {
+		t.Errorf("failed to replaceSourceAllowlist: %+v", err)
+	}
+	db.put("ok.ads.test", &Record{Source: "ads"})
+	testEqual(t, "checkName('ok.ads.test') = %+v, want %+v", checkName("ok.ads.test.", &Group{Sources: []string{"ads"}}).decision, decisionBlocked)
+	testEqual(t, "checkName('ok.ads.test') = %+v, want %+v", checkName("ok.ads.test.", &Group{Sources: []string{"ads", "gambling"}}).decision, decisionAllowlisted)
+}
+
+func Test_resolve_group(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+	queryLog = newQueryLog(time.Hour)
+	defer func() { queryLog = newQueryLog(0) }()
+
+	db.put("ads.test", &Record{Source: "ads"})
+	db.putGroup("kids", &Group{Clients: []string{"10.0.0.0/24"}, BlockMode: blockModeRefused})
+	db.putGroup("work", &Group{Clients: []string{"10.0.1.0/24"}, Sources: []string{"gambling"}})
+	groupSet.load()
+
+	m := new(dns.Msg)
+	m.SetQuestion("ads.test.", dns.TypeA)
+	testEqual(t, "resolve(kids) Rcode = %+v, want %+v", resolve(m, "10.0.0.5").Rcode, dns.RcodeRefused)
+	m.SetQuestion("ads.test.", dns.TypeA)
+	testEqual(t, "resolve() Rcode = %+v, want %+v", resolve(m, "10.0.2.5").Rcode, dns.RcodeNameError)
+
+	entries, _ := queryLog.search(QueryLogFilter{Client: "10.0.0.5"}, 10)
+	testEqual(t, "search()[0].Group = %+v, want %+v", entries[0].Group, "kids")
+
+	// The record's source doesn't apply to the work group, so the query is
+	// proxied (and fails, as there are no upstreams)
+	upstreams = MustNewUpstreamPool(nil, strategySequential)
+	defer func() { upstreams = &UpstreamPool{strategy: strategySequential} }()
+	m.SetQuestion("ads.test.", dns.TypeA)
+	testEqual(t, "resolve(work) Rcode = %+v, want %+v", resolve(m, "10.0.1.5").Rcode, dns.RcodeServerFailure)
+}
+
+func Test_clientIP(t *testing.T) {
+	testEqual(t, "clientIP() = %+v, want %+v", clientIP("10.0.0.1:53"), "10.0.0.1")
+	testEqual(t, "clientIP() = %+v, want %+v", clientIP("[fd00::1]:53"), "fd00::1")
+	testEqual(t, "clientIP() = %+v, want %+v", clientIP("10.0.0.1"), "10.0.0.1")
 }
 
 func Test_isNameAllowed(t *testing.T) {
@@ -136,4 +621,46 @@ func Test_isNameAllowed(t *testing.T) {
 	testEqual(t, "isNameAllowed('test.allowed') = %+v, want %+v", isNameAllowed("Test.Allowed."), true)
 	testEqual(t, "isNameAllowed('test.disallowed') = %+v, want %+v", isNameAllowed("Test.Disallowed"), false)
 	testEqual(t, "isNameAllowed('not.in.db') = %+v, want %+v", isNameAllowed("not.in.db."), true)
+
+	// Subdomains
+	db.put("example.test", nil)
+	db.put("cdn.example.test", &Record{Paused: true})
+	testEqual(t, "isNameAllowed('ad.example.test') = %+v, want %+v", isNameAllowed("ad.example.test."), false)
+	testEqual(t, "isNameAllowed('stats.g.example.test') = %+v, want %+v", isNameAllowed("stats.g.example.test."), false)
+	testEqual(t, "isNameAllowed('cdn.example.test') = %+v, want %+v", isNameAllowed("cdn.example.test."), true)
+	testEqual(t, "isNameAllowed('img.cdn.example.test') = %+v, want %+v", isNameAllowed("img.cdn.example.test."), true)
+	testEqual(t, "isNameAllowed('notexample.test') = %+v, want %+v", isNameAllowed("notexample.test."), true)
+
+	// Allowlist
+	db.allow("ad.example.test")
+	testEqual(t, "isNameAllowed('ad.example.test') = %+v, want %+v", isNameAllowed("ad.example.test."), true)
+	testEqual(t, "isNameAllowed('x.ad.example.test') = %+v, want %+v", isNameAllowed("x.ad.example.test."), true)
+	testEqual(t, "isNameAllowed('stats.g.example.test') = %+v, want %+v", isNameAllowed("stats.g.example.test."), false)
+	db.allow("test.disallowed")
+	testEqual(t, "isNameAllowed('test.disallowed') = %+v, want %+v", isNameAllowed("Test.Disallowed"), true)
+
+	// Important records take precedence over the domains allowlisted by a
+	// subscription (unless paused), but not over those allowlisted manually
+	db.put("x.ad.example.test", &Record{Important: true})
+	testEqual(t, "isNameAllowed('x.ad.example.test') = %+v, want %+v", isNameAllowed("x.ad.example.test."), true)
+	db.disallow("ad.example.test")
+	if err := db.replaceSourceAllowlist("test", map[string]bool{"ad.example.test": true}); err != nil {
+		t.Errorf("failed to replaceSourceAllowlist: %+v", err)
+	}
+	testEqual(t, "isNameAllowed('x.ad.example.test') = %+v, want %+v", isNameAllowed("x.ad.example.test."), false)
+	db.put("x.ad.example.test", &Record{Important: true, Paused: true})
+	testEqual(t, "isNameAllowed('x.ad.example.test') = %+v, want %+v", isNameAllowed("x.ad.example.test."), true)
+	db.replaceSourceAllowlist("test", nil)
+	db.allow("ad.example.test")
+
+	// Pattern rules (after records)
+	if err := db.putRule(&Rule{Pattern: "*.tracking.*"}); err != nil {
+		t.Errorf("failed to putRule: %+v", err)
+	}
+	ruleSet.load()
+	db.put("paused.tracking.test", &Record{Paused: true})
+	testEqual(t, "isNameAllowed('a.tracking.test') = %+v, want %+v", isNameAllowed("a.tracking.test."), false)
+	testEqual(t, "isNameAllowed('paused.tracking.test') = %+v, want %+v", isNameAllowed("paused.tracking.test."), true)
+	db.allow("allowed.tracking.test")
+	testEqual(t, "isNameAllowed('allowed.tracking.test') = %+v, want %+v", isNameAllowed("allowed.tracking.test."), true)
 }
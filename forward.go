@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ForwardSet represents the conditional forwarding rules, each proxying the
+// queries for a domain (and its subdomains) to its own upstream servers rather
+// than to -dns-proxyto. A rule's domain may also be a CIDR range, which stands
+// for the reverse lookup zones of its addresses.
+type ForwardSet struct {
+	rules map[string][]string      // Upstream addresses, by domain (or CIDR)
+	pools map[string]*UpstreamPool // Upstream pools, by zone
+}
+
+// newForwardSet compiles the passed rules. The upstreams of rules covering the
+// same zone are combined, and are tried sequentially.
+func newForwardSet(rules map[string][]string) (*ForwardSet, error) {
+	fs := &ForwardSet{rules: make(map[string][]string), pools: make(map[string]*UpstreamPool)}
+	addrs := make(map[string][]string)
+
+	for k, us := range rules {
+		k, zones, err := forwardZones(k)
+		if err != nil {
+			return nil, err
+		}
+		if len(us) == 0 {
+			return nil, fmt.Errorf("no upstream servers to forward %s to", k)
+		}
+
+		fs.rules[k] = append(fs.rules[k], us...)
+		for _, z := range zones {
+			addrs[z] = append(addrs[z], us...)
+		}
+	}
+
+	for z, us := range addrs {
+		pool, err := newUpstreamPool(us, strategySequential)
+		if err != nil {
+			return nil, err
+		}
+		fs.pools[z] = pool
+	}
+
+	return fs, nil
+}
+
+// match returns the zone and upstream pool of the most specific rule covering
+// the passed name, or nil if no rule covers it.
+func (fs *ForwardSet) match(n string) (string, *UpstreamPool) {
+	n = strings.ToLower(strings.TrimSuffix(n, "."))
+
+	for n != "" {
+		if pool, ok := fs.pools[n]; ok {
+			return n, pool
+		}
+
+		i := strings.IndexByte(n, '.')
+		if i < 0 {
+			break
+		}
+		n = n[i+1:]
+	}
+
+	return "", nil
+}
+
+// list returns a copy of the rules.
+func (fs *ForwardSet) list() map[string][]string {
+	rules := make(map[string][]string, len(fs.rules))
+
+	for k, us := range fs.rules {
+		rules[k] = append([]string(nil), us...)
+	}
+
+	return rules
+}
+
+// close stops probing the upstreams of the rules (once the set has been
+// replaced).
+func (fs *ForwardSet) close() {
+	for _, pool := range fs.pools {
+		pool.close()
+	}
+}
+
+// forwardZones returns the normalized form of the passed rule domain (or CIDR
+// range), along with the zones it covers.
+func forwardZones(s string) (string, []string, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid forwarding CIDR: %s", s)
+		}
+
+		return n.String(), reverseZones(n), nil
+	}
+
+	s = strings.ToLower(strings.TrimSuffix(s, "."))
+	if !isValidLocalName(s) {
+		return "", nil, fmt.Errorf("invalid forwarding domain: %s", s)
+	}
+
+	return s, []string{s}, nil
+}
+
+// reverseZones returns the in-addr.arpa (or ip6.arpa) zones covering the passed
+// range. Zones are delegated on octet (or nibble) boundaries, so a range which
+// doesn't fall on one is covered by several zones (e.g. 10.0.0.0/23 by
+// 0.0.10.in-addr.arpa and 1.0.10.in-addr.arpa).
+func reverseZones(n *net.IPNet) []string {
+	var zones []string
+
+	ones, bits := n.Mask.Size()
+	ip := n.IP.To4()
+	step, suffix := 8, "in-addr.arpa"
+	if ip == nil || bits != 32 {
+		ip, step, suffix = n.IP.To16(), 4, "ip6.arpa"
+	}
+
+	// Round the prefix up to the next boundary
+	labels := (ones + step - 1) / step
+	count := 1 << uint(labels*step-ones)
+
+	for i := 0; i < count; i++ {
+		zip := append(net.IP(nil), ip...)
+
+		var parts []string
+		if step == 8 {
+			if labels > 0 {
+				zip[labels-1] |= byte(i)
+			}
+			for j := labels - 1; j >= 0; j-- {
+				parts = append(parts, strconv.Itoa(int(zip[j])))
+			}
+		} else {
+			if labels > 0 {
+				if j := labels - 1; j%2 == 0 {
+					zip[j/2] |= byte(i) << 4
+				} else {
+					zip[j/2] |= byte(i)
+				}
+			}
+			for j := labels - 1; j >= 0; j-- {
+				nibble := zip[j/2] >> 4
+				if j%2 == 1 {
+					nibble = zip[j/2] & 0xf
+				}
+				parts = append(parts, strconv.FormatUint(uint64(nibble), 16))
+			}
+		}
+
+		zones = append(zones, strings.Join(append(parts, suffix), "."))
+	}
+
+	return zones
+}
+
+// parseForwards adds the passed comma separated "domain=upstream" rules (such
+// as "corp.example.com=10.0.0.53:53,192.168.0.0/16=192.168.1.1:53") to rules.
+// Repeating a domain adds upstreams to it.
+func parseForwards(s string, rules map[string][]string) error {
+	for _, rule := range strings.Split(s, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+
+		i := strings.IndexByte(rule, '=')
+		if i <= 0 || i == len(rule)-1 {
+			return fmt.Errorf("invalid forwarding rule: %s", rule)
+		}
+		rules[rule[:i]] = append(rules[rule[:i]], rule[i+1:])
+	}
+
+	return nil
+}
+
+// readForwards adds the rules of the passed file to rules. Each line holds a
+// domain (or CIDR range) followed by its upstream addresses, in the manner of
+// a hosts file.
+func readForwards(fname string, rules map[string][]string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		domain, us := parseHostsLine(scanner.Text())
+		if domain == "" && len(us) == 0 {
+			continue
+		}
+		if domain == "" {
+			return fmt.Errorf("no upstream servers to forward %s to", us[0])
+		}
+
+		rules[domain] = append(rules[domain], us...)
+	}
+
+	return scanner.Err()
+}
+
+// currentForwards returns the conditional forwarding rules.
+func currentForwards() *ForwardSet {
+	forwardsMu.RLock()
+	defer forwardsMu.RUnlock()
+
+	return forwards
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func Test_reverseZones(t *testing.T) {
+	for _, tt := range []struct {
+		cidr string
+		want []string
+	}{
+		{"192.168.0.0/16", []string{"168.192.in-addr.arpa"}},
+		{"192.168.1.0/24", []string{"1.168.192.in-addr.arpa"}},
+		{"10.0.0.0/23", []string{"0.0.10.in-addr.arpa", "1.0.10.in-addr.arpa"}},
+		{"10.0.0.0/8", []string{"10.in-addr.arpa"}},
+		{"fd00::/8", []string{"d.f.ip6.arpa"}},
+		{"fd00::/7", []string{"c.f.ip6.arpa", "d.f.ip6.arpa"}},
+		{"2001:db8::/32", []string{"8.b.d.0.1.0.0.2.ip6.arpa"}},
+	} {
+		_, n, _ := net.ParseCIDR(tt.cidr)
+		testEqual(t, "reverseZones("+tt.cidr+") = %+v, want %+v", reverseZones(n), tt.want)
+	}
+}
+
+func Test_newForwardSet(t *testing.T) {
+	for _, rules := range []map[string][]string{
+		{"corp.test": nil},
+		{"*.corp.test": {"127.0.0.1:53"}},
+		{"10.0.0.0/33": {"127.0.0.1:53"}},
+		{"corp.test": {"ftp://127.0.0.1"}},
+	} {
+		_, err := newForwardSet(rules)
+		testEqual(t, "newForwardSet() err != nil = %+v, want %+v", err != nil, true)
+	}
+
+	fs, err := newForwardSet(map[string][]string{"Corp.Test.": {"127.0.0.1:53"}, "10.1.2.3/16": {"127.0.0.2:53"}, "2.10.in-addr.arpa": {"127.0.0.3:53"}})
+	testEqual(t, "newForwardSet() err = %+v, want %+v", err, nil)
+	testEqual(t, "list() = %+v, want %+v", fs.list(), map[string][]string{"corp.test": {"127.0.0.1:53"}, "10.1.0.0/16": {"127.0.0.2:53"}, "2.10.in-addr.arpa": {"127.0.0.3:53"}})
+
+	zone, pool := fs.match("WWW.corp.test.")
+	testEqual(t, "match('www.corp.test') = %+v, want %+v", []interface{}{zone, pool.addrs()}, []interface{}{"corp.test", []string{"127.0.0.1:53"}})
+	zone, pool = fs.match("4.3.1.10.in-addr.arpa.")
+	testEqual(t, "match('4.3.1.10.in-addr.arpa') = %+v, want %+v", []interface{}{zone, pool.addrs()}, []interface{}{"1.10.in-addr.arpa", []string{"127.0.0.2:53"}})
+	zone, pool = fs.match("othercorp.test.")
+	testEqual(t, "match('othercorp.test') = %+v, want %+v", []interface{}{zone, pool == nil}, []interface{}{"", true})
+	zone, pool = fs.match("test.")
+	testEqual(t, "match('test') = %+v, want %+v", []interface{}{zone, pool == nil}, []interface{}{"", true})
+}
+
+func Test_parseForwards(t *testing.T) {
+	rules := make(map[string][]string)
+	testEqual(t, "parseForwards() = %+v, want %+v", parseForwards("", rules), nil)
+	testEqual(t, "parseForwards() = %+v, want %+v", parseForwards("corp.test=10.0.0.53:53, corp.test=10.0.0.54:53,192.168.0.0/16=192.168.1.1:53", rules), nil)
+	testEqual(t, "rules = %+v, want %+v", rules, map[string][]string{"corp.test": {"10.0.0.53:53", "10.0.0.54:53"}, "192.168.0.0/16": {"192.168.1.1:53"}})
+
+	for _, s := range []string{"corp.test", "=10.0.0.53:53", "corp.test="} {
+		testEqual(t, "parseForwards("+s+") err != nil = %+v, want %+v", parseForwards(s, rules) != nil, true)
+	}
+}
+
+func Test_readForwards(t *testing.T) {
+	f, err := ioutil.TempFile("", "nogo-forwards-")
+	if err != nil {
+		t.Errorf("failed to create TempFile: %+v", err)
+	}
+	f.WriteString("# comment\n\ncorp.test 10.0.0.53:53 10.0.0.54:53 # internal\n192.168.0.0/16\t192.168.1.1:53\n")
+	f.Sync()
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	rules := map[string][]string{"corp.test": {"10.0.0.52:53"}}
+	testEqual(t, "readForwards() = %+v, want %+v", readForwards(f.Name(), rules), nil)
+	testEqual(t, "rules = %+v, want %+v", rules, map[string][]string{"corp.test": {"10.0.0.52:53", "10.0.0.53:53", "10.0.0.54:53"}, "192.168.0.0/16": {"192.168.1.1:53"}})
+
+	f.WriteString("lab.test\n")
+	f.Sync()
+	testEqual(t, "readForwards() err != nil = %+v, want %+v", readForwards(f.Name(), rules) != nil, true)
+}
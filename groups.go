@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sourceManual is the group source of the records (and allowlisted domains)
+// which were added manually or imported, rather than from a subscription.
+const sourceManual = "manual"
+
+// GroupSet represents the client groups, indexed by their clients
+type GroupSet struct {
+	mu      sync.RWMutex
+	clients []groupClient // Most specific first
+}
+
+type groupClient struct {
+	network *net.IPNet
+	name    string
+	group   *Group
+}
+
+// load replaces the group set with the groups stored in the database.
+func (gs *GroupSet) load() {
+	var clients []groupClient
+
+	for name, g := range db.getGroups() {
+		for _, c := range g.Clients {
+			if n := parseClient(c); n != nil {
+				clients = append(clients, groupClient{network: n, name: name, group: g})
+			}
+		}
+	}
+
+	// Sort by prefix length (and then by name, so that clients listed by more
+	// than one group consistently match the same group)
+	sort.Slice(clients, func(i, j int) bool {
+		a, _ := clients[i].network.Mask.Size()
+		b, _ := clients[j].network.Mask.Size()
+		if a != b {
+			return a > b
+		}
+
+		return clients[i].name < clients[j].name
+	})
+
+	gs.mu.Lock()
+	gs.clients = clients
+	gs.mu.Unlock()
+}
+
+// match returns the name and policy of the group the passed client IP belongs
+// to, preferring the most specific client (or nil if it belongs to none).
+func (gs *GroupSet) match(client string) (string, *Group) {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return "", nil
+	}
+
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+
+	for _, c := range gs.clients {
+		if c.network.Contains(ip) {
+			return c.name, c.group
+		}
+	}
+
+	return "", nil
+}
+
+// hasSource checks whether the records from the passed source (empty if added
+// manually) apply to the group. All sources apply without a group, or if the
+// group doesn't list any.
+func (g *Group) hasSource(source string) bool {
+	if g == nil || len(g.Sources) == 0 {
+		return true
+	}
+
+	if source == "" {
+		source = sourceManual
+	}
+
+	for _, s := range g.Sources {
+		if s == source {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isValid checks that the group's clients are IP addresses or CIDR ranges, and
+// that its block mode (if any) is known.
+func (g *Group) isValid() bool {
+	if len(g.Clients) == 0 {
+		return false
+	}
+
+	for _, c := range g.Clients {
+		if parseClient(c) == nil {
+			return false
+		}
+	}
+
+	for _, s := range g.Sources {
+		if s != sourceManual && !isValidSubscriptionName(s) {
+			return false
+		}
+	}
+
+	return g.BlockMode == "" || isUsableBlockMode(g.BlockMode)
+}
+
+// parseClient parses the passed IP address or CIDR range, returning nil if it
+// is neither.
+func parseClient(s string) *net.IPNet {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil
+		}
+
+		return n
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// splitList splits the passed comma (or space) separated list.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+}
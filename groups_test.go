@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGroupSet_match(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+
+	db.putGroup("lan", &Group{Clients: []string{"10.0.0.0/8", "fd00::/8"}})
+	db.putGroup("kids", &Group{Clients: []string{"10.0.0.20", "10.0.1.0/24"}})
+	db.putGroup("also", &Group{Clients: []string{"10.0.1.0/24"}})
+
+	gs := &GroupSet{}
+	gs.load()
+
+	for client, want := range map[string]string{
+		"10.0.0.20":   "kids",
+		"10.0.0.21":   "lan",
+		"10.0.1.5":    "also", // Listed by two groups of the same specificity
+		"fd00::1":     "lan",
+		"192.168.1.1": "",
+		"invalid":     "",
+	} {
+		name, g := gs.match(client)
+		testEqual(t, "match("+client+") = %+v, want %+v", name, want)
+		testEqual(t, "match("+client+") group = %+v, want %+v", g != nil, want != "")
+	}
+}
+
+func TestGroup_hasSource(t *testing.T) {
+	var g *Group
+	testEqual(t, "nil.hasSource() = %+v, want %+v", g.hasSource("ads"), true)
+
+	g = &Group{}
+	testEqual(t, "hasSource() = %+v, want %+v", g.hasSource("ads"), true)
+
+	g = &Group{Sources: []string{"adult", sourceManual}}
+	testEqual(t, "hasSource('adult') = %+v, want %+v", g.hasSource("adult"), true)
+	testEqual(t, "hasSource('') = %+v, want %+v", g.hasSource(""), true)
+	testEqual(t, "hasSource('ads') = %+v, want %+v", g.hasSource("ads"), false)
+
+	g = &Group{Sources: []string{"ads"}}
+	testEqual(t, "hasSource('') = %+v, want %+v", g.hasSource(""), false)
+}
+
+func TestGroup_isValid(t *testing.T) {
+	for _, tc := range []struct {
+		g    Group
+		want bool
+	}{
+		{Group{Clients: []string{"10.0.0.1", "10.0.1.0/24", "fd00::1"}}, true},
+		{Group{Clients: []string{"10.0.0.1"}, Sources: []string{"ads", sourceManual}, BlockMode: blockModeNull}, true},
+		{Group{}, false},
+		{Group{Clients: []string{"10.0.0.256"}}, false},
+		{Group{Clients: []string{"10.0.0.0/33"}}, false},
+		{Group{Clients: []string{"10.0.0.1"}, Sources: []string{"a b"}}, false},
+		{Group{Clients: []string{"10.0.0.1"}, BlockMode: "invalid"}, false},
+		{Group{Clients: []string{"10.0.0.1"}, BlockMode: blockModeSinkhole}, false}, // No sinkhole address
+	} {
+		testEqual(t, "isValid(%+v) = %+v, want %+v", tc.g, tc.g.isValid(), tc.want)
+	}
+}
+
+func Test_parseClient(t *testing.T) {
+	testEqual(t, "parseClient() = %+v, want %+v", parseClient("10.0.0.1").String(), "10.0.0.1/32")
+	testEqual(t, "parseClient() = %+v, want %+v", parseClient("fd00::1").String(), "fd00::1/128")
+	testEqual(t, "parseClient() = %+v, want %+v", parseClient("10.0.0.1/24").String(), "10.0.0.0/24")
+	testEqual(t, "parseClient() = %+v, want %+v", parseClient("example.test") == nil, true)
+}
+
+func Test_splitList(t *testing.T) {
+	testEqual(t, "splitList() = %+v, want %+v", splitList(" 10.0.0.1, 10.0.0.2 10.0.1.0/24,"), []string{"10.0.0.1", "10.0.0.2", "10.0.1.0/24"})
+	testEqual(t, "len(splitList('')) = %+v, want %+v", len(splitList("")), 0)
+}
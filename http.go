@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/miekg/dns"
@@ -85,7 +89,16 @@ func rootIndexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = tmpl.Execute(w, H{"data": data, "isDisabled": isDisabled, "totalCount": totalCount, "q": q, "p": p}); err != nil {
+	disabled, until := disabledState()
+	vars := H{"data": data, "isDisabled": disabled, "disabledUntil": until, "totalCount": totalCount, "q": q, "p": p}
+	if q == "" && p != "1" {
+		// Dashboard
+		sum := queryStats.summary(statsPeriodDay, time.Now())
+		vars["stats"] = sum
+		vars["chart"] = statsBars(sum.Queries)
+	}
+
+	if err = tmpl.Execute(w, vars); err != nil {
 		log.Printf("tmpl.Execute() Error: %s\n", err)
 		http.Error(w, http.StatusText(500), 500)
 	}
@@ -93,17 +106,37 @@ func rootIndexHandler(w http.ResponseWriter, r *http.Request) {
 
 // POST /records/
 func recordsCreateHandler(w http.ResponseWriter, r *http.Request) {
-	var rec *Record
-
 	key := r.FormValue("key")
 	if !isValidDomainName(key) {
 		http.Error(w, http.StatusText(422), 422)
 		return
 	}
 
+	// Start from an existing record, so that only its pause state (and comment,
+	// if passed) changes
+	rec, err := db.get(key)
+	if err == errRecordNotFound {
+		rec = &Record{}
+	} else if err != nil {
+		log.Printf("db.get(%s) Error: %s\n", key, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	rec.Paused, rec.PausedUntil = false, nil
+	if c := r.FormValue("comment"); c != "" {
+		rec.Comment = c
+	}
+
 	p := r.FormValue("paused")
 	if p == "1" {
-		rec = &Record{Paused: true}
+		until, err := pauseUntil(r.FormValue("for"))
+		if err != nil {
+			http.Error(w, http.StatusText(422), 422)
+			return
+		}
+
+		rec.Paused, rec.PausedUntil = true, until
 	}
 
 	// Save
@@ -146,7 +179,8 @@ func recordsReadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = tmpl.Execute(w, H{"data": data, "isDisabled": isDisabled, "totalCount": totalCount}); err != nil {
+	disabled, until := disabledState()
+	if err = tmpl.Execute(w, H{"data": data, "isDisabled": disabled, "disabledUntil": until, "totalCount": totalCount}); err != nil {
 		log.Printf("tmpl.Execute() Error: %s\n", err)
 		http.Error(w, http.StatusText(500), 500)
 	}
@@ -231,7 +265,14 @@ func apiRecordsReadHandler(w http.ResponseWriter, r *http.Request) {
 
 // PUT /api/records/:key
 func apiRecordsUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	var data Record
+	// Only the pause state and comment can be changed, the rest of the record
+	// (such as its source and $important flag) is kept
+	var data struct {
+		Paused      bool       `json:"paused"`
+		PausedUntil *time.Time `json:"pausedUntil,omitempty"`
+		Comment     *string    `json:"comment,omitempty"`
+		For         string     `json:"for,omitempty"` // e.g. "5m", resuming automatically
+	}
 
 	key := chi.URLParam(r, "key")
 	if !isValidDomainName(key) {
@@ -246,14 +287,49 @@ func apiRecordsUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if data.For != "" {
+		until, err := pauseUntil(data.For)
+		if err != nil {
+			http.Error(w, http.StatusText(422), 422)
+			return
+		}
+
+		data.Paused, data.PausedUntil = true, until
+	} else if !data.Paused {
+		data.PausedUntil = nil
+	}
+
+	// Start from an existing record
+	rec, err := db.get(key)
+	if err == errRecordNotFound {
+		rec = &Record{}
+	} else if err != nil {
+		log.Printf("db.get(%s) Error: %s\n", key, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	rec.Paused, rec.PausedUntil = data.Paused, data.PausedUntil
+	if data.Comment != nil {
+		rec.Comment = *data.Comment
+	}
+
 	// Save
-	if err := db.put(key, &data); err != nil {
+	if err := db.put(key, rec); err != nil {
 		log.Printf("db.put(%s) Error: %s\n", key, err)
 		http.Error(w, http.StatusText(500), 500)
 		return
 	}
 
-	render.JSON(w, r, H{"data": H{key: data}})
+	// Respond with the stored record (including its timestamps)
+	rec, err = db.get(key)
+	if err != nil {
+		log.Printf("db.get(%s) Error: %s\n", key, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	render.JSON(w, r, H{"data": H{key: rec}})
 }
 
 // DELETE /api/records/:key
@@ -270,12 +346,26 @@ func apiRecordsDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	render.NoContent(w, r)
 }
 
+// GET /api/settings/
+func apiSettingsReadHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, H{"data": currentSettings()})
+}
+
 // PUT /api/settings/
 func apiSettingsUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var d time.Duration
 	var data struct {
-		Disabled bool `json:"disabled"`
+		Settings
+		Disabled *bool  `json:"disabled,omitempty"` // Nil if omitted
+		For      string `json:"for,omitempty"`      // e.g. "15m", re-enabling automatically
 	}
 
+	// Start with the current settings, so that omitted fields are unchanged
+	cur := currentSettings()
+	data.Settings = cur
+	data.Upstreams = append([]string(nil), cur.Upstreams...) // Don't decode into cur's
+	data.Forwards = nil                                      // Maps are decoded into, so replace rather than merge
+
 	// Bind
 	if err := render.Bind(r.Body, &data); err != nil {
 		log.Printf("render.Bind() Error: %s\n", err)
@@ -283,47 +373,888 @@ func apiSettingsUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update disabled toggle
-	isDisabledMu.Lock()
-	isDisabled = data.Disabled
-	isDisabledMu.Unlock()
+	isUpstreamsChange := data.Strategy != cur.Strategy || strings.Join(data.Upstreams, ",") != strings.Join(cur.Upstreams, ",")
+	if !isUsableBlockMode(data.BlockMode) || !isValidStrategy(data.Strategy) || (isUpstreamsChange && len(data.Upstreams) == 0) {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	if data.For != "" {
+		var err error
+		if d, err = time.ParseDuration(data.For); err != nil || d <= 0 {
+			http.Error(w, http.StatusText(422), 422)
+			return
+		}
+	}
+
+	var u settingsUpdate
 
-	render.JSON(w, r, H{"data": data})
+	// Compile the conditional forwarding rules, if passed
+	if data.Forwards != nil {
+		var err error
+		if u.forwards, err = newForwardSet(data.Forwards); err != nil {
+			render.Status(r, 422)
+			render.JSON(w, r, H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Compile the upstream servers, if changed
+	if isUpstreamsChange {
+		var err error
+		if u.upstreams, err = newUpstreamPool(data.Upstreams, data.Strategy); err != nil {
+			u.close()
+			render.Status(r, 422)
+			render.JSON(w, r, H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Disabled toggle (an explicit disable or enable replaces any timed
+	// disable)
+	if data.Disabled != nil || d > 0 {
+		disabled := cur.Disabled
+		if data.Disabled != nil {
+			disabled = *data.Disabled
+		}
+
+		ds := newDisabledSetting(disabled, d)
+		u.disabled = &ds
+	}
+
+	if data.BlockMode != cur.BlockMode {
+		u.blockMode = data.BlockMode
+	}
+
+	// Update the settings (all at once, so that a failed update changes
+	// nothing)
+	if err := updateSettings(u); err != nil {
+		log.Printf("updateSettings() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	render.JSON(w, r, H{"data": currentSettings()})
 }
 
-// GET /css/nogo.css
-func cssHandler(w http.ResponseWriter, r *http.Request) {
-	var data = []byte(nogoCSS)
+// GET /allowlist/
+func allowlistIndexHandler(w http.ResponseWriter, r *http.Request) {
+	totalCount, err := db.keyCount()
+	if err != nil {
+		log.Printf("db.keyCount() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
 
-	w.Header().Set("Cache-Control", "public, max-age=31536000")
-	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
-	w.Header().Set("Content-Type", "text/css")
+	tmpl, err := template.New("index").Parse(indexTmpl)
+	if err != nil {
+		log.Printf("template.ParseFiles() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
 
-	w.Write(data)
+	disabled, until := disabledState()
+	if err = tmpl.Execute(w, H{"allowlist": db.getAllowlist(), "isAllowlist": true, "isDisabled": disabled, "disabledUntil": until, "totalCount": totalCount}); err != nil {
+		log.Printf("tmpl.Execute() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+	}
 }
 
-// isValidDomainName runs a few (intentionally liberal) checks on the passed
-// string to see if it looks like a valid (non-local) domain name.
-func isValidDomainName(d string) bool {
-	// Reject localhost.localdomain
-	if d == "localhost.localdomain" {
-		return false
+// POST /allowlist/
+func allowlistCreateHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	if !isValidDomainName(key) {
+		http.Error(w, http.StatusText(422), 422)
+		return
 	}
 
-	// Run the dns package's check (extremely liberal)
-	if _, ok := dns.IsDomainName(d); !ok {
-		return false
+	// Save
+	if err := db.allow(key); err != nil {
+		log.Printf("db.allow(%s) Error: %s\n", key, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
 	}
 
-	// Check for a valid length
-	if len(d) < 4 || len(d) > 255 {
-		return false
+	// Redirect to allowlist view
+	http.Redirect(w, r, "/allowlist/", 302)
+}
+
+// GET /api/allowlist/
+func apiAllowlistIndexHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, H{"data": db.getAllowlist()})
+}
+
+// GET /api/allowlist/:key
+func apiAllowlistReadHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.ToLower(chi.URLParam(r, "key"))
+
+	if !db.isAllowlisted(key) {
+		http.Error(w, http.StatusText(404), 404)
+		return
 	}
 
-	// Check that it has a dot, and the dot is reasonably positioned
-	if i := strings.IndexByte(d, '.'); i < 1 || i >= len(d)-2 {
-		return false
+	render.JSON(w, r, H{"data": key})
+}
+
+// PUT /api/allowlist/:key
+func apiAllowlistUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.ToLower(chi.URLParam(r, "key"))
+	if !isValidDomainName(key) {
+		http.Error(w, http.StatusText(422), 422)
+		return
 	}
 
-	return true
+	// Save
+	if err := db.allow(key); err != nil {
+		log.Printf("db.allow(%s) Error: %s\n", key, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	render.JSON(w, r, H{"data": key})
+}
+
+// DELETE /api/allowlist/:key
+func apiAllowlistDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+
+	// Delete
+	if err := db.disallow(key); err != nil {
+		log.Printf("db.disallow(%s) Error: %s\n", key, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// GET /subscriptions/
+func subscriptionsIndexHandler(w http.ResponseWriter, r *http.Request) {
+	totalCount, err := db.keyCount()
+	if err != nil {
+		log.Printf("db.keyCount() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	tmpl, err := template.New("index").Parse(indexTmpl)
+	if err != nil {
+		log.Printf("template.ParseFiles() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	disabled, until := disabledState()
+	if err = tmpl.Execute(w, H{"subscriptions": db.getSubscriptions(), "isSubscriptions": true, "isDisabled": disabled, "disabledUntil": until, "totalCount": totalCount}); err != nil {
+		log.Printf("tmpl.Execute() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+	}
+}
+
+// POST /subscriptions/
+func subscriptionsCreateHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	sub := &Subscription{URL: r.FormValue("url"), Format: r.FormValue("format"), Enabled: true}
+	if !isValidSubscriptionName(name) || !sub.isValid() {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	if _, err := db.getSubscription(name); err == nil {
+		http.Error(w, http.StatusText(409), 409)
+		return
+	}
+
+	// Save
+	if err := db.putSubscription(name, sub); err != nil {
+		log.Printf("db.putSubscription(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// Fetch the list right away (errors are shown in the subscriptions view)
+	if _, err := refreshSubscription(name); err != nil {
+		log.Printf("refreshSubscription(%s) Error: %s\n", name, err)
+	}
+
+	// Redirect to subscriptions view
+	http.Redirect(w, r, "/subscriptions/", 302)
+}
+
+// GET /api/subscriptions/
+func apiSubscriptionsIndexHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, H{"data": db.getSubscriptions()})
+}
+
+// GET /api/subscriptions/:name
+func apiSubscriptionsReadHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	sub, err := db.getSubscription(name)
+	if err == errSubscriptionNotFound {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	} else if err != nil {
+		log.Printf("db.getSubscription(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	render.JSON(w, r, H{"data": H{name: sub}})
+}
+
+// PUT /api/subscriptions/:name
+func apiSubscriptionsUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		URL      string `json:"url"`
+		Format   string `json:"format"`
+		Enabled  bool   `json:"enabled"`
+		Interval string `json:"interval"`
+	}
+
+	name := chi.URLParam(r, "name")
+	if !isValidSubscriptionName(name) {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	sub, err := db.getSubscription(name)
+	if err == errSubscriptionNotFound {
+		sub = &Subscription{Enabled: true}
+	} else if err != nil {
+		log.Printf("db.getSubscription(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// Start with the current subscription, so that omitted fields are unchanged
+	data.URL, data.Format, data.Enabled, data.Interval = sub.URL, sub.Format, sub.Enabled, sub.Interval
+
+	// Bind
+	if err := render.Bind(r.Body, &data); err != nil && err != io.EOF {
+		log.Printf("render.Bind() Error: %s\n", err)
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	if data.URL != sub.URL {
+		// Fetch the new URL unconditionally (and on the next check)
+		sub.ETag, sub.LastModified, sub.LastUpdated = "", "", time.Time{}
+	}
+	sub.URL, sub.Format, sub.Enabled, sub.Interval = data.URL, data.Format, data.Enabled, data.Interval
+
+	if !sub.isValid() {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	// Save
+	if err := db.putSubscription(name, sub); err != nil {
+		log.Printf("db.putSubscription(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	render.JSON(w, r, H{"data": H{name: sub}})
+}
+
+// DELETE /api/subscriptions/:name
+func apiSubscriptionsDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	// Delete (along with its records)
+	if err := db.deleteSubscription(name); err != nil {
+		log.Printf("db.deleteSubscription(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// POST /api/subscriptions/:name/refresh
+func apiSubscriptionsRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	sub, err := refreshSubscription(name)
+	if err == errSubscriptionNotFound {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	} else if sub == nil {
+		log.Printf("refreshSubscription(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	} else if err != nil {
+		// The list couldn't be fetched
+		log.Printf("refreshSubscription(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(502), 502)
+		return
+	}
+
+	render.JSON(w, r, H{"data": H{name: sub}})
+}
+
+// GET /groups/
+func groupsIndexHandler(w http.ResponseWriter, r *http.Request) {
+	totalCount, err := db.keyCount()
+	if err != nil {
+		log.Printf("db.keyCount() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	tmpl, err := template.New("index").Parse(indexTmpl)
+	if err != nil {
+		log.Printf("template.ParseFiles() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	disabled, until := disabledState()
+	if err = tmpl.Execute(w, H{"groups": db.getGroups(), "blockModes": blockModes, "isGroups": true, "isDisabled": disabled, "disabledUntil": until, "totalCount": totalCount}); err != nil {
+		log.Printf("tmpl.Execute() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+	}
+}
+
+// POST /groups/
+func groupsCreateHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	g := &Group{
+		Clients:     splitList(r.FormValue("clients")),
+		Sources:     splitList(r.FormValue("sources")),
+		NoAllowlist: r.FormValue("noAllowlist") == "1",
+		BlockMode:   r.FormValue("blockMode"),
+	}
+	if !isValidName(name) || !g.isValid() {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	if _, err := db.getGroup(name); err == nil {
+		http.Error(w, http.StatusText(409), 409)
+		return
+	}
+
+	// Save
+	if err := db.putGroup(name, g); err != nil {
+		log.Printf("db.putGroup(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	groupSet.load()
+
+	// Redirect to groups view
+	http.Redirect(w, r, "/groups/", 302)
+}
+
+// GET /api/groups/
+func apiGroupsIndexHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, H{"data": db.getGroups()})
+}
+
+// GET /api/groups/:name
+func apiGroupsReadHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	g, err := db.getGroup(name)
+	if err == errGroupNotFound {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	} else if err != nil {
+		log.Printf("db.getGroup(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	render.JSON(w, r, H{"data": H{name: g}})
+}
+
+// PUT /api/groups/:name
+func apiGroupsUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var g Group
+
+	name := chi.URLParam(r, "name")
+	if !isValidName(name) {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	// Bind
+	if err := render.Bind(r.Body, &g); err != nil && err != io.EOF {
+		log.Printf("render.Bind() Error: %s\n", err)
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	if !g.isValid() {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	// Save
+	if err := db.putGroup(name, &g); err != nil {
+		log.Printf("db.putGroup(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	groupSet.load()
+
+	render.JSON(w, r, H{"data": H{name: g}})
+}
+
+// DELETE /api/groups/:name
+func apiGroupsDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	// Delete
+	if err := db.deleteGroup(name); err != nil {
+		log.Printf("db.deleteGroup(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	groupSet.load()
+
+	render.NoContent(w, r)
+}
+
+// GET /api/ipblacklist/
+func apiIPBlacklistIndexHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, H{"data": db.getIPBlacklist()})
+}
+
+// GET /api/ipblacklist/*
+func apiIPBlacklistReadHandler(w http.ResponseWriter, r *http.Request) {
+	key := parseIPRange(chi.URLParam(r, "*"))
+
+	if key == "" || !db.isIPBlacklisted(key) {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	render.JSON(w, r, H{"data": key})
+}
+
+// PUT /api/ipblacklist/*
+func apiIPBlacklistUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	key := parseIPRange(chi.URLParam(r, "*"))
+	if key == "" {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	// Save
+	if err := db.blockIP(key); err != nil {
+		log.Printf("db.blockIP(%s) Error: %s\n", key, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	ipBlacklist.load()
+
+	render.JSON(w, r, H{"data": key})
+}
+
+// DELETE /api/ipblacklist/*
+func apiIPBlacklistDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	key := parseIPRange(chi.URLParam(r, "*"))
+
+	// Delete
+	if err := db.unblockIP(key); err != nil {
+		log.Printf("db.unblockIP(%s) Error: %s\n", key, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	ipBlacklist.load()
+
+	render.NoContent(w, r)
+}
+
+// GET /localrecords/
+func localRecordsIndexHandler(w http.ResponseWriter, r *http.Request) {
+	totalCount, err := db.keyCount()
+	if err != nil {
+		log.Printf("db.keyCount() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	tmpl, err := template.New("index").Parse(indexTmpl)
+	if err != nil {
+		log.Printf("template.ParseFiles() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	disabled, until := disabledState()
+	if err = tmpl.Execute(w, H{"localRecords": db.getAllLocalRecords(), "localRecordTypes": localRecordTypes, "isLocalRecords": true, "isDisabled": disabled, "disabledUntil": until, "totalCount": totalCount}); err != nil {
+		log.Printf("tmpl.Execute() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+	}
+}
+
+// POST /localrecords/
+func localRecordsCreateHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(strings.TrimSuffix(r.FormValue("name"), "."))
+	lr := LocalRecord{Type: strings.ToUpper(r.FormValue("type")), Value: strings.TrimSpace(r.FormValue("value"))}
+	if !isValidLocalName(name) || !lr.isValid() {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	// Save
+	if err := db.addLocalRecords(name, lr); err != nil {
+		log.Printf("db.addLocalRecords(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// Redirect to local records view
+	http.Redirect(w, r, "/localrecords/", 302)
+}
+
+// GET /api/localrecords/
+func apiLocalRecordsIndexHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, H{"data": db.getAllLocalRecords()})
+}
+
+// GET /api/localrecords/:name
+func apiLocalRecordsReadHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(strings.TrimSuffix(chi.URLParam(r, "name"), "."))
+
+	lrs, err := db.getLocalRecords(name)
+	if err == errLocalRecordNotFound {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	} else if err != nil {
+		log.Printf("db.getLocalRecords(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	render.JSON(w, r, H{"data": H{name: lrs}})
+}
+
+// PUT /api/localrecords/:name
+func apiLocalRecordsUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var lrs []LocalRecord
+
+	name := strings.ToLower(strings.TrimSuffix(chi.URLParam(r, "name"), "."))
+	if !isValidLocalName(name) {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	// Bind
+	if err := render.Bind(r.Body, &lrs); err != nil && err != io.EOF {
+		log.Printf("render.Bind() Error: %s\n", err)
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	if len(lrs) == 0 {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	for i := range lrs {
+		lrs[i].Type = strings.ToUpper(lrs[i].Type)
+		if !lrs[i].isValid() {
+			http.Error(w, http.StatusText(422), 422)
+			return
+		}
+	}
+
+	// Save
+	if err := db.putLocalRecords(name, lrs); err != nil {
+		log.Printf("db.putLocalRecords(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	render.JSON(w, r, H{"data": H{name: lrs}})
+}
+
+// DELETE /api/localrecords/:name
+func apiLocalRecordsDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(strings.TrimSuffix(chi.URLParam(r, "name"), "."))
+
+	// Delete
+	if err := db.deleteLocalRecords(name); err != nil {
+		log.Printf("db.deleteLocalRecords(%s) Error: %s\n", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// GET /api/rules/
+func apiRulesIndexHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, H{"data": ruleSet.list()})
+}
+
+// POST /api/rules/
+func apiRulesCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var data Rule
+
+	// Bind
+	if err := render.Bind(r.Body, &data); err != nil && err != io.EOF {
+		log.Printf("render.Bind() Error: %s\n", err)
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	re, err := compileRule(data.Pattern)
+	if err != nil {
+		render.Status(r, 422)
+		render.JSON(w, r, H{"error": err.Error()})
+		return
+	}
+
+	// Save (with fresh counters)
+	rule := &Rule{Pattern: data.Pattern}
+	if err := db.putRule(rule); err != nil {
+		log.Printf("db.putRule(%s) Error: %s\n", data.Pattern, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	ruleSet.add(rule, re)
+
+	render.Status(r, 201)
+	render.JSON(w, r, H{"data": rule})
+}
+
+// GET /api/rules/:id
+func apiRulesReadHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	data, err := ruleSet.get(id)
+	if err != nil {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	render.JSON(w, r, H{"data": data})
+}
+
+// DELETE /api/rules/:id
+func apiRulesDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	// Delete
+	if err := db.deleteRule(id); err != nil {
+		log.Printf("db.deleteRule(%d) Error: %s\n", id, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	ruleSet.remove(id)
+
+	render.NoContent(w, r)
+}
+
+// GET /querylog/
+func queryLogIndexHandler(w http.ResponseWriter, r *http.Request) {
+	f := QueryLogFilter{Client: r.FormValue("client"), Name: r.FormValue("name"), Decision: r.FormValue("decision")}
+
+	data, err := queryLog.search(f, defaultQueryLogLimit)
+	if err != nil {
+		log.Printf("queryLog.search() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	totalCount, err := db.keyCount()
+	if err != nil {
+		log.Printf("db.keyCount() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	tmpl, err := template.New("index").Parse(indexTmpl)
+	if err != nil {
+		log.Printf("template.ParseFiles() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	disabled, until := disabledState()
+	if err = tmpl.Execute(w, H{"querylog": data, "isQueryLog": true, "filter": f, "decisions": queryDecisions, "isDisabled": disabled, "disabledUntil": until, "totalCount": totalCount}); err != nil {
+		log.Printf("tmpl.Execute() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+	}
+}
+
+// GET /api/querylog
+func apiQueryLogIndexHandler(w http.ResponseWriter, r *http.Request) {
+	f := QueryLogFilter{Client: r.FormValue("client"), Name: r.FormValue("name"), Decision: r.FormValue("decision")}
+
+	limit := defaultQueryLogLimit
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxQueryLogLimit {
+			http.Error(w, http.StatusText(422), 422)
+			return
+		}
+	}
+
+	data, err := queryLog.search(f, limit)
+	if err != nil {
+		log.Printf("queryLog.search() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	render.JSON(w, r, H{"data": data})
+}
+
+// GET /api/stats
+func apiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	period := r.FormValue("period")
+	if period == "" {
+		period = statsPeriodDay
+	} else if !isValidStatsPeriod(period) {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	render.JSON(w, r, H{"data": queryStats.summary(period, time.Now())})
+}
+
+// GET /api/upstreams/
+func apiUpstreamsIndexHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, H{"data": currentUpstreams().status()})
+}
+
+// GET /api/cache/
+func apiCacheReadHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, H{"data": dnsCache.stats()})
+}
+
+// DELETE /api/cache/
+func apiCacheDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	dnsCache.flush()
+
+	render.NoContent(w, r)
+}
+
+// GET /metrics (Prometheus)
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	if err := writeMetrics(&buf); err != nil {
+		log.Printf("writeMetrics() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", metricsContentType)
+	buf.WriteTo(w)
+}
+
+// GET /dns-query and POST /dns-query (DNS over HTTPS, RFC 8484)
+func dohHandler(w http.ResponseWriter, r *http.Request) {
+	var buf []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, http.StatusText(415), 415)
+			return
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+	if err != nil || len(buf) == 0 {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err = req.Unpack(buf); err != nil || len(req.Question) == 0 {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	m := resolve(req, clientIP(r.RemoteAddr))
+	out, err := m.Pack()
+	if err != nil {
+		log.Printf("m.Pack() Error: %s\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// Allow HTTP caching for as long as the response is valid (RFC 8484 section 5.1)
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(minTTL(m)), 10))
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+
+	w.Write(out)
+}
+
+// GET /css/nogo.css
+func cssHandler(w http.ResponseWriter, r *http.Request) {
+	var data = []byte(nogoCSS)
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Content-Type", "text/css")
+
+	w.Write(data)
+}
+
+// isValidDomainName runs a few (intentionally liberal) checks on the passed
+// string to see if it looks like a valid (non-local) domain name.
+func isValidDomainName(d string) bool {
+	// Reject localhost.localdomain
+	if d == "localhost.localdomain" {
+		return false
+	}
+
+	// Run the dns package's check (extremely liberal)
+	if _, ok := dns.IsDomainName(d); !ok {
+		return false
+	}
+
+	// Check for a valid length
+	if len(d) < 4 || len(d) > 255 {
+		return false
+	}
+
+	// Check that it has a dot, and the dot is reasonably positioned
+	if i := strings.IndexByte(d, '.'); i < 1 || i >= len(d)-2 {
+		return false
+	}
+
+	return true
+}
+
+// pauseUntil returns when a pause for the passed duration (e.g. "5m") expires,
+// or nil if no duration was passed (pausing indefinitely).
+func pauseUntil(d string) (*time.Time, error) {
+	if d == "" {
+		return nil, nil
+	}
+
+	dur, err := time.ParseDuration(d)
+	if err != nil {
+		return nil, err
+	} else if dur <= 0 {
+		return nil, fmt.Errorf("invalid pause duration: %s", d)
+	}
+
+	until := time.Now().Add(dur).UTC().Truncate(time.Second)
+	return &until, nil
 }
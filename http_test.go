@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/miekg/dns"
 	"github.com/pressly/chi"
 )
 
@@ -71,7 +76,7 @@ func Test_rootIndexHandler(t *testing.T) {
 	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
 	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "text/html; charset=utf-8")
 	testEqual(t, "Body contains 'Found 1 of 1 total records' = %+v, want %+v", strings.Contains(w.Body.String(), "Found <span id=\"data-count\">1</span> of <span id=\"total-count\">1</span> total records"), true)
-	testEqual(t, "Body contains 'test.test' = %+v, want %+v", strings.Contains(w.Body.String(), "<div class=\"column key\">test.test</div>"), true)
+	testEqual(t, "Body contains 'test.test' = %+v, want %+v", strings.Contains(w.Body.String(), "<div class=\"column key\">test.test\n"), true)
 
 	// List paused records
 	r = httptest.NewRequest("GET", "/?p=1", nil)
@@ -80,7 +85,7 @@ func Test_rootIndexHandler(t *testing.T) {
 	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
 	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "text/html; charset=utf-8")
 	testEqual(t, "Body contains '1 of 1 total records' = %+v, want %+v", strings.Contains(w.Body.String(), "<span id=\"data-count\">1</span> of <span id=\"total-count\">1</span> total records"), true)
-	testEqual(t, "Body contains 'test.test' = %+v, want %+v", strings.Contains(w.Body.String(), "<div class=\"column key\">test.test</div>"), true)
+	testEqual(t, "Body contains 'test.test' = %+v, want %+v", strings.Contains(w.Body.String(), "<div class=\"column key\">test.test\n"), true)
 }
 
 func Test_recordsCreateHandler(t *testing.T) {
@@ -108,7 +113,47 @@ func Test_recordsCreateHandler(t *testing.T) {
 	testEqual(t, "Location header = %+v, want %+v", w.Header().Get("Location"), "/records/test.test")
 	// verify record created in db
 	rec, _ := db.get("test.test")
-	testEqual(t, "get() = %+v, want %+v", *rec, Record{Paused: true})
+	testEqual(t, "get() = %+v, want %+v", *rec, stamped(Record{Paused: true}))
+
+	// Invalid pause duration
+	r = &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/records/"},
+		Form:   url.Values{"key": {"test.test"}, "paused": {"1"}, "for": {"-5m"}},
+	}
+	w = httptest.NewRecorder()
+	recordsCreateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+
+	// Timed pause
+	r = &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/records/"},
+		Form:   url.Values{"key": {"test.test"}, "paused": {"1"}, "for": {"5m"}},
+	}
+	w = httptest.NewRecorder()
+	recordsCreateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 302)
+	rec, _ = db.get("test.test")
+	testEqual(t, "get().PausedUntil != nil = %+v, want %+v", rec.PausedUntil != nil, true)
+	testEqual(t, "get().PausedUntil within 5m = %+v, want %+v", time.Until(*rec.PausedUntil) > 4*time.Minute && time.Until(*rec.PausedUntil) <= 5*time.Minute, true)
+
+	// Pausing and resuming keeps the rest of the record
+	if err := db.put("important.test", &Record{Important: true, Source: "test"}); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+	for _, form := range []url.Values{{"key": {"important.test"}, "paused": {"1"}}, {"key": {"important.test"}}} {
+		r = &http.Request{
+			Method: "POST",
+			URL:    &url.URL{Path: "/records/"},
+			Form:   form,
+		}
+		w = httptest.NewRecorder()
+		recordsCreateHandler(w, r)
+		testEqual(t, "Response code = %+v, want %+v", w.Code, 302)
+	}
+	rec, _ = db.get("important.test")
+	testEqual(t, "get() = %+v, want %+v", *rec, stamped(Record{Important: true, Source: "test"}))
 }
 
 func Test_recordsReadHandler(t *testing.T) {
@@ -136,7 +181,7 @@ func Test_recordsReadHandler(t *testing.T) {
 	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
 	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "text/html; charset=utf-8")
 	testEqual(t, "Body contains '1 of 1 total records' = %+v, want %+v", strings.Contains(w.Body.String(), "<span id=\"data-count\">1</span> of <span id=\"total-count\">1</span> total records"), true)
-	testEqual(t, "Body contains 'test.test' = %+v, want %+v", strings.Contains(w.Body.String(), "<div class=\"column key\">test.test</div>"), true)
+	testEqual(t, "Body contains 'test.test' = %+v, want %+v", strings.Contains(w.Body.String(), "<div class=\"column key\">test.test\n"), true)
 }
 
 func Test_exportHostsHandler(t *testing.T) {
@@ -177,7 +222,7 @@ func Test_apiRecordsIndexHandler(t *testing.T) {
 	apiRecordsIndexHandler(w, r)
 	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
 	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
-	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"test.test\":{\"paused\":true}}}\n")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"test.test\":{\"paused\":true"+testStamps+"}}}\n")
 
 	// List paused records
 	r = httptest.NewRequest("GET", "/api/records/?p=1", nil)
@@ -185,7 +230,7 @@ func Test_apiRecordsIndexHandler(t *testing.T) {
 	apiRecordsIndexHandler(w, r)
 	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
 	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
-	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"test.test\":{\"paused\":true}}}\n")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"test.test\":{\"paused\":true"+testStamps+"}}}\n")
 }
 
 func Test_apiRecordsReadHandler(t *testing.T) {
@@ -212,7 +257,7 @@ func Test_apiRecordsReadHandler(t *testing.T) {
 	apiRecordsReadHandler(w, r)
 	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
 	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
-	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"test.test\":{\"paused\":true}}}\n")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"test.test\":{\"paused\":true"+testStamps+"}}}\n")
 }
 
 func Test_apiRecordsUpdateHandler(t *testing.T) {
@@ -236,10 +281,10 @@ func Test_apiRecordsUpdateHandler(t *testing.T) {
 	apiRecordsUpdateHandler(w, r)
 	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
 	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
-	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"unpaused.test\":{\"paused\":false}}}\n")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"unpaused.test\":{\"paused\":false"+testStamps+"}}}\n")
 	// verify record created in db
 	rec, _ := db.get("unpaused.test")
-	testEqual(t, "get() = %+v, want %+v", *rec, Record{Paused: false})
+	testEqual(t, "get() = %+v, want %+v", *rec, stamped(Record{Paused: false}))
 
 	// Create paused
 	r = httptest.NewRequest("PUT", "/api/records/paused.test", strings.NewReader("{\"paused\":true}"))
@@ -250,10 +295,10 @@ func Test_apiRecordsUpdateHandler(t *testing.T) {
 	apiRecordsUpdateHandler(w, r)
 	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
 	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
-	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"paused.test\":{\"paused\":true}}}\n")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"paused.test\":{\"paused\":true"+testStamps+"}}}\n")
 	// verify record created in db
 	rec, _ = db.get("paused.test")
-	testEqual(t, "get() = %+v, want %+v", *rec, Record{Paused: true})
+	testEqual(t, "get() = %+v, want %+v", *rec, stamped(Record{Paused: true}))
 
 	// Update
 	r = httptest.NewRequest("PUT", "/api/records/unpaused.test", strings.NewReader("{\"paused\":true}"))
@@ -263,10 +308,75 @@ func Test_apiRecordsUpdateHandler(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
 	apiRecordsUpdateHandler(w, r)
 	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
-	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"unpaused.test\":{\"paused\":true}}}\n")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"unpaused.test\":{\"paused\":true"+testStamps+"}}}\n")
 	// verify record updated in db
 	rec, _ = db.get("unpaused.test")
-	testEqual(t, "get() = %+v, want %+v", *rec, Record{Paused: true})
+	testEqual(t, "get() = %+v, want %+v", *rec, stamped(Record{Paused: true}))
+
+	// Update subscribed (keeps the source)
+	if err := db.put("subscribed.test", &Record{Source: "test"}); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+	r = httptest.NewRequest("PUT", "/api/records/subscribed.test", strings.NewReader("{\"paused\":true}"))
+	rctx = chi.NewRouteContext()
+	rctx.URLParams.Set("key", "subscribed.test")
+	w = httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiRecordsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	rec, _ = db.get("subscribed.test")
+	testEqual(t, "get() = %+v, want %+v", *rec, stamped(Record{Paused: true, Source: "test"}))
+
+	// Invalid pause duration
+	r = httptest.NewRequest("PUT", "/api/records/timed.test", strings.NewReader("{\"for\":\"soon\"}"))
+	rctx = chi.NewRouteContext()
+	rctx.URLParams.Set("key", "timed.test")
+	w = httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiRecordsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+
+	// Timed pause
+	r = httptest.NewRequest("PUT", "/api/records/timed.test", strings.NewReader("{\"paused\":true,\"for\":\"1h\"}"))
+	rctx = chi.NewRouteContext()
+	rctx.URLParams.Set("key", "timed.test")
+	w = httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiRecordsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	rec, _ = db.get("timed.test")
+	testEqual(t, "get().PausedUntil != nil = %+v, want %+v", rec.PausedUntil != nil, true)
+	until := *rec.PausedUntil
+	testEqual(t, "get().PausedUntil within 1h = %+v, want %+v", time.Until(until) > 59*time.Minute && time.Until(until) <= time.Hour, true)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"timed.test\":{\"paused\":true,\"pausedUntil\":\""+until.Format(time.RFC3339)+"\""+testStamps+"}}}\n")
+
+	// Resume (clears the expiry)
+	r = httptest.NewRequest("PUT", "/api/records/timed.test", strings.NewReader("{\"paused\":false}"))
+	rctx = chi.NewRouteContext()
+	rctx.URLParams.Set("key", "timed.test")
+	w = httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiRecordsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	rec, _ = db.get("timed.test")
+	testEqual(t, "get() = %+v, want %+v", *rec, stamped(Record{}))
+
+	// Pausing and resuming keeps the rest of the record (which the request
+	// can't change)
+	if err := db.put("important.test", &Record{Important: true, Source: "test", Comment: "tracker"}); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+	rctx = chi.NewRouteContext()
+	rctx.URLParams.Set("key", "important.test")
+	for _, body := range []string{"{\"paused\":true,\"important\":false,\"source\":\"\",\"hits\":5}", "{\"paused\":false}"} {
+		r = httptest.NewRequest("PUT", "/api/records/important.test", strings.NewReader(body))
+		w = httptest.NewRecorder()
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		apiRecordsUpdateHandler(w, r)
+		testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	}
+	rec, _ = db.get("important.test")
+	testEqual(t, "get() = %+v, want %+v", *rec, stamped(Record{Important: true, Source: "test", Comment: "tracker"}))
 }
 
 func Test_apiRecordsDeleteHandler(t *testing.T) {
@@ -287,6 +397,84 @@ func Test_apiRecordsDeleteHandler(t *testing.T) {
 	testEqual(t, "get() err = %+v, want %+v", err, errRecordNotFound)
 }
 
+func Test_apiSettingsReadHandler(t *testing.T) {
+	db.Reset()
+	upstreams = MustNewUpstreamPool([]string{"127.0.0.1:53", "tls://127.0.0.1:853#dns.test"}, strategyFastest)
+	defer func() { upstreams = &UpstreamPool{strategy: strategySequential} }()
+
+	r := httptest.NewRequest("GET", "/api/settings/", nil)
+	w := httptest.NewRecorder()
+	apiSettingsReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"disabled\":false,\"blockMode\":\"nxdomain\",\"upstreams\":[\"127.0.0.1:53\",\"tls://127.0.0.1:853#dns.test\"],\"strategy\":\"fastest\",\"forwards\":{}}}\n")
+}
+
+func Test_apiSettingsUpdateHandler_upstreams(t *testing.T) {
+	db.Reset()
+	upstreams = MustNewUpstreamPool([]string{"127.0.0.1:53"}, strategySequential)
+	defer func() { upstreams = &UpstreamPool{strategy: strategySequential} }()
+
+	// Invalid
+	for _, body := range []string{"{\"upstreams\":[]}", "{\"upstreams\":[\"127.0.0.1:53\"],\"strategy\":\"random\"}", "{\"upstreams\":[\"ftp://127.0.0.1\"]}"} {
+		r := httptest.NewRequest("PUT", "/api/settings/", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		apiSettingsUpdateHandler(w, r)
+		testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	}
+	testEqual(t, "addrs() = %+v, want %+v", currentUpstreams().addrs(), []string{"127.0.0.1:53"})
+
+	r := httptest.NewRequest("PUT", "/api/settings/", strings.NewReader("{\"upstreams\":[\"127.0.0.1:53\",\"127.0.0.2:53\"],\"strategy\":\"roundrobin\"}"))
+	w := httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"disabled\":false,\"blockMode\":\"nxdomain\",\"upstreams\":[\"127.0.0.1:53\",\"127.0.0.2:53\"],\"strategy\":\"roundrobin\",\"forwards\":{}}}\n")
+	testEqual(t, "addrs() = %+v, want %+v", currentUpstreams().addrs(), []string{"127.0.0.1:53", "127.0.0.2:53"})
+
+	var us upstreamsSetting
+	db.getSetting(settingUpstreams, &us)
+	testEqual(t, "getSetting() = %+v, want %+v", us, upstreamsSetting{Addrs: []string{"127.0.0.1:53", "127.0.0.2:53"}, Strategy: strategyRoundRobin})
+}
+
+func Test_apiSettingsUpdateHandler_forwards(t *testing.T) {
+	db.Reset()
+	defer func() { forwards = &ForwardSet{} }()
+
+	// Invalid
+	for _, body := range []string{"{\"forwards\":{\"corp.test\":[]}}", "{\"forwards\":{\"10.0.0.0/33\":[\"127.0.0.1:53\"]}}", "{\"forwards\":{\"corp.test\":[\"ftp://127.0.0.1\"]}}"} {
+		r := httptest.NewRequest("PUT", "/api/settings/", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		apiSettingsUpdateHandler(w, r)
+		testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	}
+
+	r := httptest.NewRequest("PUT", "/api/settings/", strings.NewReader("{\"forwards\":{\"corp.test\":[\"127.0.0.1:53\"],\"192.168.0.0/16\":[\"127.0.0.2:53\"]}}"))
+	w := httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"disabled\":false,\"blockMode\":\"nxdomain\",\"upstreams\":[],\"strategy\":\"sequential\",\"forwards\":{\"192.168.0.0/16\":[\"127.0.0.2:53\"],\"corp.test\":[\"127.0.0.1:53\"]}}}\n")
+
+	// Omitted rules are left alone, and passed ones replace (rather than add to) them
+	r = httptest.NewRequest("PUT", "/api/settings/", strings.NewReader("{\"blockMode\":\"nxdomain\"}"))
+	w = httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	testEqual(t, "list() = %+v, want %+v", len(currentForwards().list()), 2)
+
+	r = httptest.NewRequest("PUT", "/api/settings/", strings.NewReader("{\"forwards\":{\"lab.test\":[\"127.0.0.3:53\"]}}"))
+	w = httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	testEqual(t, "list() = %+v, want %+v", currentForwards().list(), map[string][]string{"lab.test": {"127.0.0.3:53"}})
+
+	// A failed update changes nothing
+	r = httptest.NewRequest("PUT", "/api/settings/", strings.NewReader("{\"forwards\":{\"corp.test\":[\"127.0.0.1:53\"]},\"blockMode\":\"null\",\"upstreams\":[\"ftp://127.0.0.1\"]}"))
+	w = httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	testEqual(t, "currentSettings() = %+v, want %+v", currentSettings(), Settings{BlockMode: blockModeNXDomain, Upstreams: []string{}, Strategy: strategySequential, Forwards: map[string][]string{"lab.test": {"127.0.0.3:53"}}})
+	var rules map[string][]string
+	db.getSetting(settingForwards, &rules)
+	testEqual(t, "getSetting() = %+v, want %+v", rules, map[string][]string{"lab.test": {"127.0.0.3:53"}})
+}
+
 func Test_apiSettingsUpdateHandler(t *testing.T) {
 	db.Reset()
 
@@ -296,7 +484,7 @@ func Test_apiSettingsUpdateHandler(t *testing.T) {
 	w := httptest.NewRecorder()
 	apiSettingsUpdateHandler(w, r)
 	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
-	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"disabled\":true}}\n")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"disabled\":true,\"blockMode\":\"nxdomain\",\"upstreams\":[],\"strategy\":\"sequential\",\"forwards\":{}}}\n")
 	testEqual(t, "isDisabled = %+v, want %+v", isDisabled, true)
 
 	// Enable
@@ -305,8 +493,928 @@ func Test_apiSettingsUpdateHandler(t *testing.T) {
 	w = httptest.NewRecorder()
 	apiSettingsUpdateHandler(w, r)
 	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
-	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"disabled\":false}}\n")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"disabled\":false,\"blockMode\":\"nxdomain\",\"upstreams\":[],\"strategy\":\"sequential\",\"forwards\":{}}}\n")
 	testEqual(t, "isDisabled = %+v, want %+v", isDisabled, false)
+
+	// Disable for a while
+	r = httptest.NewRequest("GET", "/api/settings/", strings.NewReader("{\"disabled\":true,\"for\":\"15m\"}"))
+	w = httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body contains disabledUntil = %+v, want %+v", strings.Contains(w.Body.String(), "{\"data\":{\"disabled\":true,\"disabledUntil\":\""), true)
+	_, until := disabledState()
+	testEqual(t, "disabledUntil in 15m = %+v, want %+v", until.Sub(time.Now()) > 14*time.Minute && until.Sub(time.Now()) <= 15*time.Minute, true)
+	r = httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	rootIndexHandler(w, r)
+	testEqual(t, "Body contains data-until = %+v, want %+v", strings.Contains(w.Body.String(), "data-until=\""+until.Format(time.RFC3339)+"\""), true)
+
+	// Other changes leave the timed disable alone
+	r = httptest.NewRequest("GET", "/api/settings/", strings.NewReader("{\"blockMode\":\"nxdomain\"}"))
+	w = httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	_, got := disabledState()
+	testEqual(t, "disabledUntil = %+v, want %+v", got, until)
+
+	// Disable indefinitely (cancelling the timer)
+	r = httptest.NewRequest("GET", "/api/settings/", strings.NewReader("{\"disabled\":true}"))
+	w = httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"disabled\":true,\"blockMode\":\"nxdomain\",\"upstreams\":[],\"strategy\":\"sequential\",\"forwards\":{}}}\n")
+	testEqual(t, "disableTimer = %+v, want %+v", disableTimer == nil, true)
+
+	// Invalid duration
+	r = httptest.NewRequest("GET", "/api/settings/", strings.NewReader("{\"disabled\":true,\"for\":\"-5m\"}"))
+	w = httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+
+	// Enable (cancelling the timer)
+	r = httptest.NewRequest("GET", "/api/settings/", strings.NewReader("{\"disabled\":false}"))
+	w = httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"disabled\":false,\"blockMode\":\"nxdomain\",\"upstreams\":[],\"strategy\":\"sequential\",\"forwards\":{}}}\n")
+
+	// Block mode
+	r = httptest.NewRequest("GET", "/api/settings/", strings.NewReader("{\"blockMode\":\"null\"}"))
+	w = httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"disabled\":false,\"blockMode\":\"null\",\"upstreams\":[],\"strategy\":\"sequential\",\"forwards\":{}}}\n")
+	testEqual(t, "blockMode = %+v, want %+v", blockMode, blockModeNull)
+
+	// Invalid block mode
+	r = httptest.NewRequest("GET", "/api/settings/", strings.NewReader("{\"blockMode\":\"invalid\"}"))
+	w = httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	testEqual(t, "blockMode = %+v, want %+v", blockMode, blockModeNull)
+
+	// Sinkhole without any sinkhole address
+	r = httptest.NewRequest("GET", "/api/settings/", strings.NewReader("{\"blockMode\":\"sinkhole\"}"))
+	w = httptest.NewRecorder()
+	apiSettingsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	testEqual(t, "blockMode = %+v, want %+v", blockMode, blockModeNull)
+	blockMode = blockModeNXDomain
+}
+
+func Test_allowlistIndexHandler(t *testing.T) {
+	db.Reset()
+	if err := db.allow("allowed.test"); err != nil {
+		t.Errorf("failed to allow: %+v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/allowlist/", nil)
+	w := httptest.NewRecorder()
+	allowlistIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "text/html; charset=utf-8")
+	testEqual(t, "Body contains '1 allowlisted domains' = %+v, want %+v", strings.Contains(w.Body.String(), "<span id=\"data-count\">1</span> allowlisted domains"), true)
+	testEqual(t, "Body contains 'allowed.test' = %+v, want %+v", strings.Contains(w.Body.String(), "<div class=\"column key\">allowed.test</div>"), true)
+	testEqual(t, "Body contains form action = %+v, want %+v", strings.Contains(w.Body.String(), "<form action=\"/allowlist/\" method=\"post\">"), true)
+}
+
+func Test_allowlistCreateHandler(t *testing.T) {
+	db.Reset()
+
+	// Invalid
+	r := &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/allowlist/"},
+		Form:   url.Values{"key": {"test"}},
+	}
+	w := httptest.NewRecorder()
+	allowlistCreateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+
+	// Valid
+	r = &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/allowlist/"},
+		Form:   url.Values{"key": {"allowed.test"}},
+	}
+	w = httptest.NewRecorder()
+	allowlistCreateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 302)
+	testEqual(t, "Location header = %+v, want %+v", w.Header().Get("Location"), "/allowlist/")
+	testEqual(t, "isAllowlisted() = %+v, want %+v", db.isAllowlisted("allowed.test"), true)
+}
+
+func Test_apiAllowlistIndexHandler(t *testing.T) {
+	db.Reset()
+	if err := db.allow("allowed.test"); err != nil {
+		t.Errorf("failed to allow: %+v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/allowlist/", nil)
+	w := httptest.NewRecorder()
+	apiAllowlistIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":[\"allowed.test\"]}\n")
+}
+
+func Test_apiAllowlistReadHandler(t *testing.T) {
+	db.Reset()
+
+	// Not allowlisted
+	r := httptest.NewRequest("GET", "/api/allowlist/allowed.test", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Set("key", "allowed.test")
+	w := httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiAllowlistReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 404)
+
+	// Allowlisted
+	if err := db.allow("allowed.test"); err != nil {
+		t.Errorf("failed to allow: %+v", err)
+	}
+	w = httptest.NewRecorder()
+	apiAllowlistReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":\"allowed.test\"}\n")
+}
+
+func Test_apiAllowlistUpdateHandler(t *testing.T) {
+	db.Reset()
+
+	// Invalid
+	r := httptest.NewRequest("PUT", "/api/allowlist/test", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Set("key", "test")
+	w := httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiAllowlistUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+
+	// Create
+	r = httptest.NewRequest("PUT", "/api/allowlist/Allowed.test", nil)
+	rctx = chi.NewRouteContext()
+	rctx.URLParams.Set("key", "Allowed.test")
+	w = httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiAllowlistUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":\"allowed.test\"}\n")
+	testEqual(t, "isAllowlisted() = %+v, want %+v", db.isAllowlisted("allowed.test"), true)
+}
+
+func Test_apiAllowlistDeleteHandler(t *testing.T) {
+	db.Reset()
+	if err := db.allow("allowed.test"); err != nil {
+		t.Errorf("failed to allow: %+v", err)
+	}
+
+	r := httptest.NewRequest("DELETE", "/api/allowlist/allowed.test", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Set("key", "allowed.test")
+	w := httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiAllowlistDeleteHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 204)
+	testEqual(t, "isAllowlisted() = %+v, want %+v", db.isAllowlisted("allowed.test"), false)
+}
+
+func Test_subscriptionsIndexHandler(t *testing.T) {
+	db.Reset()
+	if err := db.putSubscription("test", &Subscription{URL: "http://list.test/hosts", Format: subscriptionFormatHosts, Enabled: true, Interval: "24h", Count: 2}); err != nil {
+		t.Errorf("failed to putSubscription: %+v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/subscriptions/", nil)
+	w := httptest.NewRecorder()
+	subscriptionsIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "text/html; charset=utf-8")
+	testEqual(t, "Body contains '1 blocklist subscriptions' = %+v, want %+v", strings.Contains(w.Body.String(), "<span id=\"data-count\">1</span> blocklist subscriptions"), true)
+	testEqual(t, "Body contains 'test' = %+v, want %+v", strings.Contains(w.Body.String(), "test &middot; 2 records"), true)
+	testEqual(t, "Body contains form action = %+v, want %+v", strings.Contains(w.Body.String(), "<form action=\"/subscriptions/\" method=\"post\">"), true)
+}
+
+func Test_subscriptionsCreateHandler(t *testing.T) {
+	db.Reset()
+
+	ls := RunListServer("one.test\ntwo.test\n")
+	defer ls.Close()
+
+	// Invalid
+	for _, form := range []url.Values{
+		{"name": {"te st"}, "url": {ls.URL}},
+		{"name": {"test"}, "url": {"list.test"}},
+	} {
+		r := &http.Request{
+			Method: "POST",
+			URL:    &url.URL{Path: "/subscriptions/"},
+			Form:   form,
+		}
+		w := httptest.NewRecorder()
+		subscriptionsCreateHandler(w, r)
+		testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	}
+
+	// Valid (and fetched right away)
+	r := &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/subscriptions/"},
+		Form:   url.Values{"name": {"test"}, "url": {ls.URL}},
+	}
+	w := httptest.NewRecorder()
+	subscriptionsCreateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 302)
+	testEqual(t, "Location header = %+v, want %+v", w.Header().Get("Location"), "/subscriptions/")
+	c, _ := db.keyCount()
+	testEqual(t, "keyCount() = %+v, want %+v", c, 2)
+
+	// Existing
+	w = httptest.NewRecorder()
+	subscriptionsCreateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 409)
+}
+
+func Test_groupsIndexHandler(t *testing.T) {
+	db.Reset()
+	db.putGroup("kids", &Group{Clients: []string{"10.0.0.20"}, Sources: []string{"adult"}})
+
+	r := httptest.NewRequest("GET", "/groups/", nil)
+	w := httptest.NewRecorder()
+	groupsIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body contains '1 client groups' = %+v, want %+v", strings.Contains(w.Body.String(), "<span id=\"data-count\">1</span> client groups"), true)
+	testEqual(t, "Body contains 'kids' = %+v, want %+v", strings.Contains(w.Body.String(), "kids &middot; 10.0.0.20"), true)
+}
+
+func Test_groupsCreateHandler(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+
+	// Invalid
+	for _, form := range []url.Values{
+		{"name": {"ki ds"}, "clients": {"10.0.0.20"}},
+		{"name": {"kids"}, "clients": {"tablet"}},
+		{"name": {"kids"}, "clients": {""}},
+	} {
+		r := &http.Request{
+			Method: "POST",
+			URL:    &url.URL{Path: "/groups/"},
+			Form:   form,
+		}
+		w := httptest.NewRecorder()
+		groupsCreateHandler(w, r)
+		testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	}
+
+	// Valid
+	r := &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/groups/"},
+		Form:   url.Values{"name": {"kids"}, "clients": {"10.0.0.20, 10.0.1.0/24"}, "sources": {"adult,gambling"}, "blockMode": {blockModeNull}, "noAllowlist": {"1"}},
+	}
+	w := httptest.NewRecorder()
+	groupsCreateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 302)
+	testEqual(t, "Location header = %+v, want %+v", w.Header().Get("Location"), "/groups/")
+	g, _ := db.getGroup("kids")
+	testEqual(t, "getGroup() = %+v, want %+v", *g, Group{Clients: []string{"10.0.0.20", "10.0.1.0/24"}, Sources: []string{"adult", "gambling"}, NoAllowlist: true, BlockMode: blockModeNull})
+	name, _ := groupSet.match("10.0.1.5")
+	testEqual(t, "groupSet.match() = %+v, want %+v", name, "kids")
+
+	// Existing
+	w = httptest.NewRecorder()
+	groupsCreateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 409)
+}
+
+func Test_apiGroupsHandlers(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Set("name", "kids")
+
+	// Not found
+	r := httptest.NewRequest("GET", "/api/groups/kids", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+	apiGroupsReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 404)
+
+	// Invalid
+	for _, body := range []string{"{}", "{\"clients\":[\"10.0.0.20\"],\"blockMode\":\"drop\"}"} {
+		r = httptest.NewRequest("PUT", "/api/groups/kids", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		w = httptest.NewRecorder()
+		apiGroupsUpdateHandler(w, r)
+		testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	}
+
+	// Create
+	r = httptest.NewRequest("PUT", "/api/groups/kids", strings.NewReader("{\"clients\":[\"10.0.0.20\"],\"sources\":[\"adult\"]}"))
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w = httptest.NewRecorder()
+	apiGroupsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"kids\":{\"clients\":[\"10.0.0.20\"],\"sources\":[\"adult\"]}}}\n")
+	name, _ := groupSet.match("10.0.0.20")
+	testEqual(t, "groupSet.match() = %+v, want %+v", name, "kids")
+
+	// Read
+	r = httptest.NewRequest("GET", "/api/groups/kids", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w = httptest.NewRecorder()
+	apiGroupsReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"kids\":{\"clients\":[\"10.0.0.20\"],\"sources\":[\"adult\"]}}}\n")
+
+	// Index
+	r = httptest.NewRequest("GET", "/api/groups/", nil)
+	w = httptest.NewRecorder()
+	apiGroupsIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"kids\":{\"clients\":[\"10.0.0.20\"],\"sources\":[\"adult\"]}}}\n")
+
+	// Delete
+	r = httptest.NewRequest("DELETE", "/api/groups/kids", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w = httptest.NewRecorder()
+	apiGroupsDeleteHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 204)
+	testEqual(t, "len(getGroups()) = %+v, want %+v", len(db.getGroups()), 0)
+	name, _ = groupSet.match("10.0.0.20")
+	testEqual(t, "groupSet.match() = %+v, want %+v", name, "")
+}
+
+func Test_apiIPBlacklistHandlers(t *testing.T) {
+	db.Reset()
+	defer func() {
+		db.Reset()
+		ipBlacklist.load()
+	}()
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Set("*", "192.0.2.1/24")
+
+	// Not found
+	r := httptest.NewRequest("GET", "/api/ipblacklist/192.0.2.1/24", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+	apiIPBlacklistReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 404)
+
+	// Invalid
+	irctx := chi.NewRouteContext()
+	irctx.URLParams.Set("*", "ads.test")
+	r = httptest.NewRequest("PUT", "/api/ipblacklist/ads.test", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, irctx))
+	w = httptest.NewRecorder()
+	apiIPBlacklistUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+
+	// Create
+	r = httptest.NewRequest("PUT", "/api/ipblacklist/192.0.2.1/24", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w = httptest.NewRecorder()
+	apiIPBlacklistUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":\"192.0.2.0/24\"}\n")
+	testEqual(t, "ipBlacklist.match() = %+v, want %+v", ipBlacklist.match(net.ParseIP("192.0.2.5")), "192.0.2.0/24")
+
+	// Read
+	r = httptest.NewRequest("GET", "/api/ipblacklist/192.0.2.1/24", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w = httptest.NewRecorder()
+	apiIPBlacklistReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":\"192.0.2.0/24\"}\n")
+
+	// Index
+	r = httptest.NewRequest("GET", "/api/ipblacklist/", nil)
+	w = httptest.NewRecorder()
+	apiIPBlacklistIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":[\"192.0.2.0/24\"]}\n")
+
+	// Delete
+	r = httptest.NewRequest("DELETE", "/api/ipblacklist/192.0.2.1/24", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w = httptest.NewRecorder()
+	apiIPBlacklistDeleteHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 204)
+	testEqual(t, "ipBlacklist.match() = %+v, want %+v", ipBlacklist.match(net.ParseIP("192.0.2.5")), "")
+}
+
+func Test_localRecordsIndexHandler(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+	db.putLocalRecords("nas.lan", []LocalRecord{{Type: localRecordA, Value: "192.168.1.10"}})
+
+	r := httptest.NewRequest("GET", "/localrecords/", nil)
+	w := httptest.NewRecorder()
+	localRecordsIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body contains '1 local names' = %+v, want %+v", strings.Contains(w.Body.String(), "<span id=\"data-count\">1</span> local names"), true)
+	testEqual(t, "Body contains 'A 192.168.1.10' = %+v, want %+v", strings.Contains(w.Body.String(), "<small>A 192.168.1.10</small>"), true)
+}
+
+func Test_localRecordsCreateHandler(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+
+	// Invalid
+	for _, form := range []url.Values{
+		{"name": {"*.lan"}, "type": {"A"}, "value": {"192.168.1.10"}},
+		{"name": {"nas.lan"}, "type": {"A"}, "value": {"nas"}},
+		{"name": {"nas.lan"}, "type": {"MX"}, "value": {"mail.lan"}},
+	} {
+		r := &http.Request{
+			Method: "POST",
+			URL:    &url.URL{Path: "/localrecords/"},
+			Form:   form,
+		}
+		w := httptest.NewRecorder()
+		localRecordsCreateHandler(w, r)
+		testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	}
+
+	// Valid
+	for _, form := range []url.Values{
+		{"name": {"NAS.lan."}, "type": {"a"}, "value": {"192.168.1.10"}},
+		{"name": {"nas.lan"}, "type": {"AAAA"}, "value": {" fd00::10 "}},
+	} {
+		r := &http.Request{
+			Method: "POST",
+			URL:    &url.URL{Path: "/localrecords/"},
+			Form:   form,
+		}
+		w := httptest.NewRecorder()
+		localRecordsCreateHandler(w, r)
+		testEqual(t, "Response code = %+v, want %+v", w.Code, 302)
+		testEqual(t, "Location header = %+v, want %+v", w.Header().Get("Location"), "/localrecords/")
+	}
+	lrs, _ := db.getLocalRecords("nas.lan")
+	testEqual(t, "getLocalRecords() = %+v, want %+v", lrs, []LocalRecord{{Type: localRecordA, Value: "192.168.1.10"}, {Type: localRecordAAAA, Value: "fd00::10"}})
+}
+
+func Test_apiLocalRecordsHandlers(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Set("name", "nas.lan")
+
+	// Not found
+	r := httptest.NewRequest("GET", "/api/localrecords/nas.lan", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+	apiLocalRecordsReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 404)
+
+	// Invalid
+	for _, body := range []string{"[]", "[{\"type\":\"A\",\"value\":\"fd00::10\"}]", "[{\"type\":\"MX\",\"value\":\"mail.lan\"}]"} {
+		r = httptest.NewRequest("PUT", "/api/localrecords/nas.lan", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		w = httptest.NewRecorder()
+		apiLocalRecordsUpdateHandler(w, r)
+		testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	}
+
+	// Create
+	r = httptest.NewRequest("PUT", "/api/localrecords/nas.lan", strings.NewReader("[{\"type\":\"a\",\"value\":\"192.168.1.10\"},{\"type\":\"TXT\",\"value\":\"hello\",\"ttl\":60}]"))
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w = httptest.NewRecorder()
+	apiLocalRecordsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"nas.lan\":[{\"type\":\"A\",\"value\":\"192.168.1.10\"},{\"type\":\"TXT\",\"value\":\"hello\",\"ttl\":60}]}}\n")
+
+	// Read
+	r = httptest.NewRequest("GET", "/api/localrecords/nas.lan", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w = httptest.NewRecorder()
+	apiLocalRecordsReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"nas.lan\":[{\"type\":\"A\",\"value\":\"192.168.1.10\"},{\"type\":\"TXT\",\"value\":\"hello\",\"ttl\":60}]}}\n")
+
+	// Index
+	r = httptest.NewRequest("GET", "/api/localrecords/", nil)
+	w = httptest.NewRecorder()
+	apiLocalRecordsIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"nas.lan\":[{\"type\":\"A\",\"value\":\"192.168.1.10\"},{\"type\":\"TXT\",\"value\":\"hello\",\"ttl\":60}]}}\n")
+
+	// Delete
+	r = httptest.NewRequest("DELETE", "/api/localrecords/nas.lan", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w = httptest.NewRecorder()
+	apiLocalRecordsDeleteHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 204)
+	testEqual(t, "len(getAllLocalRecords()) = %+v, want %+v", len(db.getAllLocalRecords()), 0)
+}
+
+func Test_apiSubscriptionsIndexHandler(t *testing.T) {
+	db.Reset()
+	if err := db.putSubscription("test", &Subscription{URL: "http://list.test/hosts", Format: subscriptionFormatHosts, Enabled: true, Interval: "24h"}); err != nil {
+		t.Errorf("failed to putSubscription: %+v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/subscriptions/", nil)
+	w := httptest.NewRecorder()
+	apiSubscriptionsIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"test\":{\"url\":\"http://list.test/hosts\",\"format\":\"hosts\",\"enabled\":true,\"interval\":\"24h\",\"lastUpdated\":\"0001-01-01T00:00:00Z\",\"count\":0}}}\n")
+}
+
+func Test_apiSubscriptionsReadHandler(t *testing.T) {
+	db.Reset()
+
+	// Not found
+	r := httptest.NewRequest("GET", "/api/subscriptions/test", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Set("name", "test")
+	w := httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiSubscriptionsReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 404)
+
+	// Found
+	if err := db.putSubscription("test", &Subscription{URL: "http://list.test/hosts", Format: subscriptionFormatHosts, Interval: "24h"}); err != nil {
+		t.Errorf("failed to putSubscription: %+v", err)
+	}
+	w = httptest.NewRecorder()
+	apiSubscriptionsReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"test\":{\"url\":\"http://list.test/hosts\",\"format\":\"hosts\",\"enabled\":false,\"interval\":\"24h\",\"lastUpdated\":\"0001-01-01T00:00:00Z\",\"count\":0}}}\n")
+}
+
+func Test_apiSubscriptionsUpdateHandler(t *testing.T) {
+	db.Reset()
+
+	// Invalid
+	for _, body := range []string{"{}", "{\"url\":\"http://list.test/hosts\",\"interval\":\"daily\"}"} {
+		r := httptest.NewRequest("PUT", "/api/subscriptions/test", strings.NewReader(body))
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Set("name", "test")
+		w := httptest.NewRecorder()
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		apiSubscriptionsUpdateHandler(w, r)
+		testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	}
+
+	// Create
+	r := httptest.NewRequest("PUT", "/api/subscriptions/test", strings.NewReader("{\"url\":\"http://list.test/hosts\"}"))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Set("name", "test")
+	w := httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiSubscriptionsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	sub, _ := db.getSubscription("test")
+	testEqual(t, "getSubscription() = %+v, want %+v", *sub, Subscription{URL: "http://list.test/hosts", Format: subscriptionFormatHosts, Enabled: true, Interval: defaultSubscriptionInterval})
+
+	// Update (omitted fields are unchanged)
+	r = httptest.NewRequest("PUT", "/api/subscriptions/test", strings.NewReader("{\"enabled\":false,\"interval\":\"12h\"}"))
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w = httptest.NewRecorder()
+	apiSubscriptionsUpdateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	sub, _ = db.getSubscription("test")
+	testEqual(t, "getSubscription() = %+v, want %+v", *sub, Subscription{URL: "http://list.test/hosts", Format: subscriptionFormatHosts, Interval: "12h"})
+}
+
+func Test_apiSubscriptionsDeleteHandler(t *testing.T) {
+	db.Reset()
+	if err := db.putSubscription("test", &Subscription{URL: "http://list.test/hosts", Format: subscriptionFormatHosts, Interval: "24h"}); err != nil {
+		t.Errorf("failed to putSubscription: %+v", err)
+	}
+	if err := db.put("subscribed.test", &Record{Source: "test"}); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+
+	r := httptest.NewRequest("DELETE", "/api/subscriptions/test", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Set("name", "test")
+	w := httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiSubscriptionsDeleteHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 204)
+	_, err := db.getSubscription("test")
+	testEqual(t, "getSubscription() err = %+v, want %+v", err, errSubscriptionNotFound)
+	_, err = db.get("subscribed.test")
+	testEqual(t, "get() err = %+v, want %+v", err, errRecordNotFound)
+}
+
+func Test_apiSubscriptionsRefreshHandler(t *testing.T) {
+	db.Reset()
+
+	ls := RunListServer("one.test\n")
+	defer ls.Close()
+
+	// Not found
+	r := httptest.NewRequest("POST", "/api/subscriptions/test/refresh", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Set("name", "test")
+	w := httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiSubscriptionsRefreshHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 404)
+
+	// Refreshed
+	if err := db.putSubscription("test", &Subscription{URL: ls.URL, Format: subscriptionFormatHosts, Interval: "24h"}); err != nil {
+		t.Errorf("failed to putSubscription: %+v", err)
+	}
+	w = httptest.NewRecorder()
+	apiSubscriptionsRefreshHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	rec, _ := db.get("one.test")
+	testEqual(t, "get() = %+v, want %+v", *rec, stamped(Record{Source: "test"}))
+
+	// Unreachable
+	ls.Close()
+	if err := db.putSubscription("test", &Subscription{URL: ls.URL, Format: subscriptionFormatHosts, Interval: "24h"}); err != nil {
+		t.Errorf("failed to putSubscription: %+v", err)
+	}
+	w = httptest.NewRecorder()
+	apiSubscriptionsRefreshHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 502)
+}
+
+func Test_apiRulesIndexHandler(t *testing.T) {
+	db.Reset()
+
+	r := httptest.NewRequest("GET", "/api/rules/", nil)
+	w := httptest.NewRecorder()
+	apiRulesIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":[]}\n")
+
+	if err := db.putRule(&Rule{Pattern: "ads.*", Hits: 3}); err != nil {
+		t.Errorf("failed to putRule: %+v", err)
+	}
+	ruleSet.load()
+	w = httptest.NewRecorder()
+	apiRulesIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":[{\"id\":1,\"pattern\":\"ads.*\",\"hits\":3,\"lastHit\":\"0001-01-01T00:00:00Z\"}]}\n")
+}
+
+func Test_apiRulesCreateHandler(t *testing.T) {
+	db.Reset()
+
+	// Invalid
+	r := httptest.NewRequest("POST", "/api/rules/", strings.NewReader("{\"pattern\":\"/ad[s/\"}"))
+	w := httptest.NewRecorder()
+	apiRulesCreateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"error\":\"error parsing regexp: missing closing ]: `[s`\"}\n")
+
+	r = httptest.NewRequest("POST", "/api/rules/", strings.NewReader("{\"pattern\":\"ads.test\"}"))
+	w = httptest.NewRecorder()
+	apiRulesCreateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"error\":\"glob pattern has no wildcards (add it as a record instead)\"}\n")
+
+	// Valid
+	r = httptest.NewRequest("POST", "/api/rules/", strings.NewReader("{\"pattern\":\"*.tracking.*\",\"hits\":10}"))
+	w = httptest.NewRecorder()
+	apiRulesCreateHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 201)
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"id\":1,\"pattern\":\"*.tracking.*\",\"hits\":0,\"lastHit\":\"0001-01-01T00:00:00Z\"}}\n")
+	testEqual(t, "getRules() = %+v, want %+v", db.getRules(), []*Rule{{ID: 1, Pattern: "*.tracking.*"}})
+	testEqual(t, "isNameAllowed('a.tracking.test') = %+v, want %+v", isNameAllowed("a.tracking.test."), false)
+}
+
+func Test_apiRulesReadHandler(t *testing.T) {
+	db.Reset()
+
+	// Not found
+	r := httptest.NewRequest("GET", "/api/rules/1", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Set("id", "1")
+	w := httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiRulesReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 404)
+
+	// Found
+	if err := db.putRule(&Rule{Pattern: "ads.*"}); err != nil {
+		t.Errorf("failed to putRule: %+v", err)
+	}
+	ruleSet.load()
+	ruleSet.match("ads.test")
+	w = httptest.NewRecorder()
+	apiRulesReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body contains hits = %+v, want %+v", strings.Contains(w.Body.String(), "\"hits\":1,"), true)
+}
+
+func Test_apiRulesDeleteHandler(t *testing.T) {
+	db.Reset()
+	if err := db.putRule(&Rule{Pattern: "ads.*"}); err != nil {
+		t.Errorf("failed to putRule: %+v", err)
+	}
+	ruleSet.load()
+
+	r := httptest.NewRequest("DELETE", "/api/rules/1", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Set("id", "1")
+	w := httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	apiRulesDeleteHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 204)
+	testEqual(t, "getRules() = %+v, want %+v", len(db.getRules()), 0)
+	testEqual(t, "isNameAllowed('ads.test') = %+v, want %+v", isNameAllowed("ads.test."), true)
+}
+
+func Test_queryLogIndexHandler(t *testing.T) {
+	db.Reset()
+	queryLog = newQueryLog(time.Hour)
+	defer func() { queryLog = newQueryLog(0) }()
+
+	queryLog.add(&QueryLogEntry{Time: time.Now(), Client: "10.0.0.1", Name: "ads.test", Type: "A", Decision: decisionBlocked, Rule: "ads.test", Rcode: "NXDOMAIN"})
+	queryLog.add(&QueryLogEntry{Time: time.Now(), Client: "10.0.0.1", Name: "www.test", Type: "A", Decision: decisionAllowed, Rcode: "NOERROR"})
+
+	r := httptest.NewRequest("GET", "/querylog/?decision=blocked", nil)
+	w := httptest.NewRecorder()
+	queryLogIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "text/html; charset=utf-8")
+	testEqual(t, "Body contains '1 most recent queries' = %+v, want %+v", strings.Contains(w.Body.String(), "<span id=\"data-count\">1</span> most recent queries"), true)
+	testEqual(t, "Body contains 'ads.test' = %+v, want %+v", strings.Contains(w.Body.String(), "ads.test <small>A</small> &middot; <strong>blocked</strong> by ads.test"), true)
+	testEqual(t, "Body contains selected decision = %+v, want %+v", strings.Contains(w.Body.String(), "<option value=\"blocked\" selected>"), true)
+}
+
+func Test_apiQueryLogIndexHandler(t *testing.T) {
+	db.Reset()
+	queryLog = newQueryLog(100 * 365 * 24 * time.Hour) // Keep the (dated) entries
+	defer func() { queryLog = newQueryLog(0) }()
+
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	queryLog.add(&QueryLogEntry{Time: now, Client: "10.0.0.1", Name: "ads.test", Type: "A", Decision: decisionBlocked, Rule: "ads.test", Latency: 0.5, Rcode: "NXDOMAIN"})
+	queryLog.add(&QueryLogEntry{Time: now, Client: "10.0.0.2", Name: "www.test", Type: "A", Decision: decisionAllowed, Upstream: "8.8.8.8:53", Latency: 12, Rcode: "NOERROR"})
+
+	// Invalid limit
+	r := httptest.NewRequest("GET", "/api/querylog?limit=0", nil)
+	w := httptest.NewRecorder()
+	apiQueryLogIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+
+	r = httptest.NewRequest("GET", "/api/querylog?client=10.0.0.2&name=www&decision=allowed", nil)
+	w = httptest.NewRecorder()
+	apiQueryLogIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":[{\"time\":\"2017-01-01T00:00:00Z\",\"client\":\"10.0.0.2\",\"name\":\"www.test\",\"type\":\"A\",\"decision\":\"allowed\",\"upstream\":\"8.8.8.8:53\",\"latencyMs\":12,\"rcode\":\"NOERROR\"}]}\n")
+}
+
+func Test_apiStatsHandler(t *testing.T) {
+	queryStats = newStats()
+	defer func() { queryStats = newStats() }()
+
+	queryStats.add(&QueryLogEntry{Time: time.Now(), Client: "10.0.0.1", Name: "ads.test", Decision: decisionBlocked})
+
+	// Invalid period
+	r := httptest.NewRequest("GET", "/api/stats?period=1y", nil)
+	w := httptest.NewRecorder()
+	apiStatsHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 422)
+
+	r = httptest.NewRequest("GET", "/api/stats?period=7d", nil)
+	w = httptest.NewRecorder()
+	apiStatsHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
+	testEqual(t, "Body contains topBlocked = %+v, want %+v", strings.Contains(w.Body.String(), "\"topBlocked\":[{\"name\":\"ads.test\",\"count\":1}]"), true)
+	testEqual(t, "Body contains period = %+v, want %+v", strings.Contains(w.Body.String(), "\"period\":\"7d\""), true)
+
+	// Dashboard
+	r = httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	rootIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Body contains dashboard = %+v, want %+v", strings.Contains(w.Body.String(), "<li>ads.test <small>(1)</small></li>"), true)
+}
+
+func Test_metricsHandler(t *testing.T) {
+	db.Reset()
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	metricsHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8")
+	testEqual(t, "Body contains nogo_blacklist_records = %+v, want %+v", strings.Contains(w.Body.String(), "\nnogo_blacklist_records 0\n"), true)
+}
+
+func Test_apiUpstreamsIndexHandler(t *testing.T) {
+	upstreams = MustNewUpstreamPool([]string{"127.0.0.1:53"}, strategySequential)
+	defer func() { upstreams = &UpstreamPool{strategy: strategySequential} }()
+
+	r := httptest.NewRequest("GET", "/api/upstreams/", nil)
+	w := httptest.NewRecorder()
+	apiUpstreamsIndexHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":[{\"addr\":\"127.0.0.1:53\",\"down\":false,\"failures\":0,\"latencyMs\":0,\"queries\":0,\"errors\":0}]}\n")
+}
+
+func Test_apiCacheReadHandler(t *testing.T) {
+	dnsCache = newCache(10)
+	defer func() { dnsCache = newCache(0) }()
+	dnsCache.put(testCacheMsg("test.test.", dns.TypeA, dns.RcodeSuccess, "test.test. 300 IN A 127.0.0.1"))
+
+	r := httptest.NewRequest("GET", "/api/cache/", nil)
+	w := httptest.NewRecorder()
+	apiCacheReadHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/json; charset=utf-8")
+	testEqual(t, "Body = %+v, want %+v", w.Body.String(), "{\"data\":{\"size\":10,\"entries\":1,\"hits\":0,\"misses\":0}}\n")
+}
+
+func Test_apiCacheDeleteHandler(t *testing.T) {
+	dnsCache = newCache(10)
+	defer func() { dnsCache = newCache(0) }()
+	dnsCache.put(testCacheMsg("test.test.", dns.TypeA, dns.RcodeSuccess, "test.test. 300 IN A 127.0.0.1"))
+
+	r := httptest.NewRequest("DELETE", "/api/cache/", nil)
+	w := httptest.NewRecorder()
+	apiCacheDeleteHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 204)
+	testEqual(t, "stats().Entries = %+v, want %+v", dnsCache.stats().Entries, 0)
+}
+
+func Test_dohHandler(t *testing.T) {
+	db.Reset()
+
+	es, eaddrstr, err := RunLocalDNSServer("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("unable to run echo test server: %v", err)
+	}
+	defer es.Shutdown()
+	upstreams = MustNewUpstreamPool([]string{eaddrstr}, strategySequential)
+	defer func() { upstreams = &UpstreamPool{strategy: strategySequential} }()
+
+	if err := db.put("test.disallowed", &Record{}); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+
+	// Disallowed record (POST)
+	m := new(dns.Msg)
+	m.SetQuestion("test.disallowed.", dns.TypeA)
+	buf, _ := m.Pack()
+	r := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/dns-message")
+	w := httptest.NewRecorder()
+	dohHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Content-Type header = %+v, want %+v", w.Header().Get("Content-Type"), "application/dns-message")
+	in := new(dns.Msg)
+	if err := in.Unpack(w.Body.Bytes()); err != nil {
+		t.Fatalf("failed to unpack: %+v", err)
+	}
+	testEqual(t, "Disallowed Id = %+v, want %+v", in.Id, m.Id)
+	testEqual(t, "Disallowed Rcode = %+v, want %+v", in.Rcode, dns.RcodeNameError)
+
+	// Allowed record (GET)
+	m = new(dns.Msg)
+	m.SetQuestion("test.allowed.", dns.TypeA)
+	buf, _ = m.Pack()
+	r = httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	w = httptest.NewRecorder()
+	dohHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 200)
+	testEqual(t, "Cache-Control header = %+v, want %+v", w.Header().Get("Cache-Control"), "max-age=0")
+	in = new(dns.Msg)
+	if err := in.Unpack(w.Body.Bytes()); err != nil {
+		t.Fatalf("failed to unpack: %+v", err)
+	}
+	testEqual(t, "Allowed Id = %+v, want %+v", in.Id, m.Id)
+	testEqual(t, "Allowed Rcode = %+v, want %+v", in.Rcode, dns.RcodeSuccess)
+	testEqual(t, "Allowed Question = %+v, want %+v", in.Question, m.Question)
+
+	// Wrong Content-Type
+	r = httptest.NewRequest("POST", "/dns-query", bytes.NewReader(buf))
+	w = httptest.NewRecorder()
+	dohHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 415)
+
+	// Invalid message
+	r = httptest.NewRequest("GET", "/dns-query?dns=invalid", nil)
+	w = httptest.NewRecorder()
+	dohHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 400)
+	r = httptest.NewRequest("GET", "/dns-query", nil)
+	w = httptest.NewRecorder()
+	dohHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 400)
+
+	// Unsupported method
+	r = httptest.NewRequest("PUT", "/dns-query", nil)
+	w = httptest.NewRecorder()
+	dohHandler(w, r)
+	testEqual(t, "Response code = %+v, want %+v", w.Code, 405)
 }
 
 func Test_cssHandler(t *testing.T) {
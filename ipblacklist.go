@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// IPSet represents the blocked IP ranges which answers are checked against,
+// indexed by a binary prefix tree per address family, so that looking up an
+// address takes at most 32 (or 128) steps however many ranges are blocked
+type IPSet struct {
+	mu   sync.RWMutex
+	v4   *ipNode
+	v6   *ipNode
+	size int
+}
+
+// ipNode represents a bit of a blocked range's prefix
+type ipNode struct {
+	children [2]*ipNode
+	network  string // Blocked range ending at this node (empty if none)
+}
+
+// load indexes the blocked IP ranges.
+func (s *IPSet) load() {
+	v4, v6 := &ipNode{}, &ipNode{}
+	size := 0
+
+	for _, k := range db.getIPBlacklist() {
+		n := parseClient(k)
+		if n == nil {
+			continue
+		}
+
+		ones, bits := n.Mask.Size()
+		if bits == 32 {
+			v4.insert(n.IP.To4(), ones, n.String())
+		} else {
+			v6.insert(n.IP.To16(), ones, n.String())
+		}
+		size++
+	}
+
+	s.mu.Lock()
+	s.v4, s.v6, s.size = v4, v6, size
+	s.mu.Unlock()
+}
+
+// match returns the blocked range containing the passed address, or an empty
+// string if it isn't blocked.
+func (s *IPSet) match(ip net.IP) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.size == 0 {
+		return ""
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return s.v4.lookup(ip4)
+	}
+
+	return s.v6.lookup(ip.To16())
+}
+
+// len returns the number of blocked ranges.
+func (s *IPSet) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.size
+}
+
+// insert adds the range of the passed prefix to the tree.
+func (n *ipNode) insert(ip net.IP, ones int, network string) {
+	for i := 0; i < ones; i++ {
+		b := ip[i/8] >> uint(7-i%8) & 1
+		if n.children[b] == nil {
+			n.children[b] = &ipNode{}
+		}
+		n = n.children[b]
+	}
+
+	n.network = network
+}
+
+// lookup returns the (least specific) range of the tree containing the passed
+// address, if any.
+func (n *ipNode) lookup(ip net.IP) string {
+	for i := 0; n != nil; i++ {
+		if n.network != "" {
+			return n.network
+		}
+		if i == len(ip)*8 {
+			break
+		}
+
+		n = n.children[ip[i/8]>>uint(7-i%8)&1]
+	}
+
+	return ""
+}
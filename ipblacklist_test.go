@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPSet_match(t *testing.T) {
+	db.Reset()
+	defer func() {
+		db.Reset()
+		ipBlacklist.load()
+	}()
+
+	s := &IPSet{}
+	testEqual(t, "match() = %+v, want %+v", s.match(net.ParseIP("192.0.2.1")), "")
+
+	for _, k := range []string{"192.0.2.0/24", "192.0.2.128/25", "198.51.100.7/32", "2001:db8::/32", "0.0.0.0/0"} {
+		db.blockIP(k)
+	}
+	db.unblockIP("0.0.0.0/0")
+	s.load()
+	testEqual(t, "len() = %+v, want %+v", s.len(), 4)
+
+	for _, tt := range []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.0/24"},
+		{"192.0.2.200", "192.0.2.0/24"},
+		{"192.0.3.1", ""},
+		{"198.51.100.7", "198.51.100.7/32"},
+		{"198.51.100.8", ""},
+		{"::ffff:192.0.2.1", "192.0.2.0/24"},
+		{"2001:db8:1::1", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+	} {
+		testEqual(t, "match("+tt.ip+") = %+v, want %+v", s.match(net.ParseIP(tt.ip)), tt.want)
+	}
+
+	// The whole address space
+	db.blockIP("::/0")
+	s.load()
+	testEqual(t, "match('2001:db9::1') = %+v, want %+v", s.match(net.ParseIP("2001:db9::1")), "::/0")
+	testEqual(t, "match('192.0.3.1') = %+v, want %+v", s.match(net.ParseIP("192.0.3.1")), "")
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Local record types
+const (
+	localRecordA     = "A"
+	localRecordAAAA  = "AAAA"
+	localRecordCNAME = "CNAME"
+	localRecordTXT   = "TXT"
+	localRecordPTR   = "PTR"
+)
+
+const (
+	localRecordTTL   = 300 // Default TTL (in seconds) of local answers
+	maxLocalCNAMEs   = 8   // Maximum CNAMEs followed within the local records
+	maxTXTStringSize = 255 // Maximum size of each TXT character string
+)
+
+var localRecordTypes = []string{localRecordA, localRecordAAAA, localRecordCNAME, localRecordTXT, localRecordPTR}
+
+// LocalRecord represents a user-defined DNS record, which is answered
+// authoritatively (ahead of the blacklist and upstreams)
+type LocalRecord struct {
+	Type  string `json:"type"`          // A, AAAA, CNAME, TXT or PTR
+	Value string `json:"value"`         // Address, target name or text
+	TTL   uint32 `json:"ttl,omitempty"` // Defaults to localRecordTTL
+}
+
+// isValid checks that the record's value suits its type.
+func (lr *LocalRecord) isValid() bool {
+	switch lr.Type {
+	case localRecordA:
+		return net.ParseIP(lr.Value).To4() != nil
+	case localRecordAAAA:
+		ip := net.ParseIP(lr.Value)
+		return ip != nil && ip.To4() == nil
+	case localRecordCNAME, localRecordPTR:
+		return isValidLocalName(strings.TrimSuffix(lr.Value, "."))
+	case localRecordTXT:
+		return lr.Value != "" && len(lr.Value) <= 4*maxTXTStringSize
+	}
+
+	return false
+}
+
+// rr returns the record as a resource record of the passed name.
+func (lr *LocalRecord) rr(name string) dns.RR {
+	ttl := lr.TTL
+	if ttl == 0 {
+		ttl = localRecordTTL
+	}
+
+	hdr := dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.StringToType[lr.Type], Class: dns.ClassINET, Ttl: ttl}
+
+	switch lr.Type {
+	case localRecordA:
+		return &dns.A{Hdr: hdr, A: net.ParseIP(lr.Value).To4()}
+	case localRecordAAAA:
+		return &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(lr.Value)}
+	case localRecordCNAME:
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(strings.ToLower(lr.Value))}
+	case localRecordPTR:
+		return &dns.PTR{Hdr: hdr, Ptr: dns.Fqdn(strings.ToLower(lr.Value))}
+	case localRecordTXT:
+		return &dns.TXT{Hdr: hdr, Txt: splitTXT(lr.Value)}
+	}
+
+	return nil
+}
+
+// localAnswer answers the passed query authoritatively from the local records,
+// following CNAMEs to other local names (CNAMEs to names outside of the local
+// records are left to the client to resolve). A name with local records but
+// none of the queried type gets an empty answer. Nil is returned if the queried
+// name has no local records, so that it is filtered and proxied as usual.
+func localAnswer(r *dns.Msg) *dns.Msg {
+	if len(r.Question) == 0 || r.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+
+	q := r.Question[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+
+	lrs, err := db.getLocalRecords(name)
+	if err == errLocalRecordNotFound {
+		return nil
+	} else if err != nil {
+		log.Printf("db.getLocalRecords(%s) Error: %s\n", name, err)
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+
+	for i := 0; i < maxLocalCNAMEs; i++ {
+		var target string
+
+		for _, lr := range lrs {
+			if lr.Type == localRecordCNAME && q.Qtype != dns.TypeCNAME {
+				m.Answer = append(m.Answer, lr.rr(name))
+				target = strings.ToLower(strings.TrimSuffix(lr.Value, "."))
+				break
+			}
+
+			if q.Qtype == dns.TypeANY || dns.StringToType[lr.Type] == q.Qtype {
+				m.Answer = append(m.Answer, lr.rr(name))
+			}
+		}
+
+		if target == "" {
+			break
+		}
+
+		// Follow the CNAME, if its target is local too
+		if lrs, err = db.getLocalRecords(target); err != nil {
+			break
+		}
+		name = target
+	}
+
+	return m
+}
+
+// splitTXT splits the passed text into TXT character strings.
+func splitTXT(s string) []string {
+	var txt []string
+
+	for len(s) > maxTXTStringSize {
+		txt = append(txt, s[:maxTXTStringSize])
+		s = s[maxTXTStringSize:]
+	}
+
+	return append(txt, s)
+}
+
+// localRecordsFromHosts returns the local records of the passed hosts file
+// line: an A or AAAA record for each of its names, and a PTR record for the
+// address (pointing to the first name). Loopback, unspecified and broadcast
+// addresses (such as those of "localhost" and blocklists) are skipped.
+func localRecordsFromHosts(line string) map[string][]LocalRecord {
+	addr, names := parseHostsLine(line)
+
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || ip.Equal(net.IPv4bcast) {
+		return nil
+	}
+
+	lr := LocalRecord{Type: localRecordA, Value: ip.String()}
+	if ip.To4() == nil {
+		lr.Type = localRecordAAAA
+	}
+
+	recs := make(map[string][]LocalRecord)
+	for _, n := range names {
+		n = strings.ToLower(strings.TrimSuffix(n, "."))
+		if !isValidLocalName(n) {
+			continue
+		}
+
+		if len(recs) == 0 {
+			if rev, err := dns.ReverseAddr(ip.String()); err == nil {
+				recs[strings.TrimSuffix(rev, ".")] = []LocalRecord{{Type: localRecordPTR, Value: n}}
+			}
+		}
+		recs[n] = append(recs[n], lr)
+	}
+
+	return recs
+}
+
+// isValidLocalName checks that the passed string is usable as a local name
+// (which, unlike blacklist records, may be a single label such as "nas").
+func isValidLocalName(name string) bool {
+	if name == "" || len(name) > 253 || strings.ContainsAny(name, "*/") {
+		return false
+	}
+
+	_, ok := dns.IsDomainName(name)
+	return ok
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLocalRecord_isValid(t *testing.T) {
+	for _, tt := range []struct {
+		lr   LocalRecord
+		want bool
+	}{
+		{LocalRecord{Type: localRecordA, Value: "192.168.1.10"}, true},
+		{LocalRecord{Type: localRecordA, Value: "fd00::10"}, false},
+		{LocalRecord{Type: localRecordAAAA, Value: "fd00::10"}, true},
+		{LocalRecord{Type: localRecordAAAA, Value: "192.168.1.10"}, false},
+		{LocalRecord{Type: localRecordCNAME, Value: "nas.lan."}, true},
+		{LocalRecord{Type: localRecordCNAME, Value: "*.lan"}, false},
+		{LocalRecord{Type: localRecordPTR, Value: "nas"}, true},
+		{LocalRecord{Type: localRecordTXT, Value: "v=spf1 -all"}, true},
+		{LocalRecord{Type: localRecordTXT, Value: ""}, false},
+		{LocalRecord{Type: "MX", Value: "mail.lan"}, false},
+	} {
+		testEqual(t, "isValid("+tt.lr.Type+" "+tt.lr.Value+") = %+v, want %+v", tt.lr.isValid(), tt.want)
+	}
+}
+
+func Test_localAnswer(t *testing.T) {
+	db.Reset()
+	defer db.Reset()
+
+	db.putLocalRecords("nas.lan", []LocalRecord{{Type: localRecordA, Value: "192.168.1.10"}, {Type: localRecordTXT, Value: "hello", TTL: 60}})
+	db.putLocalRecords("files.lan", []LocalRecord{{Type: localRecordCNAME, Value: "nas.lan"}})
+	db.putLocalRecords("search.lan", []LocalRecord{{Type: localRecordCNAME, Value: "example.com"}})
+
+	// Not local
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	testEqual(t, "localAnswer('example.com') = %+v, want %+v", localAnswer(m) == nil, true)
+
+	// Answered authoritatively
+	m.SetQuestion("NAS.lan.", dns.TypeA)
+	a := localAnswer(m)
+	testEqual(t, "localAnswer('nas.lan') Authoritative = %+v, want %+v", a.Authoritative, true)
+	testEqual(t, "localAnswer('nas.lan') Rcode = %+v, want %+v", a.Rcode, dns.RcodeSuccess)
+	testEqual(t, "len(localAnswer('nas.lan').Answer) = %+v, want %+v", len(a.Answer), 1)
+	testEqual(t, "localAnswer('nas.lan').Answer[0] = %+v, want %+v", a.Answer[0].String(), "nas.lan.\t300\tIN\tA\t192.168.1.10")
+
+	m.SetQuestion("nas.lan.", dns.TypeTXT)
+	a = localAnswer(m)
+	testEqual(t, "localAnswer('nas.lan' TXT).Answer[0] = %+v, want %+v", a.Answer[0].String(), "nas.lan.\t60\tIN\tTXT\t\"hello\"")
+
+	// No records of the queried type
+	m.SetQuestion("nas.lan.", dns.TypeAAAA)
+	a = localAnswer(m)
+	testEqual(t, "localAnswer('nas.lan' AAAA) Rcode = %+v, want %+v", a.Rcode, dns.RcodeSuccess)
+	testEqual(t, "len(localAnswer('nas.lan' AAAA).Answer) = %+v, want %+v", len(a.Answer), 0)
+
+	// CNAMEs to local names are followed
+	m.SetQuestion("files.lan.", dns.TypeA)
+	a = localAnswer(m)
+	testEqual(t, "len(localAnswer('files.lan').Answer) = %+v, want %+v", len(a.Answer), 2)
+	testEqual(t, "localAnswer('files.lan').Answer[1] = %+v, want %+v", a.Answer[1].String(), "nas.lan.\t300\tIN\tA\t192.168.1.10")
+
+	// Others are left to the client
+	m.SetQuestion("search.lan.", dns.TypeA)
+	a = localAnswer(m)
+	testEqual(t, "len(localAnswer('search.lan').Answer) = %+v, want %+v", len(a.Answer), 1)
+
+	// CNAME queries get the CNAME itself
+	m.SetQuestion("files.lan.", dns.TypeCNAME)
+	a = localAnswer(m)
+	testEqual(t, "localAnswer('files.lan' CNAME).Answer[0] = %+v, want %+v", a.Answer[0].String(), "files.lan.\t300\tIN\tCNAME\tnas.lan.")
+}
+
+func Test_localRecordsFromHosts(t *testing.T) {
+	testEqual(t, "localRecordsFromHosts('# comment') = %+v, want %+v", len(localRecordsFromHosts("# comment")), 0)
+	testEqual(t, "localRecordsFromHosts('127.0.0.1 localhost') = %+v, want %+v", len(localRecordsFromHosts("127.0.0.1 localhost")), 0)
+	testEqual(t, "localRecordsFromHosts('0.0.0.0 ads.test') = %+v, want %+v", len(localRecordsFromHosts("0.0.0.0 ads.test")), 0)
+	testEqual(t, "localRecordsFromHosts('nas.lan') = %+v, want %+v", len(localRecordsFromHosts("nas.lan")), 0)
+
+	testEqual(t, "localRecordsFromHosts('192.168.1.10 NAS.lan nas # comment') = %+v, want %+v", localRecordsFromHosts("192.168.1.10 NAS.lan nas # comment"), map[string][]LocalRecord{
+		"nas.lan":                   {{Type: localRecordA, Value: "192.168.1.10"}},
+		"nas":                       {{Type: localRecordA, Value: "192.168.1.10"}},
+		"10.1.168.192.in-addr.arpa": {{Type: localRecordPTR, Value: "nas.lan"}},
+	})
+
+	lrs := localRecordsFromHosts("fd00::10 printer")
+	testEqual(t, "localRecordsFromHosts('fd00::10 printer')['printer'] = %+v, want %+v", lrs["printer"], []LocalRecord{{Type: localRecordAAAA, Value: "fd00::10"}})
+	testEqual(t, "len(localRecordsFromHosts('fd00::10 printer')) = %+v, want %+v", len(lrs), 2)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -26,25 +28,77 @@ type DB struct {
 }
 
 var (
-	db           *DB
-	dnsServers   []*dns.Server
-	httpServer   *http.Server
-	isDisabledMu sync.Mutex
-	dnsClient    = &dns.Client{}
-	blacklistKey = []byte("blacklist")
-	isDisabled   = false
-	version      = "undefined"
-	build        = "undefined"
-
-	dbPath     = flag.String("db", "nogo.db", "Specify a file path for the database.")
-	dnsAddr    = flag.String("dns-addr", ":53", "Specify an address for the DNS proxy server to listen on.")
-	dnsNet     = flag.String("dns-net", "udp", "Specify the listener protocol(s) for the DNS proxy server to use (\"udp\", \"tcp\", or \"udp+tcp\").")
-	dnsProxyTo = flag.String("dns-proxyto", "8.8.8.8:53,8.8.4.4:53", "Specify one or more (comma separated) upstream DNS server addresses to proxy allowed queries to.")
-	blacklist  = flag.String("import", "", "Specify a file path to import records to block (traditional hosts file format, or simply one domain per line).")
-	webAddr    = flag.String("web-addr", ":8080", "Specify an address for the control panel web server to listen on.")
-	webOff     = flag.Bool("web-off", false, "Instruct nogo not to serve the web control panel/API.")
-	webPasswd  = flag.String("web-password", "", "Instruct the web control panel/API to require basic auth, using the specified password and a username of \"admin\".")
-	showVer    = flag.Bool("version", false, "Show version and exit.")
+	db               *DB
+	dnsServers       []*dns.Server
+	httpServer       *http.Server
+	metricsServer    *http.Server
+	isDisabledMu     sync.Mutex
+	dnsClient        = &dns.Client{}
+	dnsCache         = newCache(0)
+	upstreamsMu      sync.RWMutex
+	upstreams        = &UpstreamPool{strategy: strategySequential}
+	forwardsMu       sync.RWMutex
+	forwards         = &ForwardSet{}
+	ruleSet          = &RuleSet{}
+	recordHits       = newRecordHits()
+	groupSet         = &GroupSet{}
+	ipBlacklist      = &IPSet{}
+	rebindExemptions = map[string]bool{}
+	queryLog         = newQueryLog(0)
+	queryStats       = newStats()
+	queryMetrics     = newQueryMetrics()
+	blacklistKey     = []byte("blacklist")
+	allowlistKey     = []byte("allowlist")
+	subscriptionsKey = []byte("subscriptions")
+	rulesKey         = []byte("rules")
+	queryLogKey      = []byte("querylog")
+	groupsKey        = []byte("groups")
+	settingsKey      = []byte("settings")
+	localRecordsKey  = []byte("localrecords")
+	ipBlacklistKey   = []byte("ipblacklist")
+	isDisabled       = false
+	disabledUntil    time.Time
+	blockModeMu      sync.Mutex
+	blockMode        = blockModeNXDomain
+	blockIPv4        net.IP
+	blockIPv6        net.IP
+	version          = "undefined"
+	build            = "undefined"
+
+	dbPath         = flag.String("db", "nogo.db", "Specify a file path for the database.")
+	dnsAddr        = flag.String("dns-addr", ":53", "Specify an address for the DNS proxy server to listen on.")
+	dnsNet         = flag.String("dns-net", "udp", "Specify the listener protocol(s) for the DNS proxy server to use (\"udp\", \"tcp\", \"tls\", or a combination such as \"udp+tcp+tls\").")
+	dnsTLSAddr     = flag.String("dns-tls-addr", ":853", "Specify an address for the DNS over TLS (\"tls\" -dns-net) listener.")
+	dnsTLSCert     = flag.String("dns-tls-cert", "", "Specify a certificate file path for the DNS over TLS listener.")
+	dnsTLSKey      = flag.String("dns-tls-key", "", "Specify a private key file path for the DNS over TLS listener.")
+	dnsProxyTo     = flag.String("dns-proxyto", "8.8.8.8:53,8.8.4.4:53", "Specify one or more (comma separated) upstream DNS server addresses to proxy allowed queries to (\"host:port\", \"tls://host:port#name\" for DNS over TLS, or \"https://host/path#bootstrap-ip\" for DNS over HTTPS). Overridden by changes via the API.")
+	dnsHTTPSMethod = flag.String("dns-https-method", "POST", "Specify the HTTP method to use for DNS over HTTPS upstream queries (\"POST\" or \"GET\").")
+	dnsUpstreamCA  = flag.String("dns-upstream-ca", "", "Specify a file path of PEM encoded CA certificates to verify DNS over TLS/HTTPS upstreams with (instead of the system's CAs).")
+	dnsCNAMECheck  = flag.Bool("dns-cname-check", false, "Instruct nogo to check the CNAME targets of allowed answers against the blacklist, blocking those which point at a blocked domain (CNAME cloaking).")
+	dnsRebind      = flag.Bool("dns-rebind-protection", false, "Instruct nogo to reject upstream answers pointing at private, loopback, link-local, CGNAT or unspecified addresses (DNS rebinding protection), except for local names (single label, .lan, .local, .home.arpa or .internal), and the names covered by local records, conditional forwarding rules, or -dns-rebind-exempt.")
+	rebindExempt   = flag.String("dns-rebind-exempt", "", "Specify one or more (comma separated) domains which legitimately resolve to private addresses (e.g. \"plex.direct\"), exempting them and their subdomains from -dns-rebind-protection.")
+	dnsForward     = flag.String("dns-forward", "", "Specify one or more (comma separated) conditional forwarding rules, proxying the queries for a domain and its subdomains (or the reverse lookups of a CIDR range) to their own upstream DNS server, e.g. \"corp.example.com=10.0.0.53:53,192.168.0.0/16=192.168.1.1:53\". The most specific rule applies. Overridden by changes via the API.")
+	dnsForwardFile = flag.String("dns-forward-file", "", "Specify a file path of conditional forwarding rules (see -dns-forward), one per line: a domain or CIDR range followed by its upstream DNS server addresses. Overridden by changes via the API.")
+	dnsStrategy    = flag.String("dns-strategy", strategySequential, "Specify how upstream DNS servers are selected (\"sequential\", \"roundrobin\", \"parallel\", or \"fastest\"). Overridden by changes via the API.")
+	dnsCacheSize   = flag.Int("dns-cache-size", 10000, "Specify the maximum number of upstream responses to cache (0 disables caching).")
+	dnsBlockMode   = flag.String("dns-block-mode", blockModeNXDomain, "Specify how to respond to blocked queries (\"nxdomain\", \"refused\", \"nodata\", \"null\", or \"sinkhole\"). Overridden by changes via the API.")
+	dnsBlockIPv4   = flag.String("dns-block-ipv4", "", "Specify the IPv4 address to answer blocked A queries with when using the \"sinkhole\" block mode.")
+	dnsBlockIPv6   = flag.String("dns-block-ipv6", "", "Specify the IPv6 address to answer blocked AAAA queries with when using the \"sinkhole\" block mode.")
+	dnsBlockTTL    = flag.Uint("dns-block-ttl", 60, "Specify the TTL (in seconds) of the answers synthesized by the \"null\" and \"sinkhole\" block modes.")
+	blacklist      = flag.String("import", "", "Specify a file path to import records to block (traditional hosts file format, or simply one domain per line).")
+	importFormat   = flag.String("import-format", "hosts", "Specify the format of the -import file (\"hosts\", or \"adblock\" for Adblock Plus style ||example.com^ rules, whose @@ exceptions are added to the allowlist).")
+	allowlist      = flag.String("import-allowlist", "", "Specify a file path to import domains to always allow, overriding any blocked records (traditional hosts file format, or simply one domain per line).")
+	blockedIPs     = flag.String("import-ipblacklist", "", "Specify a file path to import IP addresses and CIDR ranges to block from (one per line). Answers with addresses in these ranges have them removed, or get the block response if none remain.")
+	localRecords   = flag.String("import-local", "", "Specify a hosts file path (such as /etc/hosts) to import local records from, which are answered authoritatively. Loopback and unspecified addresses are skipped.")
+	metricsAddr    = flag.String("metrics-addr", "", "Specify an address for a separate listener serving Prometheus metrics at /metrics (without basic auth). By default, /metrics is served by the web control panel/API.")
+	metricsPublic  = flag.Bool("metrics-public", false, "Instruct the web control panel/API to serve /metrics without the -web-password basic auth.")
+	queryLogRetain = flag.Duration("querylog-retention", 24*time.Hour, "Specify how long to keep query log entries for (e.g. \"168h\"), or 0 to disable the query log.")
+	webAddr        = flag.String("web-addr", ":8080", "Specify an address for the control panel web server to listen on.")
+	webTLSCert     = flag.String("web-tls-cert", "", "Specify a certificate file path to serve the control panel/API (and DNS over HTTPS at /dns-query) over HTTPS with.")
+	webTLSKey      = flag.String("web-tls-key", "", "Specify a private key file path to serve the control panel/API (and DNS over HTTPS at /dns-query) over HTTPS with.")
+	webOff         = flag.Bool("web-off", false, "Instruct nogo not to serve the web control panel/API.")
+	webPasswd      = flag.String("web-password", "", "Instruct the web control panel/API to require basic auth, using the specified password and a username of \"admin\".")
+	showVer        = flag.Bool("version", false, "Show version and exit.")
 )
 
 func init() {
@@ -57,6 +111,31 @@ func init() {
 	}
 }
 
+// newDNSServers returns a DNS proxy server for each of the passed ("+"
+// separated) listener protocols.
+func newDNSServers(nets string) ([]*dns.Server, error) {
+	var servers []*dns.Server
+
+	for _, n := range strings.Split(nets, "+") {
+		s := &dns.Server{Addr: *dnsAddr, Net: n, Handler: dns.HandlerFunc(dnsHandler)}
+
+		if n == "tls" {
+			cert, err := tls.LoadX509KeyPair(*dnsTLSCert, *dnsTLSKey)
+			if err != nil {
+				return nil, err
+			}
+
+			s.Addr = *dnsTLSAddr
+			s.Net = "tcp-tls"
+			s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+
+		servers = append(servers, s)
+	}
+
+	return servers, nil
+}
+
 func main() {
 	var wg sync.WaitGroup
 
@@ -67,6 +146,75 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Validate the block response settings
+	if *dnsBlockIPv4 != "" {
+		if blockIPv4 = net.ParseIP(*dnsBlockIPv4).To4(); blockIPv4 == nil {
+			log.Fatalf("Invalid -dns-block-ipv4: %s\n", *dnsBlockIPv4)
+		}
+	}
+	if *dnsBlockIPv6 != "" {
+		if blockIPv6 = net.ParseIP(*dnsBlockIPv6); blockIPv6 == nil || blockIPv6.To4() != nil {
+			log.Fatalf("Invalid -dns-block-ipv6: %s\n", *dnsBlockIPv6)
+		}
+	}
+	if !isValidBlockMode(*dnsBlockMode) {
+		log.Fatalf("Invalid -dns-block-mode: %s\n", *dnsBlockMode)
+	}
+	if !isUsableBlockMode(*dnsBlockMode) {
+		log.Fatalf("The \"sinkhole\" -dns-block-mode requires -dns-block-ipv4 or -dns-block-ipv6\n")
+	}
+	blockMode = *dnsBlockMode
+
+	if *importFormat != subscriptionFormatHosts && *importFormat != subscriptionFormatAdblock {
+		log.Fatalf("Invalid -import-format: %s\n", *importFormat)
+	}
+
+	// Initialize the upstream servers
+	if !isValidStrategy(*dnsStrategy) {
+		log.Fatalf("Invalid -dns-strategy: %s\n", *dnsStrategy)
+	}
+	if *dnsHTTPSMethod != http.MethodPost && *dnsHTTPSMethod != http.MethodGet {
+		log.Fatalf("Invalid -dns-https-method: %s\n", *dnsHTTPSMethod)
+	}
+	if *dnsUpstreamCA != "" {
+		pool, err := loadRootCAs(*dnsUpstreamCA)
+		if err != nil {
+			log.Fatalf("loadRootCAs(%s) Error: %s\n", *dnsUpstreamCA, err)
+		}
+		upstreamRootCAs = pool
+	}
+	pool, err := newUpstreamPool(strings.Split(*dnsProxyTo, ","), *dnsStrategy)
+	if err != nil {
+		log.Fatalf("Invalid -dns-proxyto: %s\n", err)
+	}
+	upstreams = pool
+
+	// Initialize the conditional forwarding rules
+	rules := make(map[string][]string)
+	if *dnsForwardFile != "" {
+		if err := readForwards(*dnsForwardFile, rules); err != nil {
+			log.Fatalf("readForwards(%s) Error: %s\n", *dnsForwardFile, err)
+		}
+	}
+	if err := parseForwards(*dnsForward, rules); err != nil {
+		log.Fatalf("Invalid -dns-forward: %s\n", err)
+	}
+	if forwards, err = newForwardSet(rules); err != nil {
+		log.Fatalf("Invalid -dns-forward: %s\n", err)
+	}
+
+	// Initialize the rebinding protection exemptions
+	for _, d := range splitList(*rebindExempt) {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if !isValidLocalName(d) {
+			log.Fatalf("Invalid -dns-rebind-exempt: %s\n", d)
+		}
+		rebindExemptions[d] = true
+	}
+
+	// Initialize the response cache
+	dnsCache = newCache(*dnsCacheSize)
+
 	// Initialize the database
 	bdb, err := bolt.Open(*dbPath, 0600, &bolt.Options{Timeout: 2 * time.Second})
 	if err != nil {
@@ -75,13 +223,22 @@ func main() {
 	db = &DB{bdb}
 	defer db.Close()
 
-	// Ensure blacklist bucket exists
-	if err = db.Update(func(tx *bolt.Tx) error {
-		// Get/create bucket
-		_, err := tx.CreateBucketIfNotExists(blacklistKey)
-		return err
-	}); err != nil {
-		log.Fatalf("CreateBucketIfNotExists(%s) Error: %s\n", blacklistKey, err)
+	// Ensure the buckets exist
+	for _, key := range [][]byte{blacklistKey, allowlistKey, subscriptionsKey, rulesKey, queryLogKey, groupsKey, settingsKey, localRecordsKey, ipBlacklistKey} {
+		if err = db.Update(func(tx *bolt.Tx) error {
+			// Get/create bucket
+			_, err := tx.CreateBucketIfNotExists(key)
+			return err
+		}); err != nil {
+			log.Fatalf("CreateBucketIfNotExists(%s) Error: %s\n", key, err)
+		}
+	}
+
+	// Upgrade the records stored by previous versions
+	if n, err := db.migrateRecords(); err != nil {
+		log.Fatalf("db.migrateRecords() Error: %s\n", err)
+	} else if n > 0 {
+		fmt.Printf("Migrated %d records to the current format.\n", n)
 	}
 
 	// Import a blacklist, if specified
@@ -89,7 +246,20 @@ func main() {
 		db.NoSync = true
 
 		fmt.Println("Importing blacklist file. Please wait...")
-		if err := db.importBlacklist(*blacklist); err != nil {
+		if *importFormat == subscriptionFormatAdblock {
+			l, err := db.importAdblock(*blacklist)
+			if err != nil {
+				log.Fatalf("db.importAdblock(%s) Error: %s\n", *blacklist, err)
+			}
+
+			fmt.Printf("Imported %d blocked and %d allowlisted domains.\n", len(l.Block), len(l.Allow))
+			if len(l.Unsupported) > 0 {
+				fmt.Printf("Skipped %d unsupported rules:\n", len(l.Unsupported))
+				for _, u := range l.Unsupported {
+					fmt.Println("  " + u)
+				}
+			}
+		} else if err := db.importBlacklist(*blacklist); err != nil {
 			log.Fatalf("db.importBlacklist(%s) Error: %s\n", *blacklist, err)
 		}
 
@@ -100,43 +270,184 @@ func main() {
 		db.NoSync = false
 	}
 
+	// Import an allowlist, if specified
+	if *allowlist != "" {
+		db.NoSync = true
+
+		fmt.Println("Importing allowlist file. Please wait...")
+		if err := db.importAllowlist(*allowlist); err != nil {
+			log.Fatalf("db.importAllowlist(%s) Error: %s\n", *allowlist, err)
+		}
+
+		if err := db.Sync(); err != nil {
+			log.Fatalf("db.Sync() Error: %s\n", err)
+		}
+
+		db.NoSync = false
+	}
+
+	// Import local records, if specified
+	if *localRecords != "" {
+		db.NoSync = true
+
+		fmt.Println("Importing local records file. Please wait...")
+		n, err := db.importLocalRecords(*localRecords)
+		if err != nil {
+			log.Fatalf("db.importLocalRecords(%s) Error: %s\n", *localRecords, err)
+		}
+
+		if err := db.Sync(); err != nil {
+			log.Fatalf("db.Sync() Error: %s\n", err)
+		}
+
+		db.NoSync = false
+		fmt.Printf("Imported local records for %d names.\n", n)
+	}
+
+	// Import an IP blacklist, if specified
+	if *blockedIPs != "" {
+		db.NoSync = true
+
+		fmt.Println("Importing IP blacklist file. Please wait...")
+		n, err := db.importIPBlacklist(*blockedIPs)
+		if err != nil {
+			log.Fatalf("db.importIPBlacklist(%s) Error: %s\n", *blockedIPs, err)
+		}
+
+		if err := db.Sync(); err != nil {
+			log.Fatalf("db.Sync() Error: %s\n", err)
+		}
+
+		db.NoSync = false
+		fmt.Printf("Imported %d blocked IP ranges.\n", n)
+	}
+
+	// Compile the pattern rules
+	if err := ruleSet.load(); err != nil {
+		log.Fatalf("ruleSet.load() Error: %s\n", err)
+	}
+	go scheduleRuleFlushes()
+
+	// Resume records once their timed pause expires
+	go schedulePauseSweeps()
+
+	// Persist the record hit counters counted by the DNS path
+	go scheduleRecordHitFlushes()
+
+	// Index the client groups
+	groupSet.load()
+
+	// Index the blocked IP ranges
+	ipBlacklist.load()
+
+	// Restore the settings changed via the API (including any timed disable)
+	if err := loadSettings(); err != nil {
+		log.Fatalf("loadSettings() Error: %s\n", err)
+	}
+
+	// Initialize the query log
+	queryLog = newQueryLog(*queryLogRetain)
+	go scheduleQueryLogFlushes()
+	go scheduleQueryLogPrunes()
+
+	// Refresh blocklist subscriptions on schedule
+	go scheduleSubscriptions()
+
 	// Initialize the HTTP router
 	r := chi.NewRouter()
 
 	// Register HTTP middleware
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	if *webPasswd != "" {
-		r.Use(basicAuth(*webPasswd))
-	}
-
-	// Register HTTP routes/handlers
-	r.Get("/", rootIndexHandler)
-	r.Post("/records/", recordsCreateHandler)
-	r.Get("/records/:key", recordsReadHandler)
-	r.Get("/export/hosts.txt", exportHostsHandler)
-	r.Get("/api/records/", apiRecordsIndexHandler)
-	r.Get("/api/records/:key", apiRecordsReadHandler)
-	r.Put("/api/records/:key", apiRecordsUpdateHandler)
-	r.Delete("/api/records/:key", apiRecordsDeleteHandler)
-	r.Put("/api/settings/", apiSettingsUpdateHandler)
-	r.Get("/css/nogo.css", cssHandler)
+
+	// Register the DNS over HTTPS handler (ahead of basic auth, which DoH
+	// clients don't support)
+	r.Get("/dns-query", dohHandler)
+	r.Post("/dns-query", dohHandler)
+
+	// Register the Prometheus metrics handler (unless it has its own listener)
+	if *metricsAddr == "" && *metricsPublic {
+		r.Get("/metrics", metricsHandler)
+	}
+
+	r.Group(func(r chi.Router) {
+		if *webPasswd != "" {
+			r.Use(basicAuth(*webPasswd))
+		}
+
+		// Register HTTP routes/handlers
+		r.Get("/", rootIndexHandler)
+		r.Post("/records/", recordsCreateHandler)
+		r.Get("/records/:key", recordsReadHandler)
+		r.Get("/export/hosts.txt", exportHostsHandler)
+		r.Get("/api/records/", apiRecordsIndexHandler)
+		r.Get("/api/records/:key", apiRecordsReadHandler)
+		r.Put("/api/records/:key", apiRecordsUpdateHandler)
+		r.Delete("/api/records/:key", apiRecordsDeleteHandler)
+		r.Get("/api/settings/", apiSettingsReadHandler)
+		r.Put("/api/settings/", apiSettingsUpdateHandler)
+		r.Get("/allowlist/", allowlistIndexHandler)
+		r.Post("/allowlist/", allowlistCreateHandler)
+		r.Get("/api/allowlist/", apiAllowlistIndexHandler)
+		r.Get("/api/allowlist/:key", apiAllowlistReadHandler)
+		r.Put("/api/allowlist/:key", apiAllowlistUpdateHandler)
+		r.Delete("/api/allowlist/:key", apiAllowlistDeleteHandler)
+		r.Get("/subscriptions/", subscriptionsIndexHandler)
+		r.Post("/subscriptions/", subscriptionsCreateHandler)
+		r.Get("/api/subscriptions/", apiSubscriptionsIndexHandler)
+		r.Get("/api/subscriptions/:name", apiSubscriptionsReadHandler)
+		r.Put("/api/subscriptions/:name", apiSubscriptionsUpdateHandler)
+		r.Delete("/api/subscriptions/:name", apiSubscriptionsDeleteHandler)
+		r.Post("/api/subscriptions/:name/refresh", apiSubscriptionsRefreshHandler)
+		r.Get("/groups/", groupsIndexHandler)
+		r.Post("/groups/", groupsCreateHandler)
+		r.Get("/api/groups/", apiGroupsIndexHandler)
+		r.Get("/api/groups/:name", apiGroupsReadHandler)
+		r.Put("/api/groups/:name", apiGroupsUpdateHandler)
+		r.Delete("/api/groups/:name", apiGroupsDeleteHandler)
+		r.Get("/api/ipblacklist/", apiIPBlacklistIndexHandler)
+		r.Get("/api/ipblacklist/*", apiIPBlacklistReadHandler)
+		r.Put("/api/ipblacklist/*", apiIPBlacklistUpdateHandler)
+		r.Delete("/api/ipblacklist/*", apiIPBlacklistDeleteHandler)
+		r.Get("/localrecords/", localRecordsIndexHandler)
+		r.Post("/localrecords/", localRecordsCreateHandler)
+		r.Get("/api/localrecords/", apiLocalRecordsIndexHandler)
+		r.Get("/api/localrecords/:name", apiLocalRecordsReadHandler)
+		r.Put("/api/localrecords/:name", apiLocalRecordsUpdateHandler)
+		r.Delete("/api/localrecords/:name", apiLocalRecordsDeleteHandler)
+		r.Get("/api/rules/", apiRulesIndexHandler)
+		r.Post("/api/rules/", apiRulesCreateHandler)
+		r.Get("/api/rules/:id", apiRulesReadHandler)
+		r.Delete("/api/rules/:id", apiRulesDeleteHandler)
+		r.Get("/querylog/", queryLogIndexHandler)
+		r.Get("/api/querylog", apiQueryLogIndexHandler)
+		r.Get("/api/stats", apiStatsHandler)
+		r.Get("/api/upstreams/", apiUpstreamsIndexHandler)
+		r.Get("/api/cache/", apiCacheReadHandler)
+		r.Delete("/api/cache/", apiCacheDeleteHandler)
+		r.Get("/css/nogo.css", cssHandler)
+
+		if *metricsAddr == "" && !*metricsPublic {
+			r.Get("/metrics", metricsHandler)
+		}
+	})
 
 	// Initialize/start the servers
 	log.Println("Booting up nogo...")
 
-	for _, n := range strings.Split(*dnsNet, "+") {
-		dnsServers = append(dnsServers, &dns.Server{Addr: *dnsAddr, Net: n, Handler: dns.HandlerFunc(dnsHandler)})
-
+	if dnsServers, err = newDNSServers(*dnsNet); err != nil {
+		log.Fatalf("newDNSServers(%s) Error: %s\n", *dnsNet, err)
+	}
+	for _, s := range dnsServers {
 		wg.Add(1)
 		go func(s *dns.Server) {
 			defer wg.Done()
 			if err := s.ListenAndServe(); err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
 				log.Fatal(err)
 			}
-		}(dnsServers[len(dnsServers)-1])
+		}(s)
+		log.Printf("DNS proxy listening at: %s (%s)\n", s.Addr, s.Net)
 	}
-	log.Printf("DNS proxy listening at: %s (%s)\n", *dnsAddr, *dnsNet)
 
 	if *webOff != true {
 		httpServer = &http.Server{Addr: *webAddr, Handler: r}
@@ -144,28 +455,64 @@ func main() {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			var err error
+
+			if *webTLSCert != "" || *webTLSKey != "" {
+				err = httpServer.ListenAndServeTLS(*webTLSCert, *webTLSKey)
+			} else {
+				err = httpServer.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
 				log.Fatal(err)
 			}
 		}()
 		log.Printf("Web control panel/API listening at: %s\n", *webAddr)
 	}
 
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", metricsHandler)
+		metricsServer = &http.Server{Addr: *metricsAddr, Handler: mux}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		log.Printf("Prometheus metrics listening at: %s\n", *metricsAddr)
+	}
+
 	// Attempt to gracefully shut down when signaled
 	sig := make(chan os.Signal)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	s := <-sig
 	fmt.Printf("Signal (%s) received, shutting down... ", s)
 
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	if *webOff != true {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
 		httpServer.Shutdown(ctx)
 	}
+	if metricsServer != nil {
+		metricsServer.Shutdown(ctx)
+	}
 	for _, s := range dnsServers {
 		s.Shutdown()
 	}
 
 	wg.Wait() // Wait on goroutines
+
+	if err := ruleSet.flush(); err != nil {
+		log.Printf("ruleSet.flush() Error: %s\n", err)
+	}
+	if err := recordHits.flush(); err != nil {
+		log.Printf("recordHits.flush() Error: %s\n", err)
+	}
+	if err := queryLog.flush(); err != nil {
+		log.Printf("queryLog.flush() Error: %s\n", err)
+	}
 	fmt.Println("Done!")
 }
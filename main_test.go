@@ -1,18 +1,32 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/miekg/dns"
 )
 
+// testTime is the time records are stamped with in the tests
+var testTime = time.Date(2017, 2, 24, 0, 0, 0, 0, time.UTC)
+
+// testStamps are the JSON encoded timestamps of records stored in the tests
+const testStamps = `,"created":"2017-02-24T00:00:00Z","updated":"2017-02-24T00:00:00Z"`
+
 func TestMain(m *testing.M) {
+	timeNow = func() time.Time { return testTime }
 	db = MustOpenDB()
 	exitVal := m.Run()
 	db.MustClose()
@@ -56,19 +70,27 @@ func MustOpenDB() *DB {
 }
 
 func (db *DB) Reset() {
-	db.Update(func(tx *bolt.Tx) error {
-		// Delete bucket
-		tx.DeleteBucket(blacklistKey)
-		return nil
-	})
-
-	if err := db.Update(func(tx *bolt.Tx) error {
-		// Create bucket
-		_, err := tx.CreateBucket(blacklistKey)
-		return err
-	}); err != nil {
+	for _, key := range [][]byte{blacklistKey, allowlistKey, subscriptionsKey, rulesKey, queryLogKey, groupsKey, settingsKey, localRecordsKey, ipBlacklistKey} {
+		db.Update(func(tx *bolt.Tx) error {
+			// Delete bucket
+			tx.DeleteBucket(key)
+			return nil
+		})
+
+		if err := db.Update(func(tx *bolt.Tx) error {
+			// Create bucket
+			_, err := tx.CreateBucket(key)
+			return err
+		}); err != nil {
+			panic(err)
+		}
+	}
+
+	// Drop the compiled pattern rules and client groups
+	if err := ruleSet.load(); err != nil {
 		panic(err)
 	}
+	groupSet.load()
 }
 
 func (db *DB) MustClose() {
@@ -79,6 +101,13 @@ func (db *DB) MustClose() {
 	}
 }
 
+// stamped returns the passed record with the created and updated times of the
+// records stored in the tests.
+func stamped(r Record) Record {
+	r.Created, r.Updated = &testTime, &testTime
+	return r
+}
+
 func testEqual(t *testing.T, msg string, args ...interface{}) bool {
 	if !reflect.DeepEqual(args[len(args)-2], args[len(args)-1]) {
 		t.Errorf(msg, args...)
@@ -86,3 +115,64 @@ func testEqual(t *testing.T, msg string, args ...interface{}) bool {
 	}
 	return true
 }
+
+func Test_newDNSServers(t *testing.T) {
+	ss, err := newDNSServers("udp+tcp")
+	if err != nil {
+		t.Fatalf("failed to create servers: %+v", err)
+	}
+	testEqual(t, "len(newDNSServers(udp+tcp)) = %+v, want %+v", len(ss), 2)
+	testEqual(t, "newDNSServers(udp+tcp)[0].Net = %+v, want %+v", ss[0].Net, "udp")
+	testEqual(t, "newDNSServers(udp+tcp)[1].Net = %+v, want %+v", ss[1].Net, "tcp")
+	testEqual(t, "newDNSServers(udp+tcp)[1].Addr = %+v, want %+v", ss[1].Addr, ":53")
+
+	// Missing certificate
+	_, err = newDNSServers("udp+tls")
+	testEqual(t, "newDNSServers(udp+tls) err = %+v, want %+v", err != nil, true)
+
+	// Write out a certificate and key
+	pool, cert := MustTestCertificate("dns.test")
+	dir, err := ioutil.TempDir("", "nogo-tls-")
+	if err != nil {
+		t.Fatalf("failed to create TempDir: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	*dnsTLSCert = filepath.Join(dir, "cert.pem")
+	*dnsTLSKey = filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(*dnsTLSCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	ioutil.WriteFile(*dnsTLSKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	*dnsTLSAddr = "127.0.0.1:0"
+	defer func() { *dnsTLSCert, *dnsTLSKey, *dnsTLSAddr = "", "", ":853" }()
+
+	ss, err = newDNSServers("udp+tcp+tls")
+	if err != nil {
+		t.Fatalf("failed to create servers: %+v", err)
+	}
+	testEqual(t, "len(newDNSServers(udp+tcp+tls)) = %+v, want %+v", len(ss), 3)
+	testEqual(t, "newDNSServers(udp+tcp+tls)[2].Net = %+v, want %+v", ss[2].Net, "tcp-tls")
+	testEqual(t, "newDNSServers(udp+tcp+tls)[2].Addr = %+v, want %+v", ss[2].Addr, "127.0.0.1:0")
+
+	// Query the DNS over TLS listener
+	db.Reset()
+	if err := db.put("test.disallowed", &Record{}); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+
+	s := ss[2]
+	waitLock := sync.Mutex{}
+	waitLock.Lock()
+	s.NotifyStartedFunc = waitLock.Unlock
+	go s.ListenAndServe()
+	waitLock.Lock()
+	defer s.Shutdown()
+
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: "dns.test", RootCAs: pool}}
+	m := new(dns.Msg)
+	m.SetQuestion("test.disallowed.", dns.TypeA)
+	r, _, err := c.Exchange(m, s.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to exchange: %+v", err)
+	}
+	testEqual(t, "Disallowed Rcode = %+v, want %+v", r.Rcode, dns.RcodeNameError)
+}
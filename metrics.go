@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricsContentType is the media type of the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// QueryMetrics represents the query counters exposed to Prometheus, by query
+// type, decision and response code
+type QueryMetrics struct {
+	mu     sync.Mutex
+	counts map[queryMetricKey]uint64
+}
+
+type queryMetricKey struct {
+	qtype    string
+	decision string
+	rcode    string
+}
+
+func newQueryMetrics() *QueryMetrics {
+	return &QueryMetrics{counts: make(map[queryMetricKey]uint64)}
+}
+
+// add counts the passed (answered) query.
+func (qm *QueryMetrics) add(e *QueryLogEntry) {
+	qm.mu.Lock()
+	qm.counts[queryMetricKey{e.Type, e.Decision, e.Rcode}]++
+	qm.mu.Unlock()
+}
+
+// write writes the query counters (sorted by their labels).
+func (qm *QueryMetrics) write(w io.Writer) {
+	qm.mu.Lock()
+	keys := make([]queryMetricKey, 0, len(qm.counts))
+	for k := range qm.counts {
+		keys = append(keys, k)
+	}
+	counts := make([]uint64, len(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.qtype != b.qtype {
+			return a.qtype < b.qtype
+		}
+		if a.decision != b.decision {
+			return a.decision < b.decision
+		}
+		return a.rcode < b.rcode
+	})
+	for i, k := range keys {
+		counts[i] = qm.counts[k]
+	}
+	qm.mu.Unlock()
+
+	writeMetricHeader(w, "nogo_queries_total", "counter", "DNS queries answered, by query type, decision and response code.")
+	for i, k := range keys {
+		fmt.Fprintf(w, "nogo_queries_total{type=\"%s\",decision=\"%s\",rcode=\"%s\"} %d\n", escapeLabelValue(k.qtype), escapeLabelValue(k.decision), escapeLabelValue(k.rcode), counts[i])
+	}
+}
+
+// writeMetrics writes all of the metrics in the Prometheus text exposition
+// format.
+func writeMetrics(w io.Writer) error {
+	queryMetrics.write(w)
+
+	// Upstreams
+	pool := currentUpstreams()
+	writeMetricHeader(w, "nogo_upstream_latency_seconds", "histogram", "Latency of successful upstream DNS queries.")
+	for _, l := range pool.latencies() {
+		addr := escapeLabelValue(l.Addr)
+		for i, bound := range upstreamLatencyBuckets {
+			fmt.Fprintf(w, "nogo_upstream_latency_seconds_bucket{upstream=\"%s\",le=\"%s\"} %d\n", addr, formatMetricValue(bound), l.Buckets[i])
+		}
+		fmt.Fprintf(w, "nogo_upstream_latency_seconds_bucket{upstream=\"%s\",le=\"+Inf\"} %d\n", addr, l.Count)
+		fmt.Fprintf(w, "nogo_upstream_latency_seconds_sum{upstream=\"%s\"} %s\n", addr, formatMetricValue(l.Sum))
+		fmt.Fprintf(w, "nogo_upstream_latency_seconds_count{upstream=\"%s\"} %d\n", addr, l.Count)
+	}
+
+	ss := pool.status()
+	writeMetricHeader(w, "nogo_upstream_queries_total", "counter", "Queries sent to each upstream DNS server.")
+	for _, s := range ss {
+		fmt.Fprintf(w, "nogo_upstream_queries_total{upstream=\"%s\"} %d\n", escapeLabelValue(s.Addr), s.Queries)
+	}
+	writeMetricHeader(w, "nogo_upstream_errors_total", "counter", "Failed queries to each upstream DNS server.")
+	for _, s := range ss {
+		fmt.Fprintf(w, "nogo_upstream_errors_total{upstream=\"%s\"} %d\n", escapeLabelValue(s.Addr), s.Errors)
+	}
+	writeMetricHeader(w, "nogo_upstream_up", "gauge", "Whether each upstream DNS server is up (1) or marked down (0).")
+	for _, s := range ss {
+		fmt.Fprintf(w, "nogo_upstream_up{upstream=\"%s\"} %d\n", escapeLabelValue(s.Addr), boolMetric(!s.Down))
+	}
+
+	// Cache
+	cs := dnsCache.stats()
+	writeMetricHeader(w, "nogo_cache_size", "gauge", "Maximum number of cached responses.")
+	fmt.Fprintf(w, "nogo_cache_size %d\n", cs.Size)
+	writeMetricHeader(w, "nogo_cache_entries", "gauge", "Number of cached responses.")
+	fmt.Fprintf(w, "nogo_cache_entries %d\n", cs.Entries)
+	writeMetricHeader(w, "nogo_cache_hits_total", "counter", "Queries answered from the cache.")
+	fmt.Fprintf(w, "nogo_cache_hits_total %d\n", cs.Hits)
+	writeMetricHeader(w, "nogo_cache_misses_total", "counter", "Queries which weren't answered from the cache.")
+	fmt.Fprintf(w, "nogo_cache_misses_total %d\n", cs.Misses)
+
+	// Blacklist
+	keyCount, err := db.keyCount()
+	if err != nil {
+		return err
+	}
+	writeMetricHeader(w, "nogo_blacklist_records", "gauge", "Number of blacklist records.")
+	fmt.Fprintf(w, "nogo_blacklist_records %d\n", keyCount)
+
+	isDisabledMu.Lock()
+	disabled := isDisabled
+	isDisabledMu.Unlock()
+	writeMetricHeader(w, "nogo_disabled", "gauge", "Whether blocking is disabled (1) or enabled (0).")
+	fmt.Fprintf(w, "nogo_disabled %d\n", boolMetric(disabled))
+
+	return nil
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// escapeLabelValue escapes the backslashes, double quotes and line feeds of the
+// passed label value.
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func formatMetricValue(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestQueryMetrics_write(t *testing.T) {
+	qm := newQueryMetrics()
+	qm.add(&QueryLogEntry{Type: "AAAA", Decision: decisionAllowed, Rcode: "NOERROR"})
+	qm.add(&QueryLogEntry{Type: "A", Decision: decisionBlocked, Rcode: "NXDOMAIN"})
+	qm.add(&QueryLogEntry{Type: "A", Decision: decisionBlocked, Rcode: "NXDOMAIN"})
+	qm.add(&QueryLogEntry{Type: "A", Decision: decisionAllowed, Rcode: "NOERROR"})
+
+	var buf bytes.Buffer
+	qm.write(&buf)
+	testEqual(t, "write() = %+v, want %+v", buf.String(), `# HELP nogo_queries_total DNS queries answered, by query type, decision and response code.
+# TYPE nogo_queries_total counter
+nogo_queries_total{type="A",decision="allowed",rcode="NOERROR"} 1
+nogo_queries_total{type="A",decision="blocked",rcode="NXDOMAIN"} 2
+nogo_queries_total{type="AAAA",decision="allowed",rcode="NOERROR"} 1
+`)
+}
+
+func Test_writeMetrics(t *testing.T) {
+	db.Reset()
+	upstreams = MustNewUpstreamPool([]string{"127.0.0.1:53"}, strategySequential)
+	defer func() { upstreams = &UpstreamPool{strategy: strategySequential} }()
+
+	if err := db.put("test.test", nil); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+
+	var buf bytes.Buffer
+	err := writeMetrics(&buf)
+	testEqual(t, "writeMetrics() err = %+v, want %+v", err, nil)
+
+	for _, line := range []string{
+		"# TYPE nogo_upstream_latency_seconds histogram",
+		`nogo_upstream_latency_seconds_bucket{upstream="127.0.0.1:53",le="0.001"} 0`,
+		`nogo_upstream_latency_seconds_bucket{upstream="127.0.0.1:53",le="+Inf"} 0`,
+		`nogo_upstream_errors_total{upstream="127.0.0.1:53"} 0`,
+		`nogo_upstream_up{upstream="127.0.0.1:53"} 1`,
+		"nogo_cache_hits_total 0",
+		"nogo_blacklist_records 1",
+		"nogo_disabled 0",
+	} {
+		testEqual(t, "writeMetrics() contains "+line+" = %+v, want %+v", strings.Contains(buf.String(), line+"\n"), true)
+	}
+}
+
+func Test_escapeLabelValue(t *testing.T) {
+	testEqual(t, "escapeLabelValue() = %+v, want %+v", escapeLabelValue("a\\b\"c\nd"), `a\\b\"c\nd`)
+}
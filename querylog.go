@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	queryLogFlushInterval = time.Second
+	queryLogPruneInterval = time.Minute
+	maxPendingQueryLog    = 10000 // Entries buffered between flushes
+	defaultQueryLogLimit  = 100
+	maxQueryLogLimit      = 1000
+)
+
+// QueryLogEntry represents a logged DNS query
+type QueryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Group    string    `json:"group,omitempty"` // Client group
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Decision string    `json:"decision"`
+	Rule     string    `json:"rule,omitempty"`     // Record, allowlisted domain or pattern rule
+	CNAME    string    `json:"cname,omitempty"`    // CNAME target which was blocked (if cloaked)
+	Upstream string    `json:"upstream,omitempty"` // Upstream server which answered
+	Latency  float64   `json:"latencyMs"`
+	Rcode    string    `json:"rcode"`
+}
+
+// QueryLogFilter represents a query log search
+type QueryLogFilter struct {
+	Client   string // Exact client IP
+	Name     string // Part of a name
+	Decision string // Exact decision
+}
+
+// QueryLog represents the query log, which buffers entries in memory and
+// periodically writes them to the database (and, less often, drops those older
+// than the retention period)
+type QueryLog struct {
+	mu        sync.Mutex
+	retention time.Duration
+	pending   []*QueryLogEntry
+}
+
+// newQueryLog returns a query log keeping entries for the passed duration. A
+// retention of 0 disables the query log.
+func newQueryLog(retention time.Duration) *QueryLog {
+	return &QueryLog{retention: retention}
+}
+
+// recordQuery records the passed (answered) query in the query log, the
+// statistics and the metrics.
+func recordQuery(e *QueryLogEntry) {
+	queryLog.add(e)
+	queryStats.add(e)
+	queryMetrics.add(e)
+}
+
+// add buffers the passed entry until the next flush.
+func (ql *QueryLog) add(e *QueryLogEntry) {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+
+	if ql.retention <= 0 {
+		return
+	}
+
+	if len(ql.pending) >= maxPendingQueryLog {
+		// Drop the oldest entry, rather than growing without bound
+		ql.pending = ql.pending[1:]
+	}
+	ql.pending = append(ql.pending, e)
+}
+
+// flush writes the buffered entries to the database.
+func (ql *QueryLog) flush() error {
+	ql.mu.Lock()
+	pending := ql.pending
+	ql.pending = nil
+	ql.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	return db.appendQueryLog(pending)
+}
+
+// prune drops the entries older than the retention period from the database.
+func (ql *QueryLog) prune() (int, error) {
+	if ql.retention <= 0 {
+		return 0, nil
+	}
+
+	return db.pruneQueryLog(time.Now().Add(-ql.retention))
+}
+
+// search returns the newest entries (at most limit) matching the passed filter.
+// Expired entries which haven't been pruned yet are skipped.
+func (ql *QueryLog) search(f QueryLogFilter, limit int) ([]*QueryLogEntry, error) {
+	// Include the buffered entries
+	if err := ql.flush(); err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-ql.retention)
+	return db.searchQueryLog(func(e *QueryLogEntry) bool {
+		return !e.Time.Before(cutoff) && f.match(e)
+	}, limit)
+}
+
+// scheduleQueryLogFlushes periodically flushes the query log.
+func scheduleQueryLogFlushes() {
+	for {
+		time.Sleep(queryLogFlushInterval)
+
+		if err := queryLog.flush(); err != nil {
+			log.Printf("queryLog.flush() Error: %s\n", err)
+		}
+	}
+}
+
+// scheduleQueryLogPrunes periodically prunes the query log.
+func scheduleQueryLogPrunes() {
+	for {
+		time.Sleep(queryLogPruneInterval)
+
+		if _, err := queryLog.prune(); err != nil {
+			log.Printf("queryLog.prune() Error: %s\n", err)
+		}
+	}
+}
+
+// match checks the passed entry against the filter.
+func (f QueryLogFilter) match(e *QueryLogEntry) bool {
+	if f.Client != "" && e.Client != f.Client {
+		return false
+	}
+
+	if f.Name != "" && !strings.Contains(e.Name, strings.ToLower(f.Name)) {
+		return false
+	}
+
+	if f.Decision != "" && e.Decision != f.Decision {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryLog_add(t *testing.T) {
+	// Disabled
+	ql := newQueryLog(0)
+	ql.add(&QueryLogEntry{Name: "test.test"})
+	testEqual(t, "len(pending) = %+v, want %+v", len(ql.pending), 0)
+
+	ql = newQueryLog(time.Hour)
+	for i := 0; i < maxPendingQueryLog+1; i++ {
+		ql.add(&QueryLogEntry{Latency: float64(i)})
+	}
+	testEqual(t, "len(pending) = %+v, want %+v", len(ql.pending), maxPendingQueryLog)
+	testEqual(t, "pending[0].Latency = %+v, want %+v", ql.pending[0].Latency, float64(1))
+}
+
+func TestQueryLog_flush_search(t *testing.T) {
+	db.Reset()
+
+	now := time.Now().UTC()
+	ql := newQueryLog(time.Hour)
+	ql.add(&QueryLogEntry{Time: now.Add(-2 * time.Hour), Client: "10.0.0.1", Name: "expired.test", Decision: decisionAllowed})
+	ql.add(&QueryLogEntry{Time: now.Add(-time.Minute), Client: "10.0.0.1", Name: "ads.example.test", Decision: decisionBlocked})
+	ql.add(&QueryLogEntry{Time: now, Client: "10.0.0.2", Name: "www.example.test", Decision: decisionAllowed})
+	ql.add(&QueryLogEntry{Time: now, Client: "10.0.0.2", Name: "other.test", Decision: decisionCached})
+
+	entries, err := ql.search(QueryLogFilter{}, 10)
+	testEqual(t, "search() err = %+v, want %+v", err, nil)
+	testEqual(t, "len(pending) = %+v, want %+v", len(ql.pending), 0)
+	testEqual(t, "len(search()) = %+v, want %+v", len(entries), 3)
+	testEqual(t, "search()[0].Name = %+v, want %+v", entries[0].Name, "other.test")
+
+	entries, _ = ql.search(QueryLogFilter{}, 1)
+	testEqual(t, "len(search(limit)) = %+v, want %+v", len(entries), 1)
+
+	entries, _ = ql.search(QueryLogFilter{Name: "Example"}, 10)
+	testEqual(t, "len(search(name)) = %+v, want %+v", len(entries), 2)
+
+	entries, _ = ql.search(QueryLogFilter{Client: "10.0.0.1"}, 10)
+	testEqual(t, "len(search(client)) = %+v, want %+v", len(entries), 1)
+	testEqual(t, "search(client)[0].Name = %+v, want %+v", entries[0].Name, "ads.example.test")
+
+	entries, _ = ql.search(QueryLogFilter{Client: "10.0.0.2", Decision: decisionCached}, 10)
+	testEqual(t, "len(search(client, decision)) = %+v, want %+v", len(entries), 1)
+	testEqual(t, "search(client, decision)[0].Name = %+v, want %+v", entries[0].Name, "other.test")
+}
+
+func TestQueryLog_prune(t *testing.T) {
+	db.Reset()
+
+	now := time.Now().UTC()
+	ql := newQueryLog(time.Hour)
+	testEqual(t, "flush() = %+v, want %+v", ql.flush(), nil)
+
+	ql.add(&QueryLogEntry{Time: now.Add(-2 * time.Hour), Name: "expired.test"})
+	ql.add(&QueryLogEntry{Time: now, Name: "www.example.test"})
+	testEqual(t, "flush() = %+v, want %+v", ql.flush(), nil)
+
+	n, err := ql.prune()
+	testEqual(t, "prune() err = %+v, want %+v", err, nil)
+	testEqual(t, "prune() = %+v, want %+v", n, 1)
+
+	entries, _ := db.searchQueryLog(func(*QueryLogEntry) bool { return true }, 10)
+	testEqual(t, "len(searchQueryLog()) = %+v, want %+v", len(entries), 1)
+	testEqual(t, "searchQueryLog()[0].Name = %+v, want %+v", entries[0].Name, "www.example.test")
+
+	// Disabled
+	n, _ = newQueryLog(0).prune()
+	testEqual(t, "prune() = %+v, want %+v", n, 0)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rebindNetworks are the address ranges which upstream answers for public names
+// shouldn't point at (see filterRebinding).
+var rebindNetworks = parseNetworks(
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7", // Private
+	"0.0.0.0/8", "::/128", // Unspecified ("this network")
+	"127.0.0.0/8", "::1/128", // Loopback
+	"169.254.0.0/16", "fe80::/10", // Link-local
+	"100.64.0.0/10", // CGNAT
+)
+
+// rebindLocalDomains are the domains used for names on the LAN, which are
+// always exempt from the rebinding protection (along with single label names).
+var rebindLocalDomains = map[string]bool{"lan": true, "local": true, "home.arpa": true, "internal": true}
+
+// filterRebinding rejects the passed upstream response (when enabled via
+// -dns-rebind-protection) if any of its A or AAAA answers point at a private,
+// loopback, link-local, CGNAT or unspecified address, as a public name doing so
+// may be used to attack devices on the LAN through a browser (DNS rebinding).
+// Local names (see isRebindExempt), names covered by a conditional forwarding
+// rule and the -dns-rebind-exempt domains (and their subdomains) are left
+// alone. Rejected responses are logged, and get the block response.
+func filterRebinding(r, m *dns.Msg, e *QueryLogEntry, g *Group) *dns.Msg {
+	if !*dnsRebind || isRebindExempt(e.Name) {
+		return m
+	}
+
+	for _, rr := range m.Answer {
+		var ip net.IP
+
+		switch a := rr.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		default:
+			continue
+		}
+
+		if isRebindAddr(ip) {
+			log.Printf("Rejected possible DNS rebinding answer for %s: %s\n", e.Name, ip)
+			e.Decision, e.Rule = decisionRebinding, ip.String()
+			return blockResponse(r, r.Question, groupBlockMode(g))
+		}
+	}
+
+	return m
+}
+
+// isRebindAddr checks whether the passed address is in one of the
+// rebindNetworks.
+func isRebindAddr(ip net.IP) bool {
+	for _, n := range rebindNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isRebindExempt checks whether the passed name (or one of its parent domains)
+// is exempt from the rebinding protection. Single label names, and names under
+// the rebindLocalDomains, are always exempt.
+func isRebindExempt(n string) bool {
+	if _, pool := currentForwards().match(n); pool != nil {
+		return true
+	}
+
+	n = strings.ToLower(strings.TrimSuffix(n, "."))
+	if n != "" && !strings.Contains(n, ".") {
+		return true
+	}
+
+	for n != "" {
+		if rebindExemptions[n] || rebindLocalDomains[n] {
+			return true
+		}
+
+		i := strings.IndexByte(n, '.')
+		if i < 0 {
+			break
+		}
+		n = n[i+1:]
+	}
+
+	return false
+}
+
+// parseNetworks parses the passed IP addresses and CIDR ranges, skipping any
+// which are neither.
+func parseNetworks(ss ...string) []*net.IPNet {
+	var ns []*net.IPNet
+
+	for _, s := range ss {
+		if n := parseClient(s); n != nil {
+			ns = append(ns, n)
+		}
+	}
+
+	return ns
+}
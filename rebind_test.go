@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_isRebindAddr(t *testing.T) {
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"100.128.0.1", false},
+		{"93.184.216.34", false},
+		{"::ffff:192.168.1.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"2001:db8::1", false},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"::", true},
+		{"::2", false},
+	} {
+		testEqual(t, "isRebindAddr("+tt.ip+") = %+v, want %+v", isRebindAddr(net.ParseIP(tt.ip)), tt.want)
+	}
+}
+
+func Test_isRebindExempt(t *testing.T) {
+	rebindExemptions = map[string]bool{"plex.direct": true}
+	defer func() { rebindExemptions = map[string]bool{} }()
+	forwards, _ = newForwardSet(map[string][]string{"corp.test": {"127.0.0.1:53"}})
+	defer func() { forwards = &ForwardSet{} }()
+
+	testEqual(t, "isRebindExempt('plex.direct') = %+v, want %+v", isRebindExempt("plex.direct."), true)
+	testEqual(t, "isRebindExempt('192-168-1-2.abc.Plex.direct') = %+v, want %+v", isRebindExempt("192-168-1-2.abc.Plex.direct."), true)
+	testEqual(t, "isRebindExempt('nas.corp.test') = %+v, want %+v", isRebindExempt("nas.corp.test"), true)
+	testEqual(t, "isRebindExempt('notplex.direct') = %+v, want %+v", isRebindExempt("notplex.direct."), false)
+	testEqual(t, "isRebindExempt('example.test') = %+v, want %+v", isRebindExempt("example.test."), false)
+
+	// Local names
+	for _, n := range []string{"nas.", "NAS", "nas.lan.", "printer.local.", "router.home.arpa.", "db.corp.internal."} {
+		testEqual(t, "isRebindExempt('"+n+"') = %+v, want %+v", isRebindExempt(n), true)
+	}
+	for _, n := range []string{".", "lan.example.test.", "example.localhost.", "notarpa.home."} {
+		testEqual(t, "isRebindExempt('"+n+"') = %+v, want %+v", isRebindExempt(n), false)
+	}
+}
+
+func Test_filterRebinding(t *testing.T) {
+	*dnsRebind = true
+	defer func() { *dnsRebind = false }()
+	rebindExemptions = map[string]bool{"plex.direct": true}
+	defer func() { rebindExemptions = map[string]bool{} }()
+
+	answer := func(name string, ips ...string) (*dns.Msg, *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, ip := range ips {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP(ip)})
+		}
+		return r, m
+	}
+
+	// Public addresses
+	r, m := answer("example.test.", "93.184.216.34")
+	e := &QueryLogEntry{Name: "example.test", Decision: decisionAllowed}
+	testEqual(t, "filterRebinding() = %+v, want %+v", filterRebinding(r, m, e, nil) == m, true)
+
+	// Any private address
+	r, m = answer("example.test.", "93.184.216.34", "192.168.1.1")
+	b := filterRebinding(r, m, e, nil)
+	testEqual(t, "filterRebinding() Rcode = %+v, want %+v", b.Rcode, dns.RcodeNameError)
+	testEqual(t, "len(filterRebinding().Answer) = %+v, want %+v", len(b.Answer), 0)
+	testEqual(t, "e = %+v, want %+v", []string{e.Decision, e.Rule}, []string{decisionRebinding, "192.168.1.1"})
+
+	// Exempt
+	r, m = answer("abc.plex.direct.", "192.168.1.2")
+	e = &QueryLogEntry{Name: "abc.plex.direct", Decision: decisionAllowed}
+	testEqual(t, "filterRebinding() = %+v, want %+v", filterRebinding(r, m, e, nil) == m, true)
+	testEqual(t, "e.Decision = %+v, want %+v", e.Decision, decisionAllowed)
+
+	// Local name
+	r, m = answer("nas.lan.", "192.168.1.3")
+	testEqual(t, "filterRebinding() = %+v, want %+v", filterRebinding(r, m, &QueryLogEntry{Name: "nas.lan"}, nil) == m, true)
+
+	// Unspecified address
+	r, m = answer("example.test.", "0.0.0.0")
+	testEqual(t, "filterRebinding() Rcode = %+v, want %+v", filterRebinding(r, m, &QueryLogEntry{Name: "example.test"}, nil).Rcode, dns.RcodeNameError)
+
+	// Unless enabled
+	*dnsRebind = false
+	r, m = answer("example.test.", "127.0.0.1")
+	testEqual(t, "filterRebinding() = %+v, want %+v", filterRebinding(r, m, &QueryLogEntry{Name: "example.test"}, nil) == m, true)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// recordHitFlushInterval is how often the record hit counters are persisted.
+const recordHitFlushInterval = time.Minute
+
+// RecordHits represents the record hit counters which are yet to be persisted,
+// so that the DNS path doesn't write to the database for every query
+type RecordHits struct {
+	mu   sync.Mutex
+	hits map[string]*recordHit
+}
+
+type recordHit struct {
+	count uint64
+	last  time.Time
+}
+
+func newRecordHits() *RecordHits {
+	return &RecordHits{hits: make(map[string]*recordHit)}
+}
+
+// add counts a hit of the record with the passed key at the passed time.
+func (rh *RecordHits) add(key string, t time.Time) {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	h, ok := rh.hits[key]
+	if !ok {
+		h = &recordHit{}
+		rh.hits[key] = h
+	}
+
+	h.count++
+	if t.After(h.last) {
+		h.last = t
+	}
+}
+
+// flush persists (and resets) the pending hit counters.
+func (rh *RecordHits) flush() error {
+	rh.mu.Lock()
+	hits := rh.hits
+	rh.hits = make(map[string]*recordHit)
+	rh.mu.Unlock()
+
+	if len(hits) == 0 {
+		return nil
+	}
+
+	return db.addRecordHits(hits)
+}
+
+// scheduleRecordHitFlushes periodically persists the record hit counters.
+func scheduleRecordHitFlushes() {
+	for {
+		time.Sleep(recordHitFlushInterval)
+
+		if err := recordHits.flush(); err != nil {
+			log.Printf("recordHits.flush() Error: %s\n", err)
+		}
+	}
+}
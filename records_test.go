@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordHits(t *testing.T) {
+	db.Reset()
+	db.put("hit.test", nil)
+
+	rh := newRecordHits()
+	t1 := testTime.Add(time.Minute)
+	t2 := t1.Add(time.Minute)
+	rh.add("hit.test", t2)
+	rh.add("hit.test", t1)
+	rh.add("deleted.test", t1)
+
+	testEqual(t, "flush() = %+v, want %+v", rh.flush(), nil)
+	testEqual(t, "len(hits) = %+v, want %+v", len(rh.hits), 0)
+	r, _ := db.get("hit.test")
+	testEqual(t, "get() = %+v, want %+v", *r, Record{Created: &testTime, Updated: &testTime, Hits: 2, LastHit: &t2})
+	_, err := db.get("deleted.test")
+	testEqual(t, "get() err = %+v, want %+v", err, errRecordNotFound)
+
+	// Accumulates, keeping the latest hit
+	rh.add("hit.test", t1)
+	rh.flush()
+	r, _ = db.get("hit.test")
+	testEqual(t, "get() = %+v, want %+v", *r, Record{Created: &testTime, Updated: &testTime, Hits: 3, LastHit: &t2})
+}
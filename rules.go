@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ruleFlushInterval is how often the rule match counters are persisted.
+const ruleFlushInterval = time.Minute
+
+var (
+	errRuleNotFound     = errors.New("rule not found")
+	errRuleEmpty        = errors.New("pattern is empty")
+	errRuleNoWildcards  = errors.New("glob pattern has no wildcards (add it as a record instead)")
+	errRuleInvalidGlob  = errors.New("glob pattern may only contain letters, digits, '-', '_', '.', '*' and '?'")
+	validGlobCharacters = regexp.MustCompile(`^[a-z0-9_.*?-]+$`)
+)
+
+// Rule represents a regular expression (/^ads?[0-9]*\./) or glob (*.tracking.*)
+// block rule
+type Rule struct {
+	ID      uint64    `json:"id"`
+	Pattern string    `json:"pattern"`
+	Hits    uint64    `json:"hits"`
+	LastHit time.Time `json:"lastHit"`
+}
+
+// RuleSet represents the compiled pattern rules, which are evaluated against
+// names without a matching record
+type RuleSet struct {
+	mu    sync.RWMutex
+	rules []*compiledRule
+}
+
+type compiledRule struct {
+	hits    uint64 // Accessed atomically (and first, for 64-bit alignment)
+	lastHit int64  // Unix nanoseconds, accessed atomically
+	id      uint64
+	pattern string
+	re      *regexp.Regexp
+}
+
+// compileRule compiles the passed pattern, which is either a regular
+// expression enclosed in slashes, or a glob where '*' matches any characters
+// (including dots) and '?' matches a single character. Patterns are matched
+// against lowercased names without the trailing dot.
+func compileRule(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, errRuleEmpty
+	}
+
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile(pattern[1 : len(pattern)-1])
+	}
+
+	if !validGlobCharacters.MatchString(pattern) {
+		return nil, errRuleInvalidGlob
+	}
+	if !strings.ContainsAny(pattern, "*?") {
+		return nil, errRuleNoWildcards
+	}
+
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+
+	return regexp.Compile("^" + expr + "$")
+}
+
+// load replaces the rule set with the rules stored in the database.
+func (rs *RuleSet) load() error {
+	var rules []*compiledRule
+
+	for _, r := range db.getRules() {
+		re, err := compileRule(r.Pattern)
+		if err != nil {
+			return err
+		}
+
+		rules = append(rules, newCompiledRule(r, re))
+	}
+
+	rs.mu.Lock()
+	rs.rules = rules
+	rs.mu.Unlock()
+
+	return nil
+}
+
+// add adds the passed (already stored) rule to the rule set.
+func (rs *RuleSet) add(r *Rule, re *regexp.Regexp) {
+	rs.mu.Lock()
+	rs.rules = append(rs.rules, newCompiledRule(r, re))
+	rs.mu.Unlock()
+}
+
+// remove removes the rule with the passed ID from the rule set.
+func (rs *RuleSet) remove(id uint64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for i, cr := range rs.rules {
+		if cr.id == id {
+			rs.rules = append(rs.rules[:i:i], rs.rules[i+1:]...)
+			return
+		}
+	}
+}
+
+// match checks the passed name against each of the rules (counting the hits),
+// returning the pattern of the first matching rule.
+func (rs *RuleSet) match(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	for _, cr := range rs.rules {
+		if cr.re.MatchString(name) {
+			atomic.AddUint64(&cr.hits, 1)
+			atomic.StoreInt64(&cr.lastHit, time.Now().UnixNano())
+			return cr.pattern
+		}
+	}
+
+	return ""
+}
+
+// get returns a snapshot of the rule with the passed ID.
+func (rs *RuleSet) get(id uint64) (*Rule, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	for _, cr := range rs.rules {
+		if cr.id == id {
+			return cr.rule(), nil
+		}
+	}
+
+	return nil, errRuleNotFound
+}
+
+// list returns a snapshot of the rules, including their current match counters.
+func (rs *RuleSet) list() []*Rule {
+	var rules = []*Rule{}
+
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	for _, cr := range rs.rules {
+		rules = append(rules, cr.rule())
+	}
+
+	return rules
+}
+
+// flush persists the match counters of the rules.
+func (rs *RuleSet) flush() error {
+	return db.updateRuleHits(rs.list())
+}
+
+// scheduleRuleFlushes periodically persists the rule match counters.
+func scheduleRuleFlushes() {
+	for {
+		time.Sleep(ruleFlushInterval)
+
+		if err := ruleSet.flush(); err != nil {
+			log.Printf("ruleSet.flush() Error: %s\n", err)
+		}
+	}
+}
+
+func newCompiledRule(r *Rule, re *regexp.Regexp) *compiledRule {
+	cr := &compiledRule{hits: r.Hits, id: r.ID, pattern: r.Pattern, re: re}
+	if !r.LastHit.IsZero() {
+		cr.lastHit = r.LastHit.UnixNano()
+	}
+
+	return cr
+}
+
+func (cr *compiledRule) rule() *Rule {
+	r := &Rule{ID: cr.id, Pattern: cr.pattern, Hits: atomic.LoadUint64(&cr.hits)}
+	if n := atomic.LoadInt64(&cr.lastHit); n != 0 {
+		r.LastHit = time.Unix(0, n).UTC()
+	}
+
+	return r
+}
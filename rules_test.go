@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_compileRule(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		match   []string
+		nomatch []string
+		err     error
+	}{
+		{`/^ad[s]?[0-9]*\./`, []string{"ad.test", "ads2.example.test"}, []string{"bad.test", "adx.test"}, nil},
+		{"*.tracking.*", []string{"a.tracking.test", "x.y.tracking.example.test"}, []string{"tracking.test", "a.tracking"}, nil},
+		{"ad?.test", []string{"ads.test", "ad1.test"}, []string{"ad.test", "x.ads.test"}, nil},
+		{"", nil, nil, errRuleEmpty},
+		{"ads.test", nil, nil, errRuleNoWildcards},
+		{"ads.(test)*", nil, nil, errRuleInvalidGlob},
+		{"Ads*", nil, nil, errRuleInvalidGlob},
+	} {
+		re, err := compileRule(tt.pattern)
+		testEqual(t, "compileRule("+tt.pattern+") err = %+v, want %+v", err, tt.err)
+		for _, n := range tt.match {
+			testEqual(t, "compileRule("+tt.pattern+").MatchString("+n+") = %+v, want %+v", re.MatchString(n), true)
+		}
+		for _, n := range tt.nomatch {
+			testEqual(t, "compileRule("+tt.pattern+").MatchString("+n+") = %+v, want %+v", re.MatchString(n), false)
+		}
+	}
+
+	// Invalid regular expression
+	_, err := compileRule("/ad[s/")
+	testEqual(t, "compileRule(/ad[s/) err = %+v, want %+v", err != nil, true)
+}
+
+func TestRuleSet(t *testing.T) {
+	db.Reset()
+
+	rs := &RuleSet{}
+	for _, p := range []string{"ads.*", "/^tracker[0-9]+\\./"} {
+		r := &Rule{Pattern: p}
+		if err := db.putRule(r); err != nil {
+			t.Errorf("failed to putRule: %+v", err)
+		}
+		re, _ := compileRule(p)
+		rs.add(r, re)
+	}
+
+	testEqual(t, "match('ads.test') = %+v, want %+v", rs.match("Ads.test."), "ads.*")
+	testEqual(t, "match('ads.example.test') = %+v, want %+v", rs.match("ads.example.test"), "ads.*")
+	testEqual(t, "match('tracker1.test') = %+v, want %+v", rs.match("tracker1.test"), "/^tracker[0-9]+\\./")
+	testEqual(t, "match('example.test') = %+v, want %+v", rs.match("example.test"), "")
+
+	rules := rs.list()
+	testEqual(t, "len(list()) = %+v, want %+v", len(rules), 2)
+	testEqual(t, "list()[0].Hits = %+v, want %+v", rules[0].Hits, uint64(2))
+	testEqual(t, "list()[0].LastHit = %+v, want %+v", rules[0].LastHit.IsZero(), false)
+	testEqual(t, "list()[1].Hits = %+v, want %+v", rules[1].Hits, uint64(1))
+
+	r, err := rs.get(rules[1].ID)
+	testEqual(t, "get() = %+v, want %+v", r, rules[1])
+	testEqual(t, "get() err = %+v, want %+v", err, nil)
+
+	// Counters are persisted
+	if err := rs.flush(); err != nil {
+		t.Errorf("failed to flush: %+v", err)
+	}
+	rs = &RuleSet{}
+	if err := rs.load(); err != nil {
+		t.Errorf("failed to load: %+v", err)
+	}
+	testEqual(t, "list() = %+v, want %+v", rs.list(), rules)
+
+	rs.remove(rules[0].ID)
+	testEqual(t, "match('ads.test') = %+v, want %+v", rs.match("ads.test"), "")
+	_, err = rs.get(rules[0].ID)
+	testEqual(t, "get() err = %+v, want %+v", err, errRuleNotFound)
+}
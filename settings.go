@@ -0,0 +1,315 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Setting keys
+var (
+	settingDisabled  = []byte("disabled")
+	settingBlockMode = []byte("blockMode")
+	settingUpstreams = []byte("upstreams")
+	settingForwards  = []byte("forwards")
+
+	settingRecordsVersion = []byte("recordsVersion") // See migrateRecords
+)
+
+// Settings represents the effective runtime changeable settings (which start
+// out as their command line flags, until changed via the API)
+type Settings struct {
+	Disabled      bool       `json:"disabled"`
+	DisabledUntil *time.Time `json:"disabledUntil,omitempty"`
+	BlockMode     string     `json:"blockMode"`
+	Upstreams     []string   `json:"upstreams"`
+	Strategy      string     `json:"strategy"`
+
+	// Conditional forwarding rules (upstream addresses, by domain or CIDR)
+	Forwards map[string][]string `json:"forwards"`
+}
+
+// upstreamsSetting represents the persisted upstream servers
+type upstreamsSetting struct {
+	Addrs    []string `json:"addrs"`
+	Strategy string   `json:"strategy"`
+}
+
+// disabledSetting represents the persisted disabled state
+type disabledSetting struct {
+	Disabled bool      `json:"disabled"`
+	Until    time.Time `json:"until"` // Zero if disabled indefinitely
+}
+
+// disableTimer re-enables nogo once a timed disable expires (guarded by
+// isDisabledMu).
+var disableTimer *time.Timer
+
+// persistDisabledMu serializes persisting the disabled state, which happens
+// after releasing isDisabledMu (see persistDisabled and updateSettings).
+var persistDisabledMu sync.Mutex
+
+// disabledState returns whether nogo is disabled, and until when (zero if
+// indefinitely).
+func disabledState() (bool, time.Time) {
+	isDisabledMu.Lock()
+	defer isDisabledMu.Unlock()
+
+	return isDisabled, disabledUntil
+}
+
+// setDisabled disables (or enables) nogo and persists the state. A disable
+// with a positive duration is automatically undone once it expires.
+func setDisabled(disabled bool, d time.Duration) error {
+	s := newDisabledSetting(disabled, d)
+	return updateSettings(settingsUpdate{disabled: &s})
+}
+
+// newDisabledSetting returns the disabled state for a disable (or enable)
+// lasting the passed duration (indefinitely if not positive).
+func newDisabledSetting(disabled bool, d time.Duration) disabledSetting {
+	s := disabledSetting{Disabled: disabled}
+
+	if disabled && d > 0 {
+		s.Until = time.Now().Add(d).UTC().Truncate(time.Second)
+	}
+
+	return s
+}
+
+// loadDisabled restores the persisted disabled state (re-enabling nogo if a
+// timed disable expired while it wasn't running).
+func loadDisabled() error {
+	var s disabledSetting
+
+	if err := db.getSetting(settingDisabled, &s); err == errSettingNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if s.Disabled && !s.Until.IsZero() && !s.Until.After(time.Now()) {
+		s = disabledSetting{}
+	}
+
+	isDisabledMu.Lock()
+	applyDisabled(s.Disabled, s.Until)
+	isDisabledMu.Unlock()
+
+	return persistDisabled()
+}
+
+// applyDisabled sets the disabled state, stopping any scheduled re-enable and
+// scheduling a new one if until isn't zero. The caller must hold isDisabledMu,
+// and then persist the state (see persistDisabled) after releasing it.
+func applyDisabled(disabled bool, until time.Time) {
+	if disableTimer != nil {
+		disableTimer.Stop()
+		disableTimer = nil
+	}
+
+	isDisabled, disabledUntil = disabled, until
+
+	if !until.IsZero() {
+		disableTimer = time.AfterFunc(time.Until(until), func() {
+			isDisabledMu.Lock()
+			expired := isDisabled && disabledUntil.Equal(until) // Unless the state changed in the meantime
+			if expired {
+				applyDisabled(false, time.Time{})
+			}
+			isDisabledMu.Unlock()
+
+			if expired {
+				log.Println("Timed disable expired, re-enabling nogo")
+				if err := persistDisabled(); err != nil {
+					log.Printf("persistDisabled() Error: %s\n", err)
+				}
+			}
+		})
+	}
+}
+
+// persistDisabled persists the current disabled state. Persisting is
+// serialized, and reads the state afresh, so that the latest state is the one
+// left persisted.
+func persistDisabled() error {
+	persistDisabledMu.Lock()
+	defer persistDisabledMu.Unlock()
+
+	disabled, until := disabledState()
+	return db.putSetting(settingDisabled, disabledSetting{Disabled: disabled, Until: until})
+}
+
+// currentSettings returns a snapshot of the effective settings.
+func currentSettings() Settings {
+	var s Settings
+
+	var until time.Time
+	if s.Disabled, until = disabledState(); !until.IsZero() {
+		s.DisabledUntil = &until
+	}
+
+	blockModeMu.Lock()
+	s.BlockMode = blockMode
+	blockModeMu.Unlock()
+
+	pool := currentUpstreams()
+	s.Upstreams, s.Strategy = pool.addrs(), pool.strategy
+	s.Forwards = currentForwards().list()
+
+	return s
+}
+
+// settingsUpdate represents a (validated) change of the settings. Nil (or
+// empty) fields are left unchanged.
+type settingsUpdate struct {
+	blockMode string
+	upstreams *UpstreamPool
+	forwards  *ForwardSet
+	disabled  *disabledSetting
+}
+
+// updateSettings persists the passed changes in a single transaction, and only
+// then applies them, so that a failed update changes nothing. As answers from
+// the previous upstreams may differ, the cache is flushed if the upstream
+// servers or conditional forwarding rules change.
+func updateSettings(u settingsUpdate) error {
+	var settings = make(map[string]interface{})
+
+	if u.blockMode != "" {
+		settings[string(settingBlockMode)] = u.blockMode
+	}
+	if u.upstreams != nil {
+		settings[string(settingUpstreams)] = upstreamsSetting{Addrs: u.upstreams.addrs(), Strategy: u.upstreams.strategy}
+	}
+	if u.forwards != nil {
+		settings[string(settingForwards)] = u.forwards.rules
+	}
+	if u.disabled != nil {
+		settings[string(settingDisabled)] = *u.disabled
+	}
+
+	// Keep an expiring timed disable from persisting its state in between
+	persistDisabledMu.Lock()
+	defer persistDisabledMu.Unlock()
+
+	if err := db.putSettings(settings); err != nil {
+		u.close()
+		return err
+	}
+
+	if u.blockMode != "" {
+		blockModeMu.Lock()
+		blockMode = u.blockMode
+		blockModeMu.Unlock()
+	}
+
+	if u.upstreams != nil {
+		upstreamsMu.Lock()
+		old := upstreams
+		upstreams = u.upstreams
+		upstreamsMu.Unlock()
+
+		old.close()
+	}
+
+	if u.forwards != nil {
+		forwardsMu.Lock()
+		old := forwards
+		forwards = u.forwards
+		forwardsMu.Unlock()
+
+		old.close()
+	}
+
+	if u.upstreams != nil || u.forwards != nil {
+		dnsCache.flush()
+	}
+
+	if u.disabled != nil {
+		isDisabledMu.Lock()
+		applyDisabled(u.disabled.Disabled, u.disabled.Until)
+		isDisabledMu.Unlock()
+	}
+
+	return nil
+}
+
+// close closes the upstream servers of the update, when it isn't applied.
+func (u settingsUpdate) close() {
+	if u.upstreams != nil {
+		u.upstreams.close()
+	}
+	if u.forwards != nil {
+		u.forwards.close()
+	}
+}
+
+// setBlockMode changes (and persists) the block response mode.
+func setBlockMode(mode string) error {
+	return updateSettings(settingsUpdate{blockMode: mode})
+}
+
+// setUpstreams replaces (and persists) the upstream servers and their selection
+// strategy.
+func setUpstreams(addrs []string, strategy string) error {
+	pool, err := newUpstreamPool(addrs, strategy)
+	if err != nil {
+		return err
+	}
+
+	return updateSettings(settingsUpdate{upstreams: pool})
+}
+
+// setForwards replaces (and persists) the conditional forwarding rules.
+func setForwards(fs *ForwardSet) error {
+	return updateSettings(settingsUpdate{forwards: fs})
+}
+
+// loadSettings restores the settings which were changed via the API, which
+// take precedence over their command line flags.
+func loadSettings() error {
+	var mode string
+	var us upstreamsSetting
+	var rules map[string][]string
+
+	if err := loadDisabled(); err != nil {
+		return err
+	}
+
+	if err := db.getSetting(settingBlockMode, &mode); err == nil && isUsableBlockMode(mode) {
+		blockModeMu.Lock()
+		blockMode = mode
+		blockModeMu.Unlock()
+	} else if err != nil && err != errSettingNotFound {
+		return err
+	}
+
+	if err := db.getSetting(settingUpstreams, &us); err == nil && isValidStrategy(us.Strategy) {
+		pool, err := newUpstreamPool(us.Addrs, us.Strategy)
+		if err != nil {
+			return err
+		}
+
+		upstreamsMu.Lock()
+		upstreams = pool
+		upstreamsMu.Unlock()
+	} else if err != nil && err != errSettingNotFound {
+		return err
+	}
+
+	if err := db.getSetting(settingForwards, &rules); err == nil {
+		fs, err := newForwardSet(rules)
+		if err != nil {
+			return err
+		}
+
+		forwardsMu.Lock()
+		forwards = fs
+		forwardsMu.Unlock()
+	} else if err != errSettingNotFound {
+		return err
+	}
+
+	return nil
+}
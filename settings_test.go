@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_setDisabled(t *testing.T) {
+	db.Reset()
+	defer setDisabled(false, 0)
+
+	// Indefinitely
+	if err := setDisabled(true, 0); err != nil {
+		t.Errorf("failed to setDisabled: %+v", err)
+	}
+	disabled, until := disabledState()
+	testEqual(t, "disabledState() = %+v, want %+v", []interface{}{disabled, until.IsZero()}, []interface{}{true, true})
+
+	var s disabledSetting
+	db.getSetting(settingDisabled, &s)
+	testEqual(t, "getSetting() = %+v, want %+v", s, disabledSetting{Disabled: true})
+
+	// Timed, re-enabling automatically
+	if err := setDisabled(true, 10*time.Millisecond); err != nil {
+		t.Errorf("failed to setDisabled: %+v", err)
+	}
+	disabled, until = disabledState()
+	testEqual(t, "disabledState() = %+v, want %+v", []interface{}{disabled, until.IsZero()}, []interface{}{true, false})
+
+	time.Sleep(100 * time.Millisecond)
+	disabled, until = disabledState()
+	testEqual(t, "disabledState() = %+v, want %+v", []interface{}{disabled, until.IsZero()}, []interface{}{false, true})
+	db.getSetting(settingDisabled, &s)
+	testEqual(t, "getSetting() = %+v, want %+v", s, disabledSetting{})
+
+	// A timed disable is cancelled by enabling
+	setDisabled(true, time.Hour)
+	setDisabled(false, 0)
+	disabled, until = disabledState()
+	testEqual(t, "disabledState() = %+v, want %+v", []interface{}{disabled, until.IsZero()}, []interface{}{false, true})
+	testEqual(t, "disableTimer = %+v, want %+v", disableTimer == nil, true)
+
+	// A timed disable is replaced by disabling indefinitely
+	setDisabled(true, time.Hour)
+	setDisabled(true, 0)
+	disabled, until = disabledState()
+	testEqual(t, "disabledState() = %+v, want %+v", []interface{}{disabled, until.IsZero()}, []interface{}{true, true})
+	testEqual(t, "disableTimer = %+v, want %+v", disableTimer == nil, true)
+	db.getSetting(settingDisabled, &s)
+	testEqual(t, "getSetting() = %+v, want %+v", s, disabledSetting{Disabled: true})
+}
+
+func Test_loadDisabled(t *testing.T) {
+	db.Reset()
+	defer setDisabled(false, 0)
+
+	// Nothing persisted
+	testEqual(t, "loadDisabled() = %+v, want %+v", loadDisabled(), nil)
+	disabled, _ := disabledState()
+	testEqual(t, "disabledState() = %+v, want %+v", disabled, false)
+
+	// Timed disable which hasn't expired yet
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	db.putSetting(settingDisabled, disabledSetting{Disabled: true, Until: until})
+	testEqual(t, "loadDisabled() = %+v, want %+v", loadDisabled(), nil)
+	disabled, got := disabledState()
+	testEqual(t, "disabledState() = %+v, want %+v", []interface{}{disabled, got}, []interface{}{true, until})
+
+	// Timed disable which expired while not running
+	db.putSetting(settingDisabled, disabledSetting{Disabled: true, Until: time.Now().Add(-time.Minute)})
+	testEqual(t, "loadDisabled() = %+v, want %+v", loadDisabled(), nil)
+	disabled, _ = disabledState()
+	testEqual(t, "disabledState() = %+v, want %+v", disabled, false)
+}
+
+func Test_loadSettings(t *testing.T) {
+	db.Reset()
+	defer func() {
+		db.Reset()
+		blockMode = blockModeNXDomain
+		upstreams = &UpstreamPool{strategy: strategySequential}
+		forwards = &ForwardSet{}
+	}()
+
+	// Nothing persisted, so the flags apply
+	testEqual(t, "loadSettings() = %+v, want %+v", loadSettings(), nil)
+	testEqual(t, "currentSettings() = %+v, want %+v", currentSettings(), Settings{BlockMode: blockModeNXDomain, Upstreams: []string{}, Strategy: strategySequential, Forwards: map[string][]string{}})
+
+	db.putSetting(settingBlockMode, blockModeRefused)
+	db.putSetting(settingUpstreams, upstreamsSetting{Addrs: []string{"127.0.0.1:53"}, Strategy: strategyParallel})
+	testEqual(t, "loadSettings() = %+v, want %+v", loadSettings(), nil)
+	db.putSetting(settingForwards, map[string][]string{"corp.test": {"127.0.0.2:53"}})
+	testEqual(t, "loadSettings() = %+v, want %+v", loadSettings(), nil)
+	testEqual(t, "currentSettings() = %+v, want %+v", currentSettings(), Settings{BlockMode: blockModeRefused, Upstreams: []string{"127.0.0.1:53"}, Strategy: strategyParallel, Forwards: map[string][]string{"corp.test": {"127.0.0.2:53"}}})
+}
+
+func Test_setForwards(t *testing.T) {
+	db.Reset()
+	defer func() { forwards = &ForwardSet{} }()
+
+	old, _ := newForwardSet(map[string][]string{"corp.test": {"127.0.0.1:53"}})
+	forwards = old
+	fs, err := newForwardSet(map[string][]string{"Lab.test.": {"127.0.0.2:53"}})
+	testEqual(t, "newForwardSet() err = %+v, want %+v", err, nil)
+
+	testEqual(t, "setForwards() = %+v, want %+v", setForwards(fs), nil)
+	testEqual(t, "list() = %+v, want %+v", currentForwards().list(), map[string][]string{"lab.test": {"127.0.0.2:53"}})
+	testEqual(t, "old.pools['corp.test'].upstreams[0].isClosed() = %+v, want %+v", old.pools["corp.test"].upstreams[0].isClosed(), true)
+
+	var rules map[string][]string
+	db.getSetting(settingForwards, &rules)
+	testEqual(t, "getSetting() = %+v, want %+v", rules, map[string][]string{"lab.test": {"127.0.0.2:53"}})
+}
+
+func Test_setUpstreams(t *testing.T) {
+	db.Reset()
+	defer func() { upstreams = &UpstreamPool{strategy: strategySequential} }()
+	dnsCache = newCache(10)
+	defer func() { dnsCache = newCache(0) }()
+	dnsCache.put(testCacheMsg("test.test.", dns.TypeA, dns.RcodeSuccess, "test.test. 300 IN A 127.0.0.1"))
+
+	old := MustNewUpstreamPool([]string{"127.0.0.1:53"}, strategySequential)
+	upstreams = old
+
+	testEqual(t, "setUpstreams() = %+v, want %+v", setUpstreams([]string{"127.0.0.2:53"}, strategyFastest), nil)
+	testEqual(t, "addrs() = %+v, want %+v", currentUpstreams().addrs(), []string{"127.0.0.2:53"})
+	testEqual(t, "old.upstreams[0].isClosed() = %+v, want %+v", old.upstreams[0].isClosed(), true)
+	testEqual(t, "dnsCache.stats().Entries = %+v, want %+v", dnsCache.stats().Entries, 0)
+
+	// Invalid upstreams leave the current ones in place
+	testEqual(t, "setUpstreams() err != nil = %+v, want %+v", setUpstreams([]string{"ftp://127.0.0.1"}, strategyFastest) != nil, true)
+	testEqual(t, "addrs() = %+v, want %+v", currentUpstreams().addrs(), []string{"127.0.0.2:53"})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	statsInterval = 10 * time.Minute
+	statsBuckets  = 7 * 24 * 6 // 7 days worth of 10 minute buckets
+	statsTopN     = 10
+	maxStatsKeys  = 10000 // Per domain/client counter
+)
+
+// Stats periods
+const (
+	statsPeriodDay  = "24h"
+	statsPeriodWeek = "7d"
+)
+
+// Stats represents the query statistics, which are computed incrementally as
+// queries are answered (and reset on restart)
+type Stats struct {
+	mu       sync.Mutex
+	start    time.Time
+	total    uint64
+	blocked  uint64
+	blockedN *keyCounter // Blocked domain counts
+	allowedN *keyCounter // Allowed domain counts
+	clientsN *keyCounter // Client counts
+	buckets  [statsBuckets]statsBucket
+}
+
+type statsBucket struct {
+	start   int64 // Unix time of the start of the bucket
+	queries uint64
+	blocked uint64
+}
+
+// StatsCount represents a domain or client and its query count
+type StatsCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// StatsPoint represents the queries of a 10 minute interval
+type StatsPoint struct {
+	Time    time.Time `json:"time"`
+	Queries uint64    `json:"queries"`
+	Blocked uint64    `json:"blocked"`
+}
+
+// StatsSummary represents a snapshot of the query statistics
+type StatsSummary struct {
+	Since          time.Time    `json:"since"`
+	Total          uint64       `json:"total"`
+	Blocked        uint64       `json:"blocked"`
+	BlockedPercent float64      `json:"blockedPercent"`
+	TopBlocked     []StatsCount `json:"topBlocked"`
+	TopAllowed     []StatsCount `json:"topAllowed"`
+	TopClients     []StatsCount `json:"topClients"`
+	Period         string       `json:"period"`
+	Queries        []StatsPoint `json:"queries"`
+}
+
+func newStats() *Stats {
+	return &Stats{
+		start:    time.Now().UTC(),
+		blockedN: newKeyCounter(),
+		allowedN: newKeyCounter(),
+		clientsN: newKeyCounter(),
+	}
+}
+
+// add counts the passed (answered) query.
+func (s *Stats) add(e *QueryLogEntry) {
+	isBlocked := isBlockedDecision(e.Decision)
+	start := e.Time.Truncate(statsInterval).Unix()
+	i := (start / int64(statsInterval/time.Second)) % statsBuckets
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.total++
+	s.clientsN.add(e.Client)
+
+	if isBlocked {
+		s.blocked++
+		s.blockedN.add(e.Name)
+	} else {
+		s.allowedN.add(e.Name)
+	}
+
+	b := &s.buckets[i]
+	if b.start > start {
+		// Older than the period covered by the buckets
+		return
+	} else if b.start != start {
+		// Reuse the bucket from a week ago
+		*b = statsBucket{start: start}
+	}
+	b.queries++
+	if isBlocked {
+		b.blocked++
+	}
+}
+
+// summary returns a snapshot of the statistics, including the queries per 10
+// minute interval over the passed period (ending now).
+func (s *Stats) summary(period string, now time.Time) StatsSummary {
+	n := 24 * 6
+	if period == statsPeriodWeek {
+		n = statsBuckets
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sum := StatsSummary{
+		Since:      s.start,
+		Total:      s.total,
+		Blocked:    s.blocked,
+		TopBlocked: s.blockedN.top(statsTopN),
+		TopAllowed: s.allowedN.top(statsTopN),
+		TopClients: s.clientsN.top(statsTopN),
+		Period:     period,
+		Queries:    make([]StatsPoint, n),
+	}
+	if s.total > 0 {
+		sum.BlockedPercent = float64(s.blocked) * 100 / float64(s.total)
+	}
+
+	// Oldest first
+	last := now.UTC().Truncate(statsInterval)
+	for j := 0; j < n; j++ {
+		t := last.Add(-time.Duration(n-1-j) * statsInterval)
+		p := StatsPoint{Time: t}
+
+		start := t.Unix()
+		if b := s.buckets[(start/int64(statsInterval/time.Second))%statsBuckets]; b.start == start {
+			p.Queries, p.Blocked = b.queries, b.blocked
+		}
+
+		sum.Queries[j] = p
+	}
+
+	return sum
+}
+
+// keyCounter counts the queries per key (domain or client), keeping at most
+// maxStatsKeys keys. The counts are kept in a min-heap (see container/heap), so
+// that once it's full the least counted key is dropped in O(log n) to make room.
+type keyCounter struct {
+	counts []StatsCount
+	index  map[string]int // Position of each key in counts
+}
+
+func newKeyCounter() *keyCounter {
+	return &keyCounter{index: make(map[string]int)}
+}
+
+// add increments the count of the passed key.
+func (c *keyCounter) add(k string) {
+	if i, ok := c.index[k]; ok {
+		c.counts[i].Count++
+		heap.Fix(c, i)
+		return
+	}
+
+	if len(c.counts) >= maxStatsKeys {
+		heap.Pop(c)
+	}
+	heap.Push(c, StatsCount{Name: k, Count: 1})
+}
+
+// top returns the n highest counts (highest first).
+func (c *keyCounter) top(n int) []StatsCount {
+	var counts = append([]StatsCount{}, c.counts...)
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+
+		return counts[i].Name < counts[j].Name
+	})
+
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+
+	return counts
+}
+
+func (c *keyCounter) Len() int { return len(c.counts) }
+
+func (c *keyCounter) Less(i, j int) bool { return c.counts[i].Count < c.counts[j].Count }
+
+func (c *keyCounter) Swap(i, j int) {
+	c.counts[i], c.counts[j] = c.counts[j], c.counts[i]
+	c.index[c.counts[i].Name], c.index[c.counts[j].Name] = i, j
+}
+
+func (c *keyCounter) Push(x interface{}) {
+	sc := x.(StatsCount)
+	c.index[sc.Name] = len(c.counts)
+	c.counts = append(c.counts, sc)
+}
+
+func (c *keyCounter) Pop() interface{} {
+	sc := c.counts[len(c.counts)-1]
+	c.counts = c.counts[:len(c.counts)-1]
+	delete(c.index, sc.Name)
+	return sc
+}
+
+// StatsBar represents a bar of a queries over time chart, in a 100 unit high
+// SVG viewBox with 1 unit wide bars
+type StatsBar struct {
+	X       int
+	Height  float64
+	BHeight float64 // Height of the blocked part
+	Y       float64
+	BY      float64
+	Label   string
+}
+
+// statsBars returns the bars charting the passed points.
+func statsBars(points []StatsPoint) []StatsBar {
+	var max uint64
+	var bars = make([]StatsBar, len(points))
+
+	for _, p := range points {
+		if p.Queries > max {
+			max = p.Queries
+		}
+	}
+
+	for i, p := range points {
+		b := StatsBar{X: i, Label: p.Time.Local().Format("Jan 2 15:04")}
+		if max > 0 {
+			b.Height = float64(p.Queries) * 100 / float64(max)
+			b.BHeight = float64(p.Blocked) * 100 / float64(max)
+		}
+		b.Y, b.BY = 100-b.Height, 100-b.BHeight
+
+		bars[i] = b
+	}
+
+	return bars
+}
+
+// isValidStatsPeriod checks that the passed string is a known stats period.
+func isValidStatsPeriod(period string) bool {
+	return period == statsPeriodDay || period == statsPeriodWeek
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStats_add_summary(t *testing.T) {
+	now := time.Date(2017, 1, 8, 12, 5, 0, 0, time.UTC)
+	s := newStats()
+
+	s.add(&QueryLogEntry{Time: now, Client: "10.0.0.1", Name: "ads.test", Decision: decisionBlocked})
+	s.add(&QueryLogEntry{Time: now, Client: "10.0.0.1", Name: "ads.test", Decision: decisionCloaked})
+	s.add(&QueryLogEntry{Time: now, Client: "10.0.0.2", Name: "www.test", Decision: decisionCached})
+	s.add(&QueryLogEntry{Time: now.Add(-time.Hour), Client: "10.0.0.2", Name: "www.test", Decision: decisionAllowed})
+
+	// A week ago (which shares a bucket with now)
+	s.add(&QueryLogEntry{Time: now.Add(-7 * 24 * time.Hour), Client: "10.0.0.3", Name: "old.test", Decision: decisionAllowed})
+
+	sum := s.summary(statsPeriodDay, now)
+	testEqual(t, "summary().Total = %+v, want %+v", sum.Total, uint64(5))
+	testEqual(t, "summary().Blocked = %+v, want %+v", sum.Blocked, uint64(2))
+	testEqual(t, "summary().BlockedPercent = %+v, want %+v", sum.BlockedPercent, float64(40))
+	testEqual(t, "summary().TopBlocked = %+v, want %+v", sum.TopBlocked, []StatsCount{{"ads.test", 2}})
+	testEqual(t, "summary().TopAllowed = %+v, want %+v", sum.TopAllowed, []StatsCount{{"www.test", 2}, {"old.test", 1}})
+	testEqual(t, "summary().TopClients = %+v, want %+v", sum.TopClients, []StatsCount{{"10.0.0.1", 2}, {"10.0.0.2", 2}, {"10.0.0.3", 1}})
+	testEqual(t, "len(summary().Queries) = %+v, want %+v", len(sum.Queries), 144)
+
+	last := sum.Queries[len(sum.Queries)-1]
+	testEqual(t, "summary().Queries[143] = %+v, want %+v", last, StatsPoint{Time: now.Truncate(statsInterval), Queries: 3, Blocked: 2})
+	testEqual(t, "summary().Queries[137].Queries = %+v, want %+v", sum.Queries[137].Queries, uint64(1))
+	testEqual(t, "summary().Queries[0].Queries = %+v, want %+v", sum.Queries[0].Queries, uint64(0))
+
+	sum = s.summary(statsPeriodWeek, now)
+	testEqual(t, "len(summary(week).Queries) = %+v, want %+v", len(sum.Queries), statsBuckets)
+	testEqual(t, "summary(week).Period = %+v, want %+v", sum.Period, statsPeriodWeek)
+
+	// Later on, the old buckets are no longer reported
+	sum = s.summary(statsPeriodDay, now.Add(24*time.Hour))
+	testEqual(t, "summary(later).Queries[143].Queries = %+v, want %+v", sum.Queries[143].Queries, uint64(0))
+}
+
+func TestKeyCounter_add(t *testing.T) {
+	c := newKeyCounter()
+
+	c.add("twice")
+	c.add("twice")
+	for i := 1; i < maxStatsKeys; i++ {
+		c.add(strconv.Itoa(i))
+	}
+	testEqual(t, "Len() = %+v, want %+v", c.Len(), maxStatsKeys)
+
+	// Full, so a key which was only seen once is dropped
+	c.add("new")
+	c.add("new")
+	testEqual(t, "Len() = %+v, want %+v", c.Len(), maxStatsKeys)
+	testEqual(t, "top() = %+v, want %+v", c.top(2), []StatsCount{{"new", 2}, {"twice", 2}})
+
+	// The least counted keys are dropped first
+	c.add("newer")
+	testEqual(t, "Len() = %+v, want %+v", c.Len(), maxStatsKeys)
+	for _, k := range []string{"twice", "new", "newer"} {
+		i, ok := c.index[k]
+		testEqual(t, "counts[index[%s]] = %+v, want %+v", k, ok && c.counts[i].Name == k, true)
+	}
+}
+
+func TestKeyCounter_top(t *testing.T) {
+	c := newKeyCounter()
+	for _, k := range []string{"a", "b", "b", "b", "c", "c", "c", "d", "d"} {
+		c.add(k)
+	}
+
+	testEqual(t, "top() = %+v, want %+v", c.top(3), []StatsCount{{"b", 3}, {"c", 3}, {"d", 2}})
+	testEqual(t, "top(empty) = %+v, want %+v", newKeyCounter().top(3), []StatsCount{})
+}
+
+func Test_statsBars(t *testing.T) {
+	bars := statsBars([]StatsPoint{{Queries: 0}, {Queries: 4, Blocked: 1}, {Queries: 2, Blocked: 2}})
+
+	testEqual(t, "len(statsBars()) = %+v, want %+v", len(bars), 3)
+	testEqual(t, "statsBars()[0].Height = %+v, want %+v", bars[0].Height, float64(0))
+	testEqual(t, "statsBars()[1].Y = %+v, want %+v", bars[1].Y, float64(0))
+	testEqual(t, "statsBars()[1].BY = %+v, want %+v", bars[1].BY, float64(75))
+	testEqual(t, "statsBars()[2].Height = %+v, want %+v", bars[2].Height, float64(50))
+	testEqual(t, "statsBars()[2].X = %+v, want %+v", bars[2].X, 2)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subscription list formats
+const (
+	subscriptionFormatHosts   = "hosts"   // hosts file (or one domain per line)
+	subscriptionFormatAdblock = "adblock" // Adblock Plus style domain rules
+)
+
+const (
+	defaultSubscriptionInterval = "24h"
+	subscriptionCheckInterval   = time.Minute
+	subscriptionTimeout         = 30 * time.Second
+)
+
+var (
+	subscriptionClient = &http.Client{Timeout: subscriptionTimeout}
+	subscriptionMu     sync.Mutex // Serializes subscription refreshes
+
+	validName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`) // Subscription and client group names
+)
+
+// refreshSubscription fetches the named subscription's list (unless it is
+// unchanged since the last fetch) and updates the records which came from it.
+func refreshSubscription(name string) (*Subscription, error) {
+	subscriptionMu.Lock()
+	defer subscriptionMu.Unlock()
+
+	sub, err := db.getSubscription(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fetchSubscription(name, sub)
+	sub.LastUpdated = time.Now().UTC()
+	if err != nil {
+		sub.LastError = err.Error()
+	} else {
+		sub.LastError = ""
+	}
+
+	if err := db.putSubscription(name, sub); err != nil {
+		return nil, err
+	}
+
+	return sub, err
+}
+
+// fetchSubscription fetches the passed subscription's list, replacing the
+// records from the named source if it has changed.
+func fetchSubscription(name string, sub *Subscription) error {
+	req, err := http.NewRequest("GET", sub.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	// Make the request conditional, if possible
+	if sub.ETag != "" {
+		req.Header.Set("If-None-Match", sub.ETag)
+	}
+	if sub.LastModified != "" {
+		req.Header.Set("If-Modified-Since", sub.LastModified)
+	}
+
+	resp, err := subscriptionClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		// Unchanged since the last fetch
+		return nil
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	l, err := parseList(resp.Body, sub.Format)
+	if err != nil {
+		return err
+	}
+
+	skipped, err := db.replaceSourceRecords(name, l.Block)
+	if err != nil {
+		return err
+	}
+	if err := db.replaceSourceAllowlist(name, l.Allow); err != nil {
+		return err
+	}
+
+	sub.ETag = resp.Header.Get("ETag")
+	sub.LastModified = resp.Header.Get("Last-Modified")
+	sub.Count = len(l.Block)
+	sub.Skipped = skipped
+	sub.Exceptions = len(l.Allow)
+	sub.Unsupported = len(l.Unsupported)
+
+	return nil
+}
+
+// parseList parses the passed list according to its format.
+func parseList(r io.Reader, format string) (*List, error) {
+	switch format {
+	case subscriptionFormatHosts:
+		return parseHostsList(r)
+	case subscriptionFormatAdblock:
+		return parseAdblockList(r)
+	}
+
+	return nil, errors.New("unsupported format: " + format)
+}
+
+// refreshDueSubscriptions refreshes each enabled subscription whose refresh
+// interval has elapsed.
+func refreshDueSubscriptions() {
+	for name, sub := range db.getSubscriptions() {
+		if !sub.isDue(time.Now()) {
+			continue
+		}
+
+		if _, err := refreshSubscription(name); err != nil {
+			log.Printf("refreshSubscription(%s) Error: %s\n", name, err)
+		}
+	}
+}
+
+// scheduleSubscriptions periodically refreshes the subscriptions which are due.
+func scheduleSubscriptions() {
+	for {
+		refreshDueSubscriptions()
+		time.Sleep(subscriptionCheckInterval)
+	}
+}
+
+// isDue checks whether the subscription is enabled and its refresh interval
+// has elapsed.
+func (sub *Subscription) isDue(now time.Time) bool {
+	if !sub.Enabled {
+		return false
+	}
+
+	interval, err := time.ParseDuration(sub.Interval)
+	if err != nil {
+		return false
+	}
+
+	return !now.Before(sub.LastUpdated.Add(interval))
+}
+
+// isValid checks the subscription's user supplied fields, filling in defaults
+// for those which were omitted.
+func (sub *Subscription) isValid() bool {
+	if sub.Format == "" {
+		sub.Format = subscriptionFormatHosts
+	}
+	if sub.Interval == "" {
+		sub.Interval = defaultSubscriptionInterval
+	}
+
+	if !strings.HasPrefix(sub.URL, "http://") && !strings.HasPrefix(sub.URL, "https://") {
+		return false
+	}
+
+	if sub.Format != subscriptionFormatHosts && sub.Format != subscriptionFormatAdblock {
+		return false
+	}
+
+	interval, err := time.ParseDuration(sub.Interval)
+	return err == nil && interval >= time.Minute
+}
+
+// isValidName checks that the passed string is usable as a subscription or
+// client group name (and URL path segment).
+func isValidName(name string) bool {
+	return len(name) <= 64 && validName.MatchString(name)
+}
+
+// isValidSubscriptionName checks that the passed string is usable as a
+// subscription name. The name of the manual source of client groups is
+// reserved.
+func isValidSubscriptionName(name string) bool {
+	return isValidName(name) && name != sourceManual
+}
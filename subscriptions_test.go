@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ListServer represents a local blocklist host for testing
+type ListServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	body     string
+	requests int
+}
+
+// RunListServer starts a local HTTP server serving the passed list, with an
+// ETag derived from its contents.
+func RunListServer(body string) *ListServer {
+	ls := &ListServer{body: body}
+
+	ls.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ls.mu.Lock()
+		defer ls.mu.Unlock()
+
+		ls.requests++
+		etag := fmt.Sprintf(`"%d"`, len(ls.body))
+
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(ls.body))
+	}))
+
+	return ls
+}
+
+func (ls *ListServer) setBody(body string) {
+	ls.mu.Lock()
+	ls.body = body
+	ls.mu.Unlock()
+}
+
+func (ls *ListServer) requestCount() int {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	return ls.requests
+}
+
+func Test_refreshSubscription(t *testing.T) {
+	db.Reset()
+
+	ls := RunListServer("# Test list\n0.0.0.0 one.test\n0.0.0.0 Two.test\n0.0.0.0 manual.test\nlocalhost\n")
+	defer ls.Close()
+
+	// Not found
+	_, err := refreshSubscription("test")
+	testEqual(t, "refreshSubscription() err = %+v, want %+v", err, errSubscriptionNotFound)
+
+	if err := db.put("manual.test", nil); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+	if err := db.putSubscription("test", &Subscription{URL: ls.URL, Format: subscriptionFormatHosts, Enabled: true, Interval: "24h"}); err != nil {
+		t.Errorf("failed to putSubscription: %+v", err)
+	}
+
+	sub, err := refreshSubscription("test")
+	if err != nil {
+		t.Fatalf("refreshSubscription() Error: %s", err)
+	}
+	testEqual(t, "refreshSubscription() Count = %+v, want %+v", sub.Count, 3)
+	testEqual(t, "refreshSubscription() ETag = %+v, want %+v", sub.ETag, `"76"`)
+	testEqual(t, "refreshSubscription() LastUpdated = %+v, want %+v", sub.LastUpdated.IsZero(), false)
+	r, _ := db.get("two.test")
+	testEqual(t, "get() = %+v, want %+v", *r, stamped(Record{Source: "test"}))
+
+	// Manually added records are left alone
+	r, _ = db.get("manual.test")
+	testEqual(t, "get() = %+v, want %+v", *r, stamped(Record{}))
+
+	// Unchanged lists aren't processed again
+	if err := db.put("one.test", &Record{Paused: true, Source: "test"}); err != nil {
+		t.Errorf("failed to put: %+v", err)
+	}
+	if _, err = refreshSubscription("test"); err != nil {
+		t.Errorf("refreshSubscription() Error: %s", err)
+	}
+	testEqual(t, "requests = %+v, want %+v", ls.requestCount(), 2)
+
+	// Dropped records are removed, while the paused state of others is kept
+	ls.setBody("one.test\nmanual.test\n")
+	if sub, err = refreshSubscription("test"); err != nil {
+		t.Errorf("refreshSubscription() Error: %s", err)
+	}
+	testEqual(t, "refreshSubscription() Count = %+v, want %+v", sub.Count, 2)
+	_, err = db.get("two.test")
+	testEqual(t, "get() err = %+v, want %+v", err, errRecordNotFound)
+	r, _ = db.get("one.test")
+	testEqual(t, "get() = %+v, want %+v", *r, stamped(Record{Paused: true, Source: "test"}))
+	r, _ = db.get("manual.test")
+	testEqual(t, "get() = %+v, want %+v", *r, stamped(Record{}))
+	testEqual(t, "refreshSubscription() Skipped = %+v, want %+v", sub.Skipped, 1)
+
+	// Deleting a record which was skipped makes the next refresh add it
+	if err := db.delete("manual.test"); err != nil {
+		t.Errorf("failed to delete: %+v", err)
+	}
+	if sub, err = refreshSubscription("test"); err != nil {
+		t.Errorf("refreshSubscription() Error: %s", err)
+	}
+	testEqual(t, "refreshSubscription() Skipped = %+v, want %+v", sub.Skipped, 0)
+	r, _ = db.get("manual.test")
+	testEqual(t, "get() = %+v, want %+v", *r, stamped(Record{Source: "test"}))
+
+	// Errors are recorded
+	ls.Close()
+	sub, err = refreshSubscription("test")
+	testEqual(t, "refreshSubscription() err = %+v, want %+v", err != nil, true)
+	testEqual(t, "refreshSubscription() LastError = %+v, want %+v", sub.LastError != "", true)
+	sub, _ = db.getSubscription("test")
+	testEqual(t, "getSubscription() LastError = %+v, want %+v", sub.LastError != "", true)
+	testEqual(t, "getSubscription() Count = %+v, want %+v", sub.Count, 2)
+}
+
+func Test_refreshSubscription_adblock(t *testing.T) {
+	db.Reset()
+
+	ls := RunListServer("! Title: Test\n||ads.test^\n@@||allowed.ads.test^\n##.banner\n")
+	defer ls.Close()
+
+	if err := db.putSubscription("test", &Subscription{URL: ls.URL, Format: subscriptionFormatAdblock, Enabled: true, Interval: "24h"}); err != nil {
+		t.Errorf("failed to putSubscription: %+v", err)
+	}
+
+	sub, err := refreshSubscription("test")
+	if err != nil {
+		t.Fatalf("refreshSubscription() Error: %s", err)
+	}
+	testEqual(t, "refreshSubscription() Count = %+v, want %+v", sub.Count, 1)
+	testEqual(t, "refreshSubscription() Exceptions = %+v, want %+v", sub.Exceptions, 1)
+	testEqual(t, "refreshSubscription() Unsupported = %+v, want %+v", sub.Unsupported, 1)
+	testEqual(t, "getAllowlist() = %+v, want %+v", db.getAllowlist(), []string{"allowed.ads.test"})
+	testEqual(t, "isNameAllowed('ads.test') = %+v, want %+v", isNameAllowed("ads.test."), false)
+	testEqual(t, "isNameAllowed('allowed.ads.test') = %+v, want %+v", isNameAllowed("allowed.ads.test."), true)
+
+	// Dropped exceptions are removed
+	ls.setBody("||ads.test^\n")
+	if _, err = refreshSubscription("test"); err != nil {
+		t.Errorf("refreshSubscription() Error: %s", err)
+	}
+	testEqual(t, "getAllowlist() = %+v, want %+v", db.getAllowlist(), []string{})
+}
+
+func Test_refreshDueSubscriptions(t *testing.T) {
+	db.Reset()
+
+	ls := RunListServer("due.test\n")
+	defer ls.Close()
+
+	if err := db.putSubscription("due", &Subscription{URL: ls.URL, Format: subscriptionFormatHosts, Enabled: true, Interval: "1h"}); err != nil {
+		t.Errorf("failed to putSubscription: %+v", err)
+	}
+	if err := db.putSubscription("disabled", &Subscription{URL: ls.URL, Format: subscriptionFormatHosts, Interval: "1h"}); err != nil {
+		t.Errorf("failed to putSubscription: %+v", err)
+	}
+
+	refreshDueSubscriptions()
+	refreshDueSubscriptions()
+	testEqual(t, "requests = %+v, want %+v", ls.requestCount(), 1)
+	r, _ := db.get("due.test")
+	testEqual(t, "get() = %+v, want %+v", *r, stamped(Record{Source: "due"}))
+}
+
+func Test_parseList(t *testing.T) {
+	l, err := parseList(strings.NewReader("# comment\n127.0.0.1 localhost\n0.0.0.0 One.test.\ntwo.test # comment\n"), subscriptionFormatHosts)
+	testEqual(t, "parseList() = %+v, want %+v", l.Block, map[string]bool{"one.test": false, "two.test": false})
+	testEqual(t, "parseList() err = %+v, want %+v", err, nil)
+
+	l, _ = parseList(strings.NewReader("||one.test^\n@@||two.test^\n"), subscriptionFormatAdblock)
+	testEqual(t, "parseList(adblock) Block = %+v, want %+v", l.Block, map[string]bool{"one.test": false})
+	testEqual(t, "parseList(adblock) Allow = %+v, want %+v", l.Allow, map[string]bool{"two.test": true})
+
+	_, err = parseList(strings.NewReader(""), "csv")
+	testEqual(t, "parseList(csv) err = %+v, want %+v", err != nil, true)
+}
+
+func TestSubscription_isDue(t *testing.T) {
+	now := time.Now()
+
+	sub := &Subscription{Enabled: true, Interval: "1h"}
+	testEqual(t, "isDue() = %+v, want %+v", sub.isDue(now), true)
+
+	sub.LastUpdated = now.Add(-30 * time.Minute)
+	testEqual(t, "isDue() = %+v, want %+v", sub.isDue(now), false)
+
+	sub.LastUpdated = now.Add(-time.Hour)
+	testEqual(t, "isDue() = %+v, want %+v", sub.isDue(now), true)
+
+	sub.Enabled = false
+	testEqual(t, "isDue() = %+v, want %+v", sub.isDue(now), false)
+}
+
+func TestSubscription_isValid(t *testing.T) {
+	sub := &Subscription{URL: "https://example.test/hosts"}
+	testEqual(t, "isValid() = %+v, want %+v", sub.isValid(), true)
+	testEqual(t, "isValid() Format = %+v, want %+v", sub.Format, subscriptionFormatHosts)
+	testEqual(t, "isValid() Interval = %+v, want %+v", sub.Interval, defaultSubscriptionInterval)
+
+	for _, sub := range []*Subscription{
+		{URL: "ftp://example.test/hosts"},
+		{URL: "https://example.test/hosts", Format: "csv"},
+		{URL: "https://example.test/hosts", Interval: "daily"},
+		{URL: "https://example.test/hosts", Interval: "1s"},
+	} {
+		testEqual(t, "isValid() = %+v, want %+v", sub.isValid(), false)
+	}
+}
+
+func Test_isValidSubscriptionName(t *testing.T) {
+	testEqual(t, "isValidSubscriptionName() = %+v, want %+v", isValidSubscriptionName("ad-away_1.0"), true)
+	testEqual(t, "isValidSubscriptionName() = %+v, want %+v", isValidSubscriptionName(""), false)
+	testEqual(t, "isValidSubscriptionName() = %+v, want %+v", isValidSubscriptionName("ad/away"), false)
+	testEqual(t, "isValidSubscriptionName() = %+v, want %+v", isValidSubscriptionName(strings.Repeat("a", 65)), false)
+	testEqual(t, "isValidSubscriptionName() = %+v, want %+v", isValidSubscriptionName(sourceManual), false)
+
+	// Which is only reserved for subscriptions
+	testEqual(t, "isValidName() = %+v, want %+v", isValidName(sourceManual), true)
+	testEqual(t, "isValidName() = %+v, want %+v", isValidName("ad/away"), false)
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream selection strategies
+const (
+	strategySequential = "sequential" // Try each upstream in order
+	strategyRoundRobin = "roundrobin" // Rotate the first upstream tried
+	strategyParallel   = "parallel"   // Race all upstreams, first answer wins
+	strategyFastest    = "fastest"    // Try the lowest latency upstream first
+)
+
+const (
+	// maxUpstreamFailures is the number of consecutive failures after which an
+	// upstream is marked down.
+	maxUpstreamFailures = 3
+
+	// upstreamProbeInterval is the default delay between health probes of an
+	// upstream which has been marked down.
+	upstreamProbeInterval = 5 * time.Second
+
+	// upstreamTimeout is the dial, read and write timeout used for upstreams
+	// which aren't queried via dnsClient.
+	upstreamTimeout = 2 * time.Second
+
+	// maxIdleConns is the number of idle connections kept open to each DNS over
+	// TLS upstream.
+	maxIdleConns = 4
+
+	// dnsMessageType is the media type of DNS over HTTPS messages.
+	dnsMessageType = "application/dns-message"
+)
+
+var (
+	errNoUpstreams = errors.New("no upstream servers")
+
+	// upstreamLatencyBuckets are the upper bounds (in seconds) of the upstream
+	// latency histogram buckets.
+	upstreamLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+	// upstreamRootCAs is the set of CAs used to verify DNS over TLS and DNS over
+	// HTTPS upstreams (nil for the system's CAs).
+	upstreamRootCAs *x509.CertPool
+)
+
+// Upstream represents an upstream DNS server and its health state
+type Upstream struct {
+	Addr          string
+	probeInterval time.Duration
+	addr          string       // Address to dial
+	tlsConns      *tlsPool     // DNS over TLS connections (nil if not DoT)
+	httpClient    *http.Client // DNS over HTTPS client (nil if not DoH)
+	httpMethod    string       // DNS over HTTPS request method
+
+	mu       sync.Mutex
+	failures int
+	down     bool
+	probing  bool
+	latency  time.Duration
+	queries  uint64
+	errors   uint64
+	lastErr  string
+	rtts     []uint64      // Successful query counts per latency bucket (and +Inf)
+	rttSum   time.Duration // Total latency of the successful queries
+	closed   bool          // Replaced, so no longer probed
+}
+
+// UpstreamLatency represents a snapshot of an upstream's latency histogram
+type UpstreamLatency struct {
+	Addr    string
+	Buckets []uint64 // Cumulative counts per upstreamLatencyBuckets bound
+	Count   uint64
+	Sum     float64 // Seconds
+}
+
+// UpstreamStatus represents a snapshot of an upstream's health state
+type UpstreamStatus struct {
+	Addr      string  `json:"addr"`
+	Down      bool    `json:"down"`
+	Failures  int     `json:"failures"`
+	LatencyMs float64 `json:"latencyMs"`
+	Queries   uint64  `json:"queries"`
+	Errors    uint64  `json:"errors"`
+	LastError string  `json:"lastError,omitempty"`
+}
+
+// UpstreamPool represents the set of upstream DNS servers allowed queries are
+// proxied to
+type UpstreamPool struct {
+	strategy  string
+	upstreams []*Upstream
+	next      uint32
+}
+
+// tlsPool represents a pool of idle DNS over TLS connections to an upstream
+type tlsPool struct {
+	addr   string
+	config *tls.Config
+	idle   chan *dns.Conn
+}
+
+// newUpstreamPool returns a pool of the passed upstream addresses, using the
+// passed selection strategy.
+func newUpstreamPool(addrs []string, strategy string) (*UpstreamPool, error) {
+	p := &UpstreamPool{strategy: strategy}
+
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+
+		u, err := newUpstream(addr)
+		if err != nil {
+			return nil, err
+		}
+		p.upstreams = append(p.upstreams, u)
+	}
+
+	return p, nil
+}
+
+// newUpstream parses the passed upstream address, which is either a plain
+// "host:port" address, a DNS over TLS URL such as
+// "tls://1.1.1.1:853#cloudflare-dns.com" (the fragment being the name to
+// verify the server's certificate against), or a DNS over HTTPS URL such as
+// "https://dns.google/dns-query#8.8.8.8" (the optional fragment being a
+// bootstrap IP to connect to instead of resolving the host).
+func newUpstream(s string) (*Upstream, error) {
+	u := &Upstream{Addr: s, addr: s, probeInterval: upstreamProbeInterval}
+
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return u, nil
+	}
+
+	switch scheme := s[:i]; scheme {
+	case "tls":
+		addr := s[i+3:]
+		name := ""
+		if j := strings.IndexByte(addr, '#'); j >= 0 {
+			addr, name = addr[:j], addr[j+1:]
+		}
+
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			// Use the default DNS over TLS port
+			host = strings.Trim(addr, "[]")
+			addr = net.JoinHostPort(host, "853")
+		}
+		if host == "" {
+			return nil, fmt.Errorf("invalid upstream: %s", s)
+		}
+		if name == "" {
+			name = host
+		}
+
+		u.addr = addr
+		u.tlsConns = &tlsPool{
+			addr:   addr,
+			config: &tls.Config{ServerName: name, RootCAs: upstreamRootCAs},
+			idle:   make(chan *dns.Conn, maxIdleConns),
+		}
+	case "https":
+		pu, err := url.Parse(s)
+		if err != nil || pu.Hostname() == "" {
+			return nil, fmt.Errorf("invalid upstream: %s", s)
+		}
+
+		bootstrap := pu.Fragment
+		pu.Fragment = ""
+		if bootstrap != "" && net.ParseIP(bootstrap) == nil {
+			return nil, fmt.Errorf("invalid upstream bootstrap IP: %s", s)
+		}
+
+		u.addr = pu.String()
+		u.httpMethod = *dnsHTTPSMethod
+		u.httpClient = newHTTPSClient(pu, bootstrap)
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme: %s", scheme)
+	}
+
+	return u, nil
+}
+
+// exchange proxies the passed query upstream according to the pool's strategy,
+// returning the response and the upstream which answered it.
+func (p *UpstreamPool) exchange(r *dns.Msg) (*dns.Msg, *Upstream, error) {
+	us := p.candidates()
+	if len(us) == 0 {
+		return nil, nil, errNoUpstreams
+	}
+
+	if p.strategy == strategyParallel {
+		return p.race(r, us)
+	}
+
+	var err error
+	for _, u := range us {
+		var in *dns.Msg
+
+		if in, err = u.exchange(r); err != nil {
+			log.Printf("Exchange(%s) Error: %s\n", u.Addr, err)
+			continue
+		}
+
+		return in, u, nil
+	}
+
+	return nil, nil, err
+}
+
+// race sends the passed query to each of the passed upstreams at once, and
+// returns the first successful response.
+func (p *UpstreamPool) race(r *dns.Msg, us []*Upstream) (*dns.Msg, *Upstream, error) {
+	type result struct {
+		in  *dns.Msg
+		u   *Upstream
+		err error
+	}
+
+	results := make(chan result, len(us))
+	for _, u := range us {
+		go func(u *Upstream) {
+			in, err := u.exchange(r.Copy())
+			results <- result{in, u, err}
+		}(u)
+	}
+
+	var err error
+	for range us {
+		res := <-results
+		if res.err != nil {
+			log.Printf("Exchange(%s) Error: %s\n", res.u.Addr, res.err)
+			err = res.err
+			continue
+		}
+
+		return res.in, res.u, nil
+	}
+
+	return nil, nil, err
+}
+
+// candidates returns the upstreams to try, in the order they should be tried.
+// Upstreams which are down are skipped, unless every upstream is down.
+func (p *UpstreamPool) candidates() []*Upstream {
+	var us []*Upstream
+
+	for _, u := range p.upstreams {
+		if !u.isDown() {
+			us = append(us, u)
+		}
+	}
+	if len(us) == 0 {
+		us = append(us, p.upstreams...)
+	}
+	if len(us) < 2 {
+		return us
+	}
+
+	switch p.strategy {
+	case strategyRoundRobin:
+		n := int(atomic.AddUint32(&p.next, 1)-1) % len(us)
+		us = append(append([]*Upstream{}, us[n:]...), us[:n]...)
+	case strategyFastest:
+		// Untried upstreams (with no latency yet) sort first, so they get measured
+		sort.SliceStable(us, func(i, j int) bool {
+			return us[i].avgLatency() < us[j].avgLatency()
+		})
+	}
+
+	return us
+}
+
+// addrs returns the addresses of the upstreams.
+func (p *UpstreamPool) addrs() []string {
+	var addrs = []string{}
+
+	for _, u := range p.upstreams {
+		addrs = append(addrs, u.Addr)
+	}
+
+	return addrs
+}
+
+// close stops probing the upstreams, and closes their idle connections (once
+// the pool has been replaced).
+func (p *UpstreamPool) close() {
+	for _, u := range p.upstreams {
+		u.mu.Lock()
+		u.closed = true
+		u.mu.Unlock()
+
+		if u.tlsConns != nil {
+			u.tlsConns.close()
+		}
+	}
+}
+
+// status returns a snapshot of the health state of each upstream.
+func (p *UpstreamPool) status() []UpstreamStatus {
+	var ss []UpstreamStatus
+
+	for _, u := range p.upstreams {
+		ss = append(ss, u.status())
+	}
+
+	return ss
+}
+
+// latencies returns a snapshot of the latency histogram of each upstream.
+func (p *UpstreamPool) latencies() []UpstreamLatency {
+	var ls []UpstreamLatency
+
+	for _, u := range p.upstreams {
+		ls = append(ls, u.latencyHistogram())
+	}
+
+	return ls
+}
+
+// exchange sends the passed query to the upstream, and records the outcome.
+func (u *Upstream) exchange(r *dns.Msg) (*dns.Msg, error) {
+	in, rtt, err := u.query(r)
+	if err != nil {
+		u.failure(err)
+		return nil, err
+	}
+
+	u.success(rtt)
+	return in, nil
+}
+
+// query sends the passed query to the upstream over its protocol.
+func (u *Upstream) query(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if u.tlsConns != nil {
+		return u.tlsConns.exchange(r)
+	}
+	if u.httpClient != nil {
+		return u.httpsExchange(r)
+	}
+
+	return dnsClient.Exchange(r, u.addr)
+}
+
+func (u *Upstream) success(rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.queries++
+	u.failures = 0
+	u.down = false
+
+	if u.rtts == nil {
+		u.rtts = make([]uint64, len(upstreamLatencyBuckets)+1)
+	}
+	i := sort.SearchFloat64s(upstreamLatencyBuckets, rtt.Seconds())
+	u.rtts[i]++
+	u.rttSum += rtt
+
+	// Exponentially weighted moving average
+	if u.latency == 0 {
+		u.latency = rtt
+	} else {
+		u.latency = (u.latency*7 + rtt) / 8
+	}
+}
+
+func (u *Upstream) failure(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.queries++
+	u.errors++
+	u.failures++
+	u.lastErr = err.Error()
+
+	if u.failures >= maxUpstreamFailures && !u.down {
+		log.Printf("Upstream %s marked down after %d failures\n", u.Addr, u.failures)
+		u.down = true
+	}
+
+	if u.down && !u.probing {
+		u.probing = true
+		go u.probe()
+	}
+}
+
+// probe periodically queries an upstream which is down, until it recovers.
+func (u *Upstream) probe() {
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+
+	for {
+		time.Sleep(u.probeInterval)
+
+		if u.isClosed() {
+			return
+		}
+
+		if _, rtt, err := u.query(m); err == nil {
+			u.mu.Lock()
+			u.failures = 0
+			u.down = false
+			u.probing = false
+			u.latency = rtt
+			u.mu.Unlock()
+
+			log.Printf("Upstream %s recovered\n", u.Addr)
+			return
+		}
+	}
+}
+
+func (u *Upstream) isClosed() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.closed
+}
+
+func (u *Upstream) isDown() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.down
+}
+
+func (u *Upstream) avgLatency() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.latency
+}
+
+func (u *Upstream) status() UpstreamStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return UpstreamStatus{
+		Addr:      u.Addr,
+		Down:      u.down,
+		Failures:  u.failures,
+		LatencyMs: float64(u.latency) / float64(time.Millisecond),
+		Queries:   u.queries,
+		Errors:    u.errors,
+		LastError: u.lastErr,
+	}
+}
+
+func (u *Upstream) latencyHistogram() UpstreamLatency {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	l := UpstreamLatency{Addr: u.Addr, Buckets: make([]uint64, len(upstreamLatencyBuckets)), Sum: u.rttSum.Seconds()}
+	for i, n := range u.rtts {
+		l.Count += n
+		if i < len(l.Buckets) {
+			l.Buckets[i] = l.Count
+		}
+	}
+
+	return l
+}
+
+// exchange sends the passed query over an idle (or new) connection. An idle
+// connection may have been closed by the server, so the query is retried once
+// over a new connection if it fails.
+func (p *tlsPool) exchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	co, reused, err := p.get()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	in, err := exchangeConn(co, r)
+	if err != nil && reused {
+		co.Close()
+
+		if co, err = p.dial(); err != nil {
+			return nil, 0, err
+		}
+
+		start = time.Now()
+		in, err = exchangeConn(co, r)
+	}
+	if err != nil {
+		co.Close()
+		return nil, 0, err
+	}
+
+	p.put(co)
+	return in, time.Since(start), nil
+}
+
+// get returns an idle connection (if any) or dials a new one.
+func (p *tlsPool) get() (*dns.Conn, bool, error) {
+	select {
+	case co := <-p.idle:
+		return co, true, nil
+	default:
+	}
+
+	co, err := p.dial()
+	return co, false, err
+}
+
+// dial opens a new connection.
+func (p *tlsPool) dial() (*dns.Conn, error) {
+	return dns.DialTimeoutWithTLS("tcp-tls", p.addr, p.config, upstreamTimeout)
+}
+
+// put returns the passed connection to the pool, or closes it if the pool is
+// full.
+func (p *tlsPool) put(co *dns.Conn) {
+	select {
+	case p.idle <- co:
+	default:
+		co.Close()
+	}
+}
+
+// close closes the idle connections of the pool.
+func (p *tlsPool) close() {
+	for {
+		select {
+		case co := <-p.idle:
+			co.Close()
+		default:
+			return
+		}
+	}
+}
+
+// exchangeConn sends the passed query over the passed connection and reads the
+// response.
+func exchangeConn(co *dns.Conn, r *dns.Msg) (*dns.Msg, error) {
+	co.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if err := co.WriteMsg(r); err != nil {
+		return nil, err
+	}
+
+	in, err := co.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if in.Id != r.Id {
+		return nil, dns.ErrId
+	}
+
+	return in, nil
+}
+
+// newHTTPSClient returns an HTTP/2 capable client for the passed DNS over HTTPS
+// URL. If a bootstrap IP is passed, connections are made to it rather than to
+// the resolved host.
+func newHTTPSClient(u *url.URL, bootstrap string) *http.Client {
+	dialer := &net.Dialer{Timeout: upstreamTimeout}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     &tls.Config{ServerName: u.Hostname(), RootCAs: upstreamRootCAs},
+		TLSHandshakeTimeout: upstreamTimeout,
+		MaxIdleConnsPerHost: maxIdleConns,
+		ForceAttemptHTTP2:   true,
+	}
+
+	if bootstrap != "" {
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		addr := net.JoinHostPort(bootstrap, port)
+
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	return &http.Client{Transport: transport, Timeout: upstreamTimeout}
+}
+
+// httpsExchange sends the passed query to a DNS over HTTPS upstream (RFC 8484).
+func (u *Upstream) httpsExchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	var req *http.Request
+
+	// Use an ID of 0 in order to be HTTP cache friendly (RFC 8484 section 4.1)
+	q := r.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if u.httpMethod == http.MethodGet {
+		// Keep any query string of the upstream URL
+		var ru *url.URL
+		if ru, err = url.Parse(u.addr); err != nil {
+			return nil, 0, err
+		}
+		v := ru.Query()
+		v.Set("dns", base64.RawURLEncoding.EncodeToString(buf))
+		ru.RawQuery = v.Encode()
+
+		req, err = http.NewRequest(http.MethodGet, ru.String(), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, u.addr, bytes.NewReader(buf))
+		if req != nil {
+			req.Header.Set("Content-Type", dnsMessageType)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", dnsMessageType)
+
+	start := time.Now()
+	res, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected HTTP status: %s", res.Status)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != dnsMessageType {
+		return nil, 0, fmt.Errorf("unexpected Content-Type: %s", ct)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, 0, err
+	}
+	in.Id = r.Id
+
+	return in, time.Since(start), nil
+}
+
+// loadRootCAs reads the PEM encoded certificates in the passed file.
+func loadRootCAs(fname string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", fname)
+	}
+
+	return pool, nil
+}
+
+// currentUpstreams returns the upstream pool allowed queries are proxied to.
+func currentUpstreams() *UpstreamPool {
+	upstreamsMu.RLock()
+	defer upstreamsMu.RUnlock()
+
+	return upstreams
+}
+
+// isValidStrategy checks that the passed string is a known upstream selection
+// strategy.
+func isValidStrategy(strategy string) bool {
+	switch strategy {
+	case strategySequential, strategyRoundRobin, strategyParallel, strategyFastest:
+		return true
+	}
+
+	return false
+}
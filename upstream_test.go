@@ -0,0 +1,442 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// MustTestCertificate returns a pool holding a new self-signed CA, and a
+// certificate for the passed name (and 127.0.0.1) signed by that CA.
+func MustTestCertificate(name string) (*x509.CertPool, tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nogo test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		panic(err)
+	}
+	if ca, err = x509.ParseCertificate(caDER); err != nil {
+		panic(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		panic(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	return pool, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func RunLocalTLSDNSServer(laddr string, cert tls.Certificate) (*dns.Server, string, error) {
+	l, err := tls.Listen("tcp", laddr, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Act as a simple echo server
+	server := &dns.Server{Listener: l, Net: "tcp-tls", ReadTimeout: time.Hour, WriteTimeout: time.Hour}
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})
+
+	waitLock := sync.Mutex{}
+	waitLock.Lock()
+	server.NotifyStartedFunc = waitLock.Unlock
+
+	go func() {
+		server.ActivateAndServe()
+		l.Close()
+	}()
+
+	waitLock.Lock()
+	return server, l.Addr().String(), nil
+}
+
+func MustNewUpstreamPool(addrs []string, strategy string) *UpstreamPool {
+	p, err := newUpstreamPool(addrs, strategy)
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+func TestUpstreamPool_exchange(t *testing.T) {
+	es, eaddrstr, err := RunLocalDNSServer("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("unable to run echo test server: %v", err)
+	}
+	defer es.Shutdown()
+
+	// A closed port, so that exchanges fail
+	ds, daddrstr, err := RunLocalDNSServer("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("unable to run test server: %v", err)
+	}
+	ds.Shutdown()
+
+	for _, strategy := range []string{strategySequential, strategyRoundRobin, strategyParallel, strategyFastest} {
+		p := MustNewUpstreamPool([]string{daddrstr, eaddrstr}, strategy)
+
+		for i := 0; i < maxUpstreamFailures+1; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion("test.test.", dns.TypeA)
+			in, u, err := p.exchange(m)
+			if err != nil {
+				t.Errorf("%s: failed to exchange: %+v", strategy, err)
+				continue
+			}
+			testEqual(t, strategy+": exchange() Id = %+v, want %+v", in.Id, m.Id)
+			testEqual(t, strategy+": exchange() Upstream = %+v, want %+v", u.Addr, eaddrstr)
+		}
+
+		ss := p.status()
+		testEqual(t, strategy+": status()[1].Down = %+v, want %+v", ss[1].Down, false)
+		testEqual(t, strategy+": status()[1].Errors = %+v, want %+v", ss[1].Errors, uint64(0))
+		if strategy == strategySequential {
+			// The dead upstream was tried (and failed) until it was marked down
+			testEqual(t, strategy+": status()[0].Down = %+v, want %+v", ss[0].Down, true)
+			testEqual(t, strategy+": status()[0].Errors = %+v, want %+v", ss[0].Errors, uint64(maxUpstreamFailures))
+		}
+	}
+
+	// No upstreams
+	p := MustNewUpstreamPool([]string{""}, strategySequential)
+	_, _, err = p.exchange(new(dns.Msg))
+	testEqual(t, "exchange() err = %+v, want %+v", err, errNoUpstreams)
+}
+
+func TestUpstreamPool_latencies(t *testing.T) {
+	p := MustNewUpstreamPool([]string{"one", "two"}, strategySequential)
+	p.upstreams[0].success(3 * time.Millisecond)
+	p.upstreams[0].success(20 * time.Millisecond)
+	p.upstreams[0].success(5 * time.Second)
+
+	ls := p.latencies()
+	testEqual(t, "len(latencies()) = %+v, want %+v", len(ls), 2)
+	testEqual(t, "latencies()[0].Addr = %+v, want %+v", ls[0].Addr, "one")
+	testEqual(t, "latencies()[0].Count = %+v, want %+v", ls[0].Count, uint64(3))
+	testEqual(t, "latencies()[0].Buckets = %+v, want %+v", ls[0].Buckets, []uint64{0, 0, 1, 1, 2, 2, 2, 2, 2, 2, 2})
+	testEqual(t, "latencies()[0].Sum = %+v, want %+v", ls[0].Sum, 5.023)
+	testEqual(t, "latencies()[1].Count = %+v, want %+v", ls[1].Count, uint64(0))
+}
+
+func TestUpstreamPool_candidates(t *testing.T) {
+	p := MustNewUpstreamPool([]string{"one", "two", "three"}, strategyRoundRobin)
+	testEqual(t, "candidates()[0] = %+v, want %+v", p.candidates()[0].Addr, "one")
+	testEqual(t, "candidates()[0] = %+v, want %+v", p.candidates()[0].Addr, "two")
+	testEqual(t, "candidates()[0] = %+v, want %+v", p.candidates()[0].Addr, "three")
+	testEqual(t, "candidates()[0] = %+v, want %+v", p.candidates()[0].Addr, "one")
+
+	p = MustNewUpstreamPool([]string{"one", "two", "three"}, strategyFastest)
+	p.upstreams[0].latency = 30 * time.Millisecond
+	p.upstreams[1].latency = 10 * time.Millisecond
+	p.upstreams[2].latency = 20 * time.Millisecond
+	us := p.candidates()
+	testEqual(t, "candidates() = %+v, want %+v", []string{us[0].Addr, us[1].Addr, us[2].Addr}, []string{"two", "three", "one"})
+
+	// Down upstreams are skipped
+	p = MustNewUpstreamPool([]string{"one", "two"}, strategySequential)
+	p.upstreams[0].down = true
+	us = p.candidates()
+	testEqual(t, "len(candidates()) = %+v, want %+v", len(us), 1)
+	testEqual(t, "candidates()[0] = %+v, want %+v", us[0].Addr, "two")
+
+	// Unless they are all down
+	p.upstreams[1].down = true
+	testEqual(t, "len(candidates()) = %+v, want %+v", len(p.candidates()), 2)
+}
+
+func TestUpstream_probe(t *testing.T) {
+	es, eaddrstr, err := RunLocalDNSServer("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("unable to run echo test server: %v", err)
+	}
+	defer es.Shutdown()
+
+	u, _ := newUpstream(eaddrstr)
+	u.probeInterval = 10 * time.Millisecond
+	u.failures = maxUpstreamFailures - 1
+	u.failure(errNoUpstreams)
+	testEqual(t, "isDown() = %+v, want %+v", u.isDown(), true)
+
+	for i := 0; i < 100 && u.isDown(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	testEqual(t, "isDown() = %+v, want %+v", u.isDown(), false)
+	testEqual(t, "status().Failures = %+v, want %+v", u.status().Failures, 0)
+}
+
+func RunLocalHTTPSDNSServer(cert tls.Certificate) *httptest.Server {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf []byte
+		var err error
+
+		if r.ProtoMajor != 2 {
+			http.Error(w, http.StatusText(505), 505)
+			return
+		}
+
+		// Act as a simple echo server
+		if r.Method == http.MethodGet {
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			buf, err = ioutil.ReadAll(r.Body)
+		}
+		q := new(dns.Msg)
+		if err != nil || q.Unpack(buf) != nil || len(q.Question) != 1 {
+			http.Error(w, http.StatusText(400), 400)
+			return
+		}
+		// Along with the method, echo any other query string parameters
+		txt := []string{r.Method}
+		for k := range r.URL.Query() {
+			if k != "dns" {
+				txt = append(txt, k)
+			}
+		}
+		m := new(dns.Msg)
+		m.SetReply(q)
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: txt,
+		})
+
+		out, _ := m.Pack()
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(out)
+	}))
+	ts.EnableHTTP2 = true
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+
+	return ts
+}
+
+func Test_newUpstream(t *testing.T) {
+	u, err := newUpstream("8.8.8.8:53")
+	testEqual(t, "newUpstream(8.8.8.8:53) err = %+v, want %+v", err, nil)
+	testEqual(t, "newUpstream(8.8.8.8:53) addr = %+v, want %+v", u.addr, "8.8.8.8:53")
+	testEqual(t, "newUpstream(8.8.8.8:53) tlsConns = %+v, want %+v", u.tlsConns == nil, true)
+
+	u, err = newUpstream("tls://1.1.1.1:853#cloudflare-dns.com")
+	testEqual(t, "newUpstream(tls://1.1.1.1:853#cloudflare-dns.com) err = %+v, want %+v", err, nil)
+	testEqual(t, "newUpstream(tls://1.1.1.1:853#cloudflare-dns.com) Addr = %+v, want %+v", u.Addr, "tls://1.1.1.1:853#cloudflare-dns.com")
+	testEqual(t, "newUpstream(tls://1.1.1.1:853#cloudflare-dns.com) addr = %+v, want %+v", u.addr, "1.1.1.1:853")
+	testEqual(t, "newUpstream(tls://1.1.1.1:853#cloudflare-dns.com) ServerName = %+v, want %+v", u.tlsConns.config.ServerName, "cloudflare-dns.com")
+
+	u, _ = newUpstream("tls://dns.quad9.net")
+	testEqual(t, "newUpstream(tls://dns.quad9.net) addr = %+v, want %+v", u.addr, "dns.quad9.net:853")
+	testEqual(t, "newUpstream(tls://dns.quad9.net) ServerName = %+v, want %+v", u.tlsConns.config.ServerName, "dns.quad9.net")
+
+	u, _ = newUpstream("tls://[2606:4700:4700::1111]#cloudflare-dns.com")
+	testEqual(t, "newUpstream(tls://[2606:4700:4700::1111]) addr = %+v, want %+v", u.addr, "[2606:4700:4700::1111]:853")
+
+	u, err = newUpstream("https://dns.google/dns-query#8.8.8.8")
+	testEqual(t, "newUpstream(https://dns.google/dns-query#8.8.8.8) err = %+v, want %+v", err, nil)
+	testEqual(t, "newUpstream(https://dns.google/dns-query#8.8.8.8) addr = %+v, want %+v", u.addr, "https://dns.google/dns-query")
+	testEqual(t, "newUpstream(https://dns.google/dns-query#8.8.8.8) httpMethod = %+v, want %+v", u.httpMethod, "POST")
+
+	_, err = newUpstream("https://dns.google/dns-query#dns.google")
+	testEqual(t, "newUpstream(https://dns.google/dns-query#dns.google) err = %+v, want %+v", err != nil, true)
+	_, err = newUpstream("https:///dns-query")
+	testEqual(t, "newUpstream(https:///dns-query) err = %+v, want %+v", err != nil, true)
+	_, err = newUpstream("tls://#test.test")
+	testEqual(t, "newUpstream(tls://#test.test) err = %+v, want %+v", err != nil, true)
+	_, err = newUpstream("quic://1.1.1.1")
+	testEqual(t, "newUpstream(quic://1.1.1.1) err = %+v, want %+v", err != nil, true)
+}
+
+func TestUpstream_exchange_tls(t *testing.T) {
+	pool, cert := MustTestCertificate("dns.test")
+	s, addrstr, err := RunLocalTLSDNSServer("127.0.0.1:0", cert)
+	if err != nil {
+		t.Fatalf("unable to run TLS test server: %v", err)
+	}
+	defer s.Shutdown()
+
+	u, err := newUpstream("tls://" + addrstr + "#dns.test")
+	if err != nil {
+		t.Fatalf("failed to parse upstream: %v", err)
+	}
+	u.tlsConns.config.RootCAs = pool
+
+	for i := 0; i < 2; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("test.test.", dns.TypeA)
+		in, err := u.exchange(m)
+		if err != nil {
+			t.Fatalf("failed to exchange: %+v", err)
+		}
+		testEqual(t, "exchange() Id = %+v, want %+v", in.Id, m.Id)
+
+		// The connection is kept for reuse
+		testEqual(t, "len(idle) = %+v, want %+v", len(u.tlsConns.idle), 1)
+	}
+
+	// A stale pooled connection is replaced
+	co := <-u.tlsConns.idle
+	co.Close()
+	u.tlsConns.put(co)
+	m := new(dns.Msg)
+	m.SetQuestion("test.test.", dns.TypeA)
+	if _, err := u.exchange(m); err != nil {
+		t.Errorf("failed to exchange over stale connection: %+v", err)
+	}
+	testEqual(t, "len(idle) = %+v, want %+v", len(u.tlsConns.idle), 1)
+
+	// Only one stale pooled connection is retried, before dialing a new one
+	u.tlsConns.idle = make(chan *dns.Conn, 2)
+	for i := 0; i < 2; i++ {
+		co, err := u.tlsConns.dial()
+		if err != nil {
+			t.Fatalf("failed to dial: %+v", err)
+		}
+		co.Close()
+		u.tlsConns.put(co)
+	}
+	if _, err := u.exchange(m); err != nil {
+		t.Errorf("failed to exchange over stale connections: %+v", err)
+	}
+	testEqual(t, "len(idle) = %+v, want %+v", len(u.tlsConns.idle), 2)
+
+	// Certificate name mismatch
+	u, _ = newUpstream("tls://" + addrstr + "#other.test")
+	u.tlsConns.config.RootCAs = pool
+	_, err = u.exchange(m)
+	testEqual(t, "exchange() err = %+v, want %+v", err != nil, true)
+	testEqual(t, "status().Errors = %+v, want %+v", u.status().Errors, uint64(1))
+
+	// Untrusted certificate
+	u, _ = newUpstream("tls://" + addrstr + "#dns.test")
+	_, err = u.exchange(m)
+	testEqual(t, "exchange() err = %+v, want %+v", err != nil, true)
+}
+
+func TestUpstream_exchange_https(t *testing.T) {
+	pool, cert := MustTestCertificate("dns.test")
+	ts := RunLocalHTTPSDNSServer(cert)
+	defer ts.Close()
+
+	upstreamRootCAs = pool
+	defer func() { upstreamRootCAs = nil }()
+
+	// Connect to the bootstrap IP, since dns.test doesn't resolve
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	u, err := newUpstream("https://dns.test:" + port + "/dns-query#127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to parse upstream: %v", err)
+	}
+
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		u.httpMethod = method
+
+		m := new(dns.Msg)
+		m.SetQuestion("test.test.", dns.TypeA)
+		in, err := u.exchange(m)
+		if err != nil {
+			t.Fatalf("%s: failed to exchange: %+v", method, err)
+		}
+		testEqual(t, method+": exchange() Id = %+v, want %+v", in.Id, m.Id)
+		testEqual(t, method+": exchange() Question = %+v, want %+v", in.Question, m.Question)
+		testEqual(t, method+": exchange() Answer = %+v, want %+v", in.Answer[0].(*dns.TXT).Txt, []string{method})
+	}
+
+	// Upstream URL with a query string
+	u, _ = newUpstream("https://dns.test:" + port + "/dns-query?ct#127.0.0.1")
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		u.httpMethod = method
+
+		m := new(dns.Msg)
+		m.SetQuestion("test.test.", dns.TypeA)
+		in, err := u.exchange(m)
+		if err != nil {
+			t.Fatalf("%s: failed to exchange with query string: %+v", method, err)
+		}
+		testEqual(t, method+": exchange() Answer = %+v, want %+v", in.Answer[0].(*dns.TXT).Txt, []string{method, "ct"})
+	}
+
+	// Untrusted certificate
+	upstreamRootCAs = nil
+	u, _ = newUpstream("https://dns.test:" + port + "/dns-query#127.0.0.1")
+	m := new(dns.Msg)
+	m.SetQuestion("test.test.", dns.TypeA)
+	_, err = u.exchange(m)
+	testEqual(t, "exchange() err = %+v, want %+v", err != nil, true)
+
+	// Unexpected response
+	upstreamRootCAs = pool
+	u, _ = newUpstream("https://dns.test:" + port + "/dns-query#127.0.0.1")
+	u.addr = ts.URL
+	u.httpClient.Transport.(*http.Transport).TLSClientConfig.ServerName = "dns.test"
+	m.Question = nil
+	_, err = u.exchange(m)
+	testEqual(t, "exchange() err = %+v, want %+v", err != nil, true)
+}
+
+func Test_loadRootCAs(t *testing.T) {
+	_, err := loadRootCAs("/nonexistent/ca.pem")
+	testEqual(t, "loadRootCAs(nonexistent) err = %+v, want %+v", err != nil, true)
+
+	f, err := ioutil.TempFile("", "nogo-ca-")
+	if err != nil {
+		t.Fatalf("failed to create TempFile: %+v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate\n")
+	f.Close()
+
+	_, err = loadRootCAs(f.Name())
+	testEqual(t, "loadRootCAs(invalid) err = %+v, want %+v", err != nil, true)
+}
+
+func Test_isValidStrategy(t *testing.T) {
+	testEqual(t, "isValidStrategy(sequential) = %+v, want %+v", isValidStrategy("sequential"), true)
+	testEqual(t, "isValidStrategy(fastest) = %+v, want %+v", isValidStrategy("fastest"), true)
+	testEqual(t, "isValidStrategy('') = %+v, want %+v", isValidStrategy(""), false)
+}
@@ -49,6 +49,12 @@ label {
   margin-bottom: .5rem;
 }
 
+label.label-inline {
+  display: inline-block;
+  font-weight: normal;
+  margin-left: .5rem;
+}
+
 .container {
   margin: 0 auto;
   max-width: 112.0rem;
@@ -135,6 +141,22 @@ input {
 
 #back { flex: 0 0 0%; }
 
+#stats { margin-bottom: 15px; }
+
+#stats svg {
+  width: 100%;
+  height: 100px;
+  background-color: #f4f5f6;
+}
+
+#stats svg .queries { fill: #9b4dca; }
+
+#stats svg .blocked { fill: #c0392b; }
+
+#stats ol { margin-bottom: 0; }
+
+#stats li { margin-bottom: 0; }
+
 .row.record:hover { background-color: #eee; }
 
 .column.actions {
@@ -152,6 +174,24 @@ input {
 
 .actions form.hide { display: none; }
 
+.actions select.pause-for {
+  display: inline-block;
+  vertical-align: text-top;
+  width: auto;
+  height: 2rem;
+  margin: 0 0 0 10px;
+  padding: 0 .4rem;
+  font-size: 1.2rem;
+}
+
+.paused-until { color: #606c76; }
+
+.record-meta {
+  display: block;
+  color: #606c76;
+  font-size: 1.2rem;
+}
+
 .icon {
   display: inline-block;
   vertical-align: text-top;
@@ -187,6 +227,27 @@ input {
   background: url(data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAABcAAAAYCAYAAAARfGZ1AAAABmJLR0QA/wD/AP+gvaeTAAAACXBIWXMAAAsTAAALEwEAmpwYAAACr0lEQVRIx61VXUhTYRj+GsloFYhUA0egUCZUfMuJCjoPYzEHWzO1WAbahRWSyBK8KWMSGNTFZEG1IUEKkrDIikmyixiWXRgkRjBDZxfDYNRseBFGBE/bWdv5ztnfSbp4b8553ud7v/d9nvcjlFJSLJqvQTcVgf3tV3RgZVgLSnfIySPFQSjpDsAejKQihDULOFr6v8iVF4Ms+TcLOmnZtshbPKh48h3HsewsT10/P3nDADSP1qFFzKdJYHcWIIfCehec/y/J4g/YcEd/OC/5aajdIeE7YuN1iQOUOclbbgrEmYTJVm1e8l5U+6T4mCd5QImYvA9VExJgFGtGDCavn68tUPXOoo3N4dU03XWMIYfycgAdLCiOsAHDaUUUGihUPS9gY3Mj+GxK/ye1V6Blr8cn36Bq2WrhUOqYl7THf66GJ7dOik/G+0s6sUmKS7HWAd1zhmMLL7nkcEn/PJu4Kalars6x1/FOgrlK9xF3mB3iayNMdLfUoXa/MJMIlk04SfdIMIrWKWG4vIyd+kPEy7YEj5tYKWWiG5rRRZhXAA6zFypyudHkglWkGnfTEfJA1KunnNQI8gKKUxMC+UIcbUkDkpElgTyMT2a5SylrufnZnv+0YIBqSBfTT/46Y+bqfyY/j4NekdZTcyGN12EIZsto13Zbws8u6qxPypnQRux3hSQm+DBUI/dB0A+jjjXhx9+wYqS5MrNbuFvi6vkD1u9pcyqHqdgyKibm8zbu16fXbxqoku6X1I7ZMiA6V4nbTJvaoeybRpVrTuzsTK8HBYMJlXSibCgoBks3XiCc/38Ym2Y8NJbnf4kSS6h/JruiYhHHugEe0wEZbygUZ8ag9S4VJ+WHtzF+FO25jVdQYmd9CdsvoOHZKkwzq7C9icK6FIfhC36dAF6p0VNo4JT8AfOI0HtZhtVRAAAAAElFTkSuQmCC) left bottom no-repeat;
 }
 
+#power-remaining,
+#disable-presets {
+  position: absolute;
+  top: 24px;
+  right: 44px;
+  color: #fff;
+  font-size: 1.4rem;
+}
+
+#disable-presets button {
+  margin: 0 0 0 .5rem;
+  padding: 0 .8rem;
+  border: 0.1rem solid #fff;
+  border-radius: .4rem;
+  background-color: transparent;
+  color: #fff;
+  font-size: 1.2rem;
+  line-height: 2rem;
+  cursor: pointer;
+}
+
 .icon-download {
   margin: 0 8px;
   background: url(data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAYAAAAf8/9hAAAABmJLR0QA/wD/AP+gvaeTAAAACXBIWXMAAAsTAAALEwEAmpwYAAAA7klEQVQ4y2P4//8/AyUYhwQD6yIXhiAGDqkUBmG9TIbSG6GkGiBUzM/QySCsPB+MfQ/MBwqyDn8DGFh3ODPUwjXhwp13mnC7YA2Dtg0bks3o2H36fIbb/5XxewFoiCs/FkOcpsxmuPJfjrgwQDcEh2aIAasY5EQYGBwZRJS84dh1gdsRmCEgzasmyCWJoKkxzvVmOPNfkuFUOEMFVv9Grmtn2L9f5NxcBql6U4ZGrGoWvq1lOBSGL+S18MfIdIIGIGGl9PkJ3gwFDMLe8xnSnNy0GZi6wAbcKmFIZ+CVm02UISjYfD7D6k8pDJRmZwAKde5oo6iShAAAAABJRU5ErkJggg==) left bottom no-repeat;
@@ -265,7 +326,7 @@ var indexTmpl = `<!doctype html>
   <noscript>
     <style type="text/css">
       /* Power button and trash action requires JavaScript */
-      #power-button, .actions button.icon-trash { display: none; }
+      #power-button, #disable-presets, .actions button.icon-trash { display: none; }
     </style>
   </noscript>
 </head>
@@ -274,9 +335,19 @@ var indexTmpl = `<!doctype html>
     <div class="row">
       <div class="column">
         <a class="heading" href="/">nogo</a>
+        {{- if .isDisabled }}
+        <span id="power-remaining"></span>
+        {{- else }}
+        <span id="disable-presets">Disable for<!--
+       --><button data-for="5m">5m</button><!--
+       --><button data-for="30m">30m</button><!--
+       --><button data-for="1h">1h</button>
+        </span>
+        {{- end }}
         <button id="power-button" class="icon icon-power"
           {{- if .isDisabled }}
           title="[Disabled] Click to enable nogo" data-disabled
+          {{- if not .disabledUntil.IsZero }} data-until="{{ .disabledUntil.Format "2006-01-02T15:04:05Z07:00" }}"{{ end }}
           {{- else }}
           title="[Enabled] Click to disable nogo"
           {{- end -}}
@@ -287,6 +358,22 @@ var indexTmpl = `<!doctype html>
 
   <main id="main" class="container">
     <div id="inputs" class="row">
+      {{- if .isQueryLog }}
+      <div class="column">
+        <form action="/querylog/">
+          <label for="name-input">Search Query Log</label>
+          <input id="client-input" name="client" type="search" value="{{ .filter.Client }}" placeholder="Client IP" autocomplete="off">
+          <input id="name-input" name="name" type="search" value="{{ .filter.Name }}" placeholder="Part of a domain name" autocomplete="off">
+          <select id="decision-input" name="decision">
+            <option value="">Any decision</option>
+            {{- range $d := .decisions }}
+            <option value="{{ $d }}"{{ if eq $d $.filter.Decision }} selected{{ end }}>{{ $d }}</option>
+            {{- end }}
+          </select>
+          <button type="submit">Search</button>
+        </form>
+      </div>
+      {{- else }}
       <div class="column">
         <form action="/">
           <label for="search-input">Search Records</label>
@@ -294,13 +381,155 @@ var indexTmpl = `<!doctype html>
         </form>
       </div>
       <div class="column">
-        <form action="/records/" method="post">
-          <label for="key-input">Add Record</label>
+        {{- if .isSubscriptions }}
+        <form action="/subscriptions/" method="post">
+          <label for="url-input">Add Subscription</label>
+          <input id="name-input" name="name" type="text" value="" placeholder="Name (e.g. adaway)" autocomplete="off" title="Letters, digits, dots, dashes and underscores only." pattern="[A-Za-z0-9._\-]+" required>
+          <input id="url-input" name="url" type="url" value="" placeholder="Type the URL of a hosts file." autocomplete="off" required>
+          <select id="format-input" name="format">
+            <option value="hosts">hosts file</option>
+            <option value="adblock">Adblock Plus rules</option>
+          </select>
+          <button type="submit">Subscribe</button>
+        </form>
+        {{- else if .isGroups }}
+        <form action="/groups/" method="post">
+          <label for="clients-input">Add Client Group</label>
+          <input id="name-input" name="name" type="text" value="" placeholder="Name (e.g. kids)" autocomplete="off" title="Letters, digits, dots, dashes and underscores only." pattern="[A-Za-z0-9._\-]+" required>
+          <input id="clients-input" name="clients" type="text" value="" placeholder="Client IPs and CIDR ranges (e.g. 192.168.1.20, 10.0.0.0/24)" autocomplete="off" required>
+          <input id="sources-input" name="sources" type="text" value="" placeholder="Record sources (subscription names and manual), or empty for all" autocomplete="off">
+          <select id="blockmode-input" name="blockMode">
+            <option value="">Default block mode</option>
+            {{- range $m := .blockModes }}
+            <option value="{{ $m }}">{{ $m }}</option>
+            {{- end }}
+          </select>
+          <label class="label-inline"><input name="noAllowlist" type="checkbox" value="1"> Ignore the allowlist</label>
+          <button type="submit">Add Group</button>
+        </form>
+        {{- else if .isLocalRecords }}
+        <form action="/localrecords/" method="post">
+          <label for="name-input">Add Local Record</label>
+          <input id="name-input" name="name" type="text" value="" placeholder="Name (e.g. nas.lan)" autocomplete="off" required>
+          <select id="type-input" name="type">
+            {{- range $t := .localRecordTypes }}
+            <option value="{{ $t }}">{{ $t }}</option>
+            {{- end }}
+          </select>
+          <input id="value-input" name="value" type="text" value="" placeholder="Address, target name or text (e.g. 192.168.1.10)" autocomplete="off" required>
+          <button type="submit">Add Record</button>
+        </form>
+        {{- else }}
+        <form action="{{ if .isAllowlist }}/allowlist/{{ else }}/records/{{ end }}" method="post">
+          <label for="key-input">{{ if .isAllowlist }}Add Allowlisted Domain{{ else }}Add Record{{ end }}</label>
           <input id="key-input" name="key" type="text" value="" minlength="3" placeholder="Type a domain name, then press Enter." autocomplete="off" title="Must be a properly formatted domain." pattern=".+\..{2,}" required>
         </form>
+        {{- end }}
+      </div>
+      {{- end }}
+    </div>
+
+    {{- if .isAllowlist }}
+    <div id="records-header" class="row">
+      <div id="back" class="column">
+        <a href="/">&laquo; Back</a>
+      </div>
+      <div id="count" class="column text-right">
+        <span id="data-count">{{ len .allowlist }}</span> allowlisted domains (always allowed, even if blocked).
+      </div>
+    </div>
+
+    {{- range .allowlist }}
+    <div id="{{ . }}" class="row record">
+      <div class="column actions"><!--
+     --><button class="icon icon-trash" title="Remove from allowlist" data-id="{{ . }}" data-allowlist></button>
+      </div>
+      <div class="column key">{{ . }}</div>
+    </div>
+    {{- end }}
+    {{- else if .isQueryLog }}
+    <div id="records-header" class="row">
+      <div id="back" class="column">
+        <a href="/">&laquo; Back</a>
+      </div>
+      <div id="count" class="column text-right">
+        <span id="data-count">{{ len .querylog }}</span> most recent queries.
+      </div>
+    </div>
+
+    {{- range .querylog }}
+    <div class="row record">
+      <div class="column key">
+        {{ .Name }} <small>{{ .Type }}</small> &middot; <strong>{{ .Decision }}</strong>{{ if .Rule }} by {{ .Rule }}{{ end }}{{ if .CNAME }} via CNAME {{ .CNAME }}{{ end }}<br>
+        <small>{{ .Time.Format "2006-01-02 15:04:05 MST" }} &middot; {{ .Client }}{{ if .Group }} ({{ .Group }}){{ end }}{{ if .Upstream }} &middot; via {{ .Upstream }}{{ end }} &middot; {{ .Rcode }} in {{ printf "%.1f" .Latency }}ms</small>
+      </div>
+    </div>
+    {{- end }}
+    {{- else if .isGroups }}
+    <div id="records-header" class="row">
+      <div id="back" class="column">
+        <a href="/">&laquo; Back</a>
+      </div>
+      <div id="count" class="column text-right">
+        <span id="data-count">{{ len .groups }}</span> client groups.
+      </div>
+    </div>
+
+    {{- range $k, $v := .groups }}
+    <div id="{{ $k }}" class="row record">
+      <div class="column actions"><!--
+     --><button class="icon icon-trash" title="Delete group" data-id="{{ $k }}" data-group></button>
+      </div>
+      <div class="column key">
+        {{ $k }} &middot; {{ range $i, $c := $v.Clients }}{{ if $i }}, {{ end }}{{ $c }}{{ end }}<br>
+        <small>{{ if $v.Sources }}{{ range $i, $s := $v.Sources }}{{ if $i }}, {{ end }}{{ $s }}{{ end }}{{ else }}all sources{{ end }}{{ if $v.NoAllowlist }} &middot; ignoring the allowlist{{ end }}{{ if $v.BlockMode }} &middot; {{ $v.BlockMode }} block mode{{ end }}</small>
+      </div>
+    </div>
+    {{- end }}
+    {{- else if .isLocalRecords }}
+    <div id="records-header" class="row">
+      <div id="back" class="column">
+        <a href="/">&laquo; Back</a>
+      </div>
+      <div id="count" class="column text-right">
+        <span id="data-count">{{ len .localRecords }}</span> local names (answered authoritatively).
       </div>
     </div>
 
+    {{- range $k, $v := .localRecords }}
+    <div id="{{ $k }}" class="row record">
+      <div class="column actions"><!--
+     --><button class="icon icon-trash" title="Delete local records" data-id="{{ $k }}" data-localrecords></button>
+      </div>
+      <div class="column key">
+        {{ $k }}<br>
+        <small>{{ range $i, $r := $v }}{{ if $i }} &middot; {{ end }}{{ $r.Type }} {{ $r.Value }}{{ end }}</small>
+      </div>
+    </div>
+    {{- end }}
+    {{- else if .isSubscriptions }}
+    <div id="records-header" class="row">
+      <div id="back" class="column">
+        <a href="/">&laquo; Back</a>
+      </div>
+      <div id="count" class="column text-right">
+        <span id="data-count">{{ len .subscriptions }}</span> blocklist subscriptions.
+      </div>
+    </div>
+
+    {{- range $k, $v := .subscriptions }}
+    <div id="{{ $k }}" class="row record">
+      <div class="column actions"><!--
+     --><button class="icon icon-download" title="Refresh now" data-id="{{ $k }}" data-subscription></button><!--
+     --><button class="icon icon-trash" title="Delete subscription (and its records)" data-id="{{ $k }}" data-subscription></button>
+      </div>
+      <div class="column key">
+        {{ $k }}{{ if not $v.Enabled }} (disabled){{ end }} &middot; {{ $v.Count }} records{{ if $v.Exceptions }} &middot; {{ $v.Exceptions }} exceptions{{ end }}{{ if $v.Unsupported }} &middot; {{ $v.Unsupported }} unsupported rules skipped{{ end }}<br>
+        <small>{{ $v.URL }} &middot; every {{ $v.Interval }}{{ if not $v.LastUpdated.IsZero }} &middot; updated {{ $v.LastUpdated.Format "2006-01-02 15:04 MST" }}{{ end }}{{ if $v.LastError }} &middot; error: {{ $v.LastError }}{{ end }}</small>
+      </div>
+    </div>
+    {{- end }}
+    {{- else }}
     <div id="records-header" class="row">
       {{- if or .data .q .p }}
       <div id="back" class="column">
@@ -308,7 +537,7 @@ var indexTmpl = `<!doctype html>
       </div>
       {{- else }}
       <div class="column">
-        <a href="/?p=1">List Paused Records</a>
+        <a href="/?p=1">List Paused Records</a> &middot; <a href="/allowlist/">Allowlist</a> &middot; <a href="/subscriptions/">Subscriptions</a> &middot; <a href="/groups/">Groups</a> &middot; <a href="/localrecords/">Local Records</a> &middot; <a href="/querylog/">Query Log</a>
       </div>
       {{ end }}
       <div id="count" class="column text-right">
@@ -320,6 +549,52 @@ var indexTmpl = `<!doctype html>
       </div>
     </div>
 
+    {{- if .stats }}
+    <div id="stats">
+      <div class="row">
+        <div class="column">
+          <strong>{{ .stats.Total }}</strong> queries, <strong>{{ .stats.Blocked }}</strong> blocked ({{ printf "%.1f" .stats.BlockedPercent }}%) since {{ .stats.Since.Local.Format "2006-01-02 15:04 MST" }}.
+        </div>
+      </div>
+      <div class="row">
+        <div class="column">
+          <svg viewBox="0 0 {{ len .chart }} 100" preserveAspectRatio="none" role="img" aria-label="Queries over the last 24 hours">
+            {{- range .chart }}
+            <g><title>{{ .Label }}</title><rect class="queries" x="{{ .X }}" y="{{ printf "%.2f" .Y }}" width="1" height="{{ printf "%.2f" .Height }}"/><rect class="blocked" x="{{ .X }}" y="{{ printf "%.2f" .BY }}" width="1" height="{{ printf "%.2f" .BHeight }}"/></g>
+            {{- end }}
+          </svg>
+          <small>Queries (and blocked queries) per 10 minutes over the last 24 hours.</small>
+        </div>
+      </div>
+      <div class="row">
+        <div class="column">
+          <strong>Top Blocked</strong>
+          <ol>
+            {{- range .stats.TopBlocked }}
+            <li>{{ .Name }} <small>({{ .Count }})</small></li>
+            {{- end }}
+          </ol>
+        </div>
+        <div class="column">
+          <strong>Top Allowed</strong>
+          <ol>
+            {{- range .stats.TopAllowed }}
+            <li>{{ .Name }} <small>({{ .Count }})</small></li>
+            {{- end }}
+          </ol>
+        </div>
+        <div class="column">
+          <strong>Top Clients</strong>
+          <ol>
+            {{- range .stats.TopClients }}
+            <li>{{ .Name }} <small>({{ .Count }})</small></li>
+            {{- end }}
+          </ol>
+        </div>
+      </div>
+    </div>
+    {{- end }}
+
     {{- range $k, $v := .data }}
     <div id="{{ $k }}" class="row record">
       <div class="column actions"><!--
@@ -328,7 +603,14 @@ var indexTmpl = `<!doctype html>
      --><form action="/records/" method="post" class="pause-form {{ if $v.Paused }}hide{{ end }}">
           <input type="hidden" name="key" value="{{ $k }}" />
           <input type="hidden" name="paused" value="1" />
-          <button class="icon icon-pause" type="submit" title="Pause" data-id="{{ $k }}"></button>
+          <select name="for" class="pause-for" title="Pause for">
+            <option value="">&infin;</option>
+            <option value="5m">5m</option>
+            <option value="30m">30m</option>
+            <option value="1h">1h</option>
+            <option value="24h">1d</option>
+          </select><!-- clear white-space
+       --><button class="icon icon-pause" type="submit" title="Pause" data-id="{{ $k }}"></button>
         </form><!-- clear white-space
      --><form action="/records/" method="post" class="resume-form {{ if not $v.Paused }}hide{{ end }}">
           <input type="hidden" name="key" value="{{ $k }}" />
@@ -340,9 +622,18 @@ var indexTmpl = `<!doctype html>
           tunneling.
      --><button class="icon icon-trash" title="Delete" data-id="{{ $k }}"></button>
       </div>
-      <div class="column key">{{ $k }}</div>
+      <div class="column key">{{ $k }}{{ if $v.Paused }}{{ with $v.PausedUntil }} <small class="paused-until">(paused until {{ .Format "Jan 2 15:04 MST" }})</small>{{ end }}{{ end }}
+        <small class="record-meta">
+          {{- if $v.Source }}Subscription: {{ $v.Source }}{{ else if $v.File }}Imported from {{ $v.File }}{{ else }}Added manually{{ end }}
+          {{- with $v.Created }} &middot; added {{ .Format "Jan 2, 2006" }}{{ end }}
+          {{- with $v.Updated }} &middot; updated {{ .Format "Jan 2, 2006" }}{{ end }}
+          {{- if $v.Hits }} &middot; {{ $v.Hits }} hits{{ with $v.LastHit }} (last {{ .Format "Jan 2 15:04 MST" }}){{ end }}{{ end }}
+          {{- with $v.Comment }} &middot; <em>{{ . }}</em>{{ end -}}
+        </small>
+      </div>
     </div>
     {{- end }}
+    {{- end }}
   </main>
 
   <footer id="footer" class="container">
@@ -350,15 +641,20 @@ var indexTmpl = `<!doctype html>
   </footer>
 
   <script type="text/javascript">
-    function togglePower() {
+    function togglePower(duration) {
       var btn = document.getElementById('power-button');
       var disabled = btn.dataset.disabled === undefined ? true : false;
+      var settings = { disabled: disabled };
+
+      if (disabled && duration) {
+        settings.for = duration;
+      }
 
       btn.classList.add('processing');
 
       var req = new Request('/api/settings/', {
         method: 'PUT',
-        body: JSON.stringify({ disabled: disabled })
+        body: JSON.stringify(settings)
       });
 
       fetch(req)
@@ -366,14 +662,8 @@ var indexTmpl = `<!doctype html>
         btn.classList.remove('processing');
 
         if (res.ok) {
-          // Toggle power button
-          if (disabled) {
-            btn.setAttribute('data-disabled', '');
-            btn.title = '[Disabled] Click to enable nogo';
-          } else {
-            btn.removeAttribute('data-disabled');
-            btn.title = '[Enabled] Click to disable nogo';
-          }
+          // Reload, to show the remaining time (or the disable presets)
+          location.reload();
         } else {
           // Shouldn't happen
           alert('ERROR: ' + res.status + ' ' + res.statusText);
@@ -381,15 +671,44 @@ var indexTmpl = `<!doctype html>
       });
     }
 
+    function showRemaining() {
+      var btn = document.getElementById('power-button');
+      var remaining = Math.ceil((Date.parse(btn.dataset.until) - Date.now()) / 1000);
+
+      if (remaining <= 0) {
+        // Re-enabled
+        location.reload();
+        return;
+      }
+
+      var h = Math.floor(remaining / 3600);
+      var m = Math.floor(remaining % 3600 / 60);
+      var s = remaining % 60;
+      var text = (h ? h + ':' + (m < 10 ? '0' : '') : '') + m + ':' + (s < 10 ? '0' : '') + s;
+
+      document.getElementById('power-remaining').innerHTML = text + ' left';
+      btn.title = '[Disabled for ' + text + '] Click to enable nogo';
+    }
+
     function pauseRecord(key) {
+      var rec = { paused: true };
+      var duration = document.getElementById(key).querySelector('.pause-for').value;
+
+      if (duration) {
+        rec.for = duration;
+      }
+
       var req = new Request('/api/records/' + key, {
         method: 'PUT',
-        body: JSON.stringify({paused: true})
+        body: JSON.stringify(rec)
       });
 
       fetch(req)
       .then(function(res) {
-        if (res.ok) {
+        if (res.ok && duration) {
+          // Reload, to show when the pause expires
+          location.reload();
+        } else if (res.ok) {
           // Hide pause, show resume
           document.getElementById(key).querySelector('.pause-form').classList.add('hide');
           document.getElementById(key).querySelector('.resume-form').classList.remove('hide');
@@ -409,7 +728,11 @@ var indexTmpl = `<!doctype html>
       fetch(req)
       .then(function(res) {
         if (res.ok) {
-          // Hide resume, show pause
+          // Hide resume (and the pause expiry), show pause
+          var until = document.getElementById(key).querySelector('.paused-until');
+          if (until) {
+            until.remove();
+          }
           document.getElementById(key).querySelector('.resume-form').classList.add('hide');
           document.getElementById(key).querySelector('.pause-form').classList.remove('hide');
         } else {
@@ -442,11 +765,126 @@ var indexTmpl = `<!doctype html>
       });
     }
 
+    function deleteAllowlisted(key) {
+      if (!confirm('Are you sure you want to remove this domain from the allowlist?')) {
+        return;
+      }
+
+      var req = new Request('/api/allowlist/' + key, {method: 'DELETE'});
+
+      fetch(req)
+      .then(function(res) {
+        if (res.ok) {
+          // remove domain
+          document.getElementById(key).remove();
+
+          // decrement count
+          document.getElementById('data-count').innerHTML = parseInt(document.getElementById('data-count').innerHTML) - 1;
+        } else {
+          // Shouldn't happen
+          alert('ERROR: ' + res.status + ' ' + res.statusText);
+        }
+      });
+    }
+
+    function refreshSubscription(name) {
+      var req = new Request('/api/subscriptions/' + name + '/refresh', {method: 'POST'});
+
+      fetch(req)
+      .then(function(res) {
+        if (res.ok) {
+          // Show the updated subscription
+          location.reload();
+        } else {
+          alert('ERROR: ' + res.status + ' ' + res.statusText);
+        }
+      });
+    }
+
+    function deleteSubscription(name) {
+      if (!confirm('Are you sure you want to delete this subscription and its records?')) {
+        return;
+      }
+
+      var req = new Request('/api/subscriptions/' + name, {method: 'DELETE'});
+
+      fetch(req)
+      .then(function(res) {
+        if (res.ok) {
+          // remove subscription
+          document.getElementById(name).remove();
+
+          // decrement count
+          document.getElementById('data-count').innerHTML = parseInt(document.getElementById('data-count').innerHTML) - 1;
+        } else {
+          // Shouldn't happen
+          alert('ERROR: ' + res.status + ' ' + res.statusText);
+        }
+      });
+    }
+
+    function deleteGroup(name) {
+      if (!confirm('Are you sure you want to delete this group?')) {
+        return;
+      }
+
+      var req = new Request('/api/groups/' + name, {method: 'DELETE'});
+
+      fetch(req)
+      .then(function(res) {
+        if (res.ok) {
+          // remove group
+          document.getElementById(name).remove();
+
+          // decrement count
+          document.getElementById('data-count').innerHTML = parseInt(document.getElementById('data-count').innerHTML) - 1;
+        } else {
+          // Shouldn't happen
+          alert('ERROR: ' + res.status + ' ' + res.statusText);
+        }
+      });
+    }
+
+    function deleteLocalRecords(name) {
+      if (!confirm('Are you sure you want to delete the local records of this name?')) {
+        return;
+      }
+
+      var req = new Request('/api/localrecords/' + name, {method: 'DELETE'});
+
+      fetch(req)
+      .then(function(res) {
+        if (res.ok) {
+          // remove local records
+          document.getElementById(name).remove();
+
+          // decrement count
+          document.getElementById('data-count').innerHTML = parseInt(document.getElementById('data-count').innerHTML) - 1;
+        } else {
+          // Shouldn't happen
+          alert('ERROR: ' + res.status + ' ' + res.statusText);
+        }
+      });
+    }
+
     document.getElementById('power-button').addEventListener('click', function (evt) {
       togglePower();
       evt.preventDefault();
     });
 
+    [].forEach.call(
+      document.querySelectorAll('#disable-presets button'),
+      el => el.addEventListener('click', function (evt) {
+        togglePower(this.dataset.for);
+        evt.preventDefault();
+      })
+    );
+
+    if (document.getElementById('power-button').dataset.until !== undefined) {
+      showRemaining();
+      setInterval(showRemaining, 1000);
+    }
+
     [].forEach.call(
       document.getElementsByClassName('icon-pause'),
       el => el.addEventListener('click', function (evt) {
@@ -463,10 +901,27 @@ var indexTmpl = `<!doctype html>
       })
     );
 
+    [].forEach.call(
+      document.querySelectorAll('button.icon-download'),
+      el => el.addEventListener('click', function () {
+        refreshSubscription(this.dataset.id);
+      })
+    );
+
     [].forEach.call(
       document.getElementsByClassName('icon-trash'),
       el => el.addEventListener('click', function () {
-        deleteRecord(this.dataset.id);
+        if (this.dataset.allowlist !== undefined) {
+          deleteAllowlisted(this.dataset.id);
+        } else if (this.dataset.subscription !== undefined) {
+          deleteSubscription(this.dataset.id);
+        } else if (this.dataset.group !== undefined) {
+          deleteGroup(this.dataset.id);
+        } else if (this.dataset.localrecords !== undefined) {
+          deleteLocalRecords(this.dataset.id);
+        } else {
+          deleteRecord(this.dataset.id);
+        }
       })
     );
   </script>